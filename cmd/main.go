@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -69,16 +70,41 @@ func run(logger log.Logger) error {
 
 	// Connect to the VM Manager.
 	vmManager, err := vmmgr.New(logger, entity.NodeInstance{
-		LibVirtURI:      cfg.VMMgr.URI,
-		LibVirtImageDir: cfg.VMMgr.ImageDir})
+		LibVirtURI:             cfg.VMMgr.URI,
+		LibVirtImageDir:        cfg.VMMgr.ImageDir,
+		StatsInterval:          time.Duration(cfg.VMMgr.StatsInterval) * time.Second,
+		StatsRetention:         time.Duration(cfg.VMMgr.StatsRetention) * time.Second,
+		StatsRollup1mRetention: time.Duration(cfg.VMMgr.StatsRollup1mRetention) * time.Second,
+		StatsRollup5mRetention: time.Duration(cfg.VMMgr.StatsRollup5mRetention) * time.Second,
+		ResizeHeadroom:         cfg.VMMgr.ResizeHeadroom,
+		BlockJobTimeout:        time.Duration(cfg.VMMgr.BlockJobTimeout) * time.Second})
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := vmManager.Close(); err != nil {
+			logger.Error(err)
+		}
+	}()
+
+	// Report the disk images left behind, e.g. by a crash while creating a VM.
+	orphans, err := vmManager.OrphanedImages()
+	if err != nil {
+		logger.Errorf("failed to look for orphaned images: %v", err)
+	}
+	for _, path := range orphans {
+		logger.Infof("orphaned image %s belongs to no VM", path)
+	}
 
+	// Requests derive from a base context cancelled on shutdown, so that
+	// long-lived streams (e.g. events) do not hold the server.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	hs := &http.Server{
-		Addr:    cfg.Address,
-		Handler: server.BuildHandler(logger, cfg, Version, trans, producer, vmManager),
+		Addr:        cfg.Address,
+		Handler:     server.BuildHandler(logger, cfg, Version, trans, producer, vmManager),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
 	}
+	hs.RegisterOnShutdown(cancelBase)
 
 	// Start server.
 	go func() {
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"os"
 
 	"github.com/spf13/viper"
@@ -20,7 +21,29 @@ type VMMgrCfg struct {
 	URI string `mapstructure:"uri"`
 	// Location of the disk images (e.g QCOW2 images).
 	ImageDir string `mapstructure:"image_dir"`
-
+	// How guests are asked to shut down: acpi or agent. Defaults to acpi.
+	ShutdownMode string `mapstructure:"shutdown_mode"`
+	// Seconds to wait for a guest to shut down. Defaults to 60.
+	ShutdownTimeout int `mapstructure:"shutdown_timeout"`
+	// Power off guests which did not shut down in time. Defaults to true.
+	ShutdownFallback bool `mapstructure:"shutdown_fallback"`
+	// Seconds between two samples of the VMs usage, must be positive.
+	// Defaults to 10.
+	StatsInterval int `mapstructure:"stats_interval"`
+	// Seconds for which the usage of the VMs is kept. Defaults to 3600.
+	StatsRetention int `mapstructure:"stats_retention"`
+	// Seconds for which the usage of the VMs averaged over a minute is kept.
+	// Defaults to 86400.
+	StatsRollup1mRetention int `mapstructure:"stats_rollup_1m_retention"`
+	// Seconds for which the usage of the VMs averaged over five minutes is
+	// kept. Defaults to 604800.
+	StatsRollup5mRetention int `mapstructure:"stats_rollup_5m_retention"`
+	// How many times their vCPUs and memory VMs can be grown to without a
+	// reboot. Defaults to 2.
+	ResizeHeadroom uint `mapstructure:"resize_headroom"`
+	// Seconds after which the block jobs, e.g. flattening the disks of a
+	// running VM, are aborted. Defaults to 3600.
+	BlockJobTimeout int `mapstructure:"block_job_timeout"`
 }
 
 // Config represents our application config.
@@ -63,6 +86,17 @@ func Load(path string) (*Config, error) {
 	// Extension not needed.
 	viper.SetConfigName(name)
 
+	// Defaults for the optional settings.
+	viper.SetDefault("libvirt.shutdown_mode", "acpi")
+	viper.SetDefault("libvirt.shutdown_timeout", 60)
+	viper.SetDefault("libvirt.shutdown_fallback", true)
+	viper.SetDefault("libvirt.stats_interval", 10)
+	viper.SetDefault("libvirt.stats_retention", 3600)
+	viper.SetDefault("libvirt.stats_rollup_1m_retention", 86400)
+	viper.SetDefault("libvirt.stats_rollup_5m_retention", 604800)
+	viper.SetDefault("libvirt.resize_headroom", 2)
+	viper.SetDefault("libvirt.block_job_timeout", 3600)
+
 	// Load the configuration from disk.
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -75,5 +109,10 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	// Without sampling, the stats of the VMs would never be available.
+	if c.VMMgr.StatsInterval <= 0 {
+		return nil, errors.New("libvirt.stats_interval must be positive")
+	}
+
 	return &c, err
 }
@@ -0,0 +1,57 @@
+package entity
+
+import "time"
+
+// EventVersion is the version of the event envelope schema. It is bumped on
+// every breaking change so consumers can handle several versions at once.
+const EventVersion = 1
+
+// EventType represents the kind of VM lifecycle transition.
+type EventType string
+
+// VM lifecycle event types.
+const (
+	EventVMCreated         EventType = "vm.created"
+	EventVMStarted         EventType = "vm.started"
+	EventVMStopped         EventType = "vm.stopped"
+	EventVMRebooted        EventType = "vm.rebooted"
+	EventVMDeleted         EventType = "vm.deleted"
+	EventVMCrashed         EventType = "vm.crashed"
+	EventVMPaused          EventType = "vm.paused"
+	EventVMResumed         EventType = "vm.resumed"
+	EventVMSaved           EventType = "vm.saved"
+	EventVMReset           EventType = "vm.reset"
+	EventVMOperationFailed EventType = "vm.operation_failed"
+
+	// Reported by the hypervisor only.
+	EventVMShutdown    EventType = "vm.shutdown"
+	EventVMPMSuspended EventType = "vm.pmsuspended"
+	EventVMWatchdog    EventType = "vm.watchdog"
+	EventVMIOError     EventType = "vm.io_error"
+)
+
+// Event actors.
+const (
+	// ActorAPI is used for transitions requested through the API.
+	ActorAPI = "api"
+	// ActorHypervisor is used for transitions observed on the hypervisor
+	// which were not requested through the API.
+	ActorHypervisor = "hypervisor"
+)
+
+// Event is the envelope published for every VM lifecycle transition.
+type Event struct {
+	Version   int         `json:"version"`
+	ID        string      `json:"id"`
+	Type      EventType   `json:"type"`
+	VMID      string      `json:"vm_id"`
+	VMName    string      `json:"vm_name,omitempty"`
+	Node      string      `json:"node"`
+	Actor     string      `json:"actor"`
+	Timestamp time.Time   `json:"timestamp"`
+	Before    VMStateType `json:"before,omitempty"`
+	After     VMStateType `json:"after,omitempty"`
+	Operation string      `json:"operation,omitempty"`
+	Detail    string      `json:"detail,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
@@ -0,0 +1,15 @@
+package entity
+
+// Image represents a base image VMs are created from.
+type Image struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	Flavor      string `json:"flavor"`
+	OSFamily    string `json:"os_family"`
+	OSVersion   string `json:"os_version"`
+	Arch        string `json:"arch"`
+	DefaultUser string `json:"default_user,omitempty"`
+	MinDisk     uint64 `json:"min_disk"`               // In GiB
+	Format      string `json:"format,omitempty"`       // Detected from the file
+	VirtualSize uint64 `json:"virtual_size,omitempty"` // In bytes, detected from the file
+}
@@ -0,0 +1,39 @@
+package entity
+
+import "time"
+
+// JobStatus represents the execution status of an asynchronous job.
+type JobStatus string
+
+// Job execution status.
+const (
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+	JobStatusFailed    JobStatus = "failed"
+)
+
+// JobError describes why a job failed.
+type JobError struct {
+	Code    string `json:"code,omitempty"` // Same as the error responses
+	Message string `json:"message"`
+}
+
+// Job represents an asynchronous operation performed on a VM.
+type Job struct {
+	ID         string      `json:"id"`
+	Operation  string      `json:"operation"`
+	VMID       string      `json:"vm_id,omitempty"`
+	Status     JobStatus   `json:"status"`
+	Progress   int         `json:"progress"`
+	Error      *JobError   `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+// Done returns true when the job reached a final status.
+func (j Job) Done() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed
+}
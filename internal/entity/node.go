@@ -1,6 +1,22 @@
 package entity
 
+import "time"
+
 type NodeInstance struct {
 	LibVirtURI      string `json:"libvirt_uri"`
 	LibVirtImageDir string `json:"libvirt_image_dir"`
+	// Interval between two samples of the VMs usage, 10s when zero.
+	StatsInterval time.Duration `json:"stats_interval"`
+	// Period for which the usage of the VMs is kept.
+	StatsRetention time.Duration `json:"stats_retention"`
+	// Periods for which the usage of the VMs averaged over a minute and over
+	// five minutes is kept, 24h and 7 days when zero.
+	StatsRollup1mRetention time.Duration `json:"stats_rollup_1m_retention"`
+	StatsRollup5mRetention time.Duration `json:"stats_rollup_5m_retention"`
+	// How many times their vCPUs and memory at creation VMs can be grown
+	// to without a reboot, within the resources of the host.
+	ResizeHeadroom uint `json:"resize_headroom"`
+	// Time after which the block jobs, e.g. flattening the disks of a running
+	// VM, are aborted, 1h when zero.
+	BlockJobTimeout time.Duration `json:"block_job_timeout"`
 }
@@ -0,0 +1,33 @@
+package entity
+
+import "time"
+
+// SnapshotType represents where the snapshot data is stored.
+type SnapshotType string
+
+// Snapshot types.
+const (
+	// Internal snapshots are stored inside the qcow2 disks of the VM.
+	SnapshotInternal SnapshotType = "internal"
+	// External snapshots freeze the disks and redirect the writes to new
+	// overlay files.
+	SnapshotExternal SnapshotType = "external"
+)
+
+// Snapshot represents a point-in-time capture of a VM.
+type Snapshot struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Type        SnapshotType `json:"type"`
+	Memory      bool         `json:"memory"` // Whether the memory state was captured
+	State       VMStateType  `json:"state"`  // State of the VM at capture time
+	Parent      string       `json:"parent,omitempty"`
+	Current     bool         `json:"current"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// SnapshotNode is a snapshot along with the snapshots taken after it.
+type SnapshotNode struct {
+	Snapshot
+	Children []SnapshotNode `json:"children"`
+}
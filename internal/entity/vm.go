@@ -1,5 +1,7 @@
 package entity
 
+import "time"
+
 // VMStateType represents the VM running state type.
 type VMStateType string
 
@@ -23,17 +25,148 @@ const (
 
 // VM represents a virtual machine object.
 type VM struct {
-	ID            string      `json:"id"`
-	Name          string      `json:"name"`
-	State         VMStateType `json:"state"`
-	CPU           uint        `json:"cpu"`
-	Memory        uint        `json:"memory"`
-	Disk          uint64      `json:"disk"`
-	DiskPath      string      `json:"-"`
-	ReadIopsSec   uint64      `json:"read_iops_sec,omitempty"`
-	WriteIopsSec  uint64      `json:"write_iops_sec,omitempty"`
-	TotalIopsSec  uint64      `json:"total_iops_sec,omitempty"`
-	ReadBytesSec  uint64      `json:"read_bytes_sec,omitempty"`
-	WriteBytesSec uint64      `json:"write_bytes_sec,omitempty"`
-	TotalBytesSec uint64      `json:"total_bytes_sec,omitempty"`
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	State         VMStateType       `json:"state"`
+	Image         string            `json:"image,omitempty"`
+	CPU           uint              `json:"cpu"`
+	Memory        uint              `json:"memory"`
+	MaxCPU        uint              `json:"max_cpu,omitempty"`    // vCPUs the VM can be grown to without a reboot
+	MaxMemory     uint              `json:"max_memory,omitempty"` // Likewise for the memory
+	Disk          uint64            `json:"disk"`
+	DiskPath      string            `json:"-"`
+	ReadIopsSec   uint64            `json:"read_iops_sec,omitempty"`
+	WriteIopsSec  uint64            `json:"write_iops_sec,omitempty"`
+	TotalIopsSec  uint64            `json:"total_iops_sec,omitempty"`
+	ReadBytesSec  uint64            `json:"read_bytes_sec,omitempty"`
+	WriteBytesSec uint64            `json:"write_bytes_sec,omitempty"`
+	TotalBytesSec uint64            `json:"total_bytes_sec,omitempty"`
+	Saved         bool              `json:"saved,omitempty"` // Has a managed save image
+	Labels        map[string]string `json:"labels,omitempty"`
+	CloudInit     *CloudInit        `json:"-"` // Only set at creation
+}
+
+// IOTune represents the I/O throttling of a disk. Bandwidths are in MiB per
+// second and burst lengths in seconds, zero means unlimited.
+type IOTune struct {
+	TotalBytesSec uint64 `json:"total_bytes_sec"`
+	ReadBytesSec  uint64 `json:"read_bytes_sec"`
+	WriteBytesSec uint64 `json:"write_bytes_sec"`
+	TotalIopsSec  uint64 `json:"total_iops_sec"`
+	ReadIopsSec   uint64 `json:"read_iops_sec"`
+	WriteIopsSec  uint64 `json:"write_iops_sec"`
+
+	// Bursts allowed above the throttles, for at most their length.
+	TotalBytesSecMax       uint64 `json:"total_bytes_sec_max"`
+	ReadBytesSecMax        uint64 `json:"read_bytes_sec_max"`
+	WriteBytesSecMax       uint64 `json:"write_bytes_sec_max"`
+	TotalIopsSecMax        uint64 `json:"total_iops_sec_max"`
+	ReadIopsSecMax         uint64 `json:"read_iops_sec_max"`
+	WriteIopsSecMax        uint64 `json:"write_iops_sec_max"`
+	TotalBytesSecMaxLength uint64 `json:"total_bytes_sec_max_length"`
+	ReadBytesSecMaxLength  uint64 `json:"read_bytes_sec_max_length"`
+	WriteBytesSecMaxLength uint64 `json:"write_bytes_sec_max_length"`
+	TotalIopsSecMaxLength  uint64 `json:"total_iops_sec_max_length"`
+	ReadIopsSecMaxLength   uint64 `json:"read_iops_sec_max_length"`
+	WriteIopsSecMaxLength  uint64 `json:"write_iops_sec_max_length"`
+
+	// Disks of the same group share their throttles.
+	GroupName string `json:"group_name,omitempty"`
+}
+
+// StopOutcome tells how a VM was stopped.
+type StopOutcome string
+
+// Stop outcomes.
+const (
+	// The guest shut down by itself when asked to.
+	StopGraceful StopOutcome = "graceful"
+	// The VM was powered off.
+	StopForced StopOutcome = "forced"
+)
+
+// CloudInit holds the data provided to cloud-init on the first boot of a VM
+// through a NoCloud seed.
+type CloudInit struct {
+	Hostname          string
+	SSHAuthorizedKeys []string
+	UserData          string
+	NetworkConfig     string
+}
+
+// VMStats represents the resource usage of a running VM.
+type VMStats struct {
+	Timestamp         time.Time `json:"timestamp"`    // When the latest sample was taken
+	Interval          float64   `json:"interval_sec"` // Seconds between the samples the rates are computed over
+	CPUUsage          float64   `json:"cpu_usage"`
+	MemoryPercent     float64   `json:"mem_percent"` // Out of the memory stats, see MemoryStats.Source
+	DiskReadBytesSec  float64   `json:"disk_read_bytes_sec"`
+	DiskWriteBytesSec float64   `json:"disk_write_bytes_sec"`
+	DiskReadIOPS      float64   `json:"disk_read_iops"`
+	DiskWriteIOPS     float64   `json:"disk_write_iops"`
+	NetRxBytesSec     float64   `json:"net_rx_bytes_sec"`
+	NetTxBytesSec     float64   `json:"net_tx_bytes_sec"`
+	NetRxPacketsSec   float64   `json:"net_rx_packets_sec"`
+	NetTxPacketsSec   float64   `json:"net_tx_packets_sec"`
+
+	// Memory details and rates by device, left out of the usage history.
+	Memory     *MemoryStats     `json:"memory,omitempty"`
+	Disks      []DiskStats      `json:"disks,omitempty"`
+	Interfaces []InterfaceStats `json:"interfaces,omitempty"`
+	Vcpus      []VcpuStats      `json:"vcpus,omitempty"`
+}
+
+// Sources of the memory stats of a VM.
+const (
+	// MemoryStatsGuest is used when the balloon driver of the guest reports
+	// its memory usage.
+	MemoryStatsGuest = "guest"
+	// MemoryStatsHost is used otherwise, the memory usage is then the
+	// resident memory of the VM process on the host.
+	MemoryStatsHost = "host"
+)
+
+// MemoryStats represents the memory usage of a VM. Available, usable and
+// unused memory as well as the swap and fault rates are only reported by
+// the guest.
+type MemoryStats struct {
+	Source          string  `json:"source"`       // Either guest or host
+	ActualBytes     uint64  `json:"actual_bytes"` // Current balloon size
+	RSSBytes        uint64  `json:"rss_bytes"`    // Resident memory of the VM process
+	AvailableBytes  uint64  `json:"available_bytes"`
+	UsableBytes     uint64  `json:"usable_bytes"` // Available without swapping
+	UnusedBytes     uint64  `json:"unused_bytes"`
+	SwapInBytesSec  float64 `json:"swap_in_bytes_sec"`
+	SwapOutBytesSec float64 `json:"swap_out_bytes_sec"`
+	MajorFaultsSec  float64 `json:"major_faults_sec"`
+}
+
+// DiskStats represents the I/O of a disk of a VM.
+type DiskStats struct {
+	Device         string  `json:"device"`
+	ReadBytesSec   float64 `json:"read_bytes_sec"`
+	WriteBytesSec  float64 `json:"write_bytes_sec"`
+	ReadIOPS       float64 `json:"read_iops"`
+	WriteIOPS      float64 `json:"write_iops"`
+	ReadLatencyMs  float64 `json:"read_latency_ms"`  // Average time spent per read request
+	WriteLatencyMs float64 `json:"write_latency_ms"` // Average time spent per write request
+}
+
+// InterfaceStats represents the traffic of a network interface of a VM.
+type InterfaceStats struct {
+	Name         string  `json:"name"`
+	RxBytesSec   float64 `json:"rx_bytes_sec"`
+	TxBytesSec   float64 `json:"tx_bytes_sec"`
+	RxPacketsSec float64 `json:"rx_packets_sec"`
+	TxPacketsSec float64 `json:"tx_packets_sec"`
+	RxDropsSec   float64 `json:"rx_drops_sec"`
+	TxDropsSec   float64 `json:"tx_drops_sec"`
+	RxErrorsSec  float64 `json:"rx_errors_sec"`
+	TxErrorsSec  float64 `json:"tx_errors_sec"`
+}
+
+// VcpuStats represents the usage of a vCPU of a VM.
+type VcpuStats struct {
+	ID    uint    `json:"id"`
+	Usage float64 `json:"usage"` // In percent of a host CPU
 }
@@ -1,6 +1,7 @@
 package errors
 
 import (
+	goerrors "errors"
 	"fmt"
 	"net/http"
 
@@ -13,6 +14,7 @@ import (
 type ErrorResponse struct {
 	Status  int         `json:"status"`
 	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"`
 	Details interface{} `json:"details,omitempty"`
 }
 
@@ -26,6 +28,13 @@ func (e ErrorResponse) StatusCode() int {
 	return e.Status
 }
 
+// WithCode returns a copy of the error response carrying a machine readable
+// code, for clients to tell apart errors sharing the same status.
+func (e ErrorResponse) WithCode(code string) ErrorResponse {
+	e.Code = code
+	return e
+}
+
 // InternalServerError creates a new error response representing an internal
 // server error (HTTP 500)
 func InternalServerError(msg string) ErrorResponse {
@@ -74,6 +83,18 @@ func Forbidden(msg string) ErrorResponse {
 	}
 }
 
+// Conflict creates a new error response representing a request conflicting
+// with the current state of the resource (HTTP 409).
+func Conflict(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "Your request conflicts with the current state of the resource."
+	}
+	return ErrorResponse{
+		Status:  http.StatusConflict,
+		Message: msg,
+	}
+}
+
 // BadRequest creates a new error response representing a bad request
 // (HTTP 400).
 func BadRequest(msg string) ErrorResponse {
@@ -110,8 +131,81 @@ func UnsupportedMediaType(msg string) ErrorResponse {
 	}
 }
 
+// ServiceUnavailable creates a new error response representing a dependency
+// of the server being unavailable (HTTP 503).
+func ServiceUnavailable(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The service is temporarily unavailable."
+	}
+	return ErrorResponse{
+		Status:  http.StatusServiceUnavailable,
+		Message: msg,
+	}
+}
+
+// NotImplemented creates a new error response representing an operation
+// the server does not support (HTTP 501).
+func NotImplemented(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The requested operation is not supported."
+	}
+	return ErrorResponse{
+		Status:  http.StatusNotImplemented,
+		Message: msg,
+	}
+}
+
+// GatewayTimeout creates a new error response representing a dependency of
+// the server not responding in time (HTTP 504).
+func GatewayTimeout(msg string) ErrorResponse {
+	if msg == "" {
+		msg = "The service did not respond in time."
+	}
+	return ErrorResponse{
+		Status:  http.StatusGatewayTimeout,
+		Message: msg,
+	}
+}
+
+// Coder is implemented by the errors carrying a machine readable code, such
+// as the ones reported by the hypervisor.
+type Coder interface {
+	error
+	Code() string
+}
+
+// codeResponses maps the codes of the errors reported by the hypervisor to
+// the status of their response, and to its message when the one of the
+// error is not to be exposed as is.
+var codeResponses = map[string]struct {
+	status  int
+	message string
+}{
+	"vm_not_found":           {http.StatusNotFound, "VM not found"},
+	"vm_exists":              {http.StatusConflict, ""},
+	"operation_invalid":      {http.StatusConflict, ""},
+	"operation_unsupported":  {http.StatusNotImplemented, ""},
+	"hypervisor_timeout":     {http.StatusGatewayTimeout, ""},
+	"hypervisor_unavailable": {http.StatusServiceUnavailable, ""},
+	"stats_not_ready":        {http.StatusServiceUnavailable, ""},
+	"disk_not_found":         {http.StatusNotFound, ""},
+	"shutdown_timeout":       {http.StatusGatewayTimeout, ""},
+	"image_not_found":        {http.StatusNotFound, "image not found"},
+	"image_exists":           {http.StatusConflict, "image already exists"},
+	"image_in_use":           {http.StatusConflict, ""},
+	"image_checksum":         {http.StatusBadRequest, ""},
+	"image_format":           {http.StatusBadRequest, ""},
+	"snapshot_not_found":     {http.StatusNotFound, "snapshot not found"},
+	"snapshot_exists":        {http.StatusConflict, "snapshot already exists"},
+	"snapshot_memory":        {http.StatusConflict, ""},
+}
+
 // BuildErrorResponse builds an error response from an error.
 func BuildErrorResponse(err error, trans ut.Translator) ErrorResponse {
+	if res, ok := codedErrorResponse(err); ok {
+		return res
+	}
+
 	switch err := err.(type) {
 	case ErrorResponse:
 		return err
@@ -135,6 +229,28 @@ func BuildErrorResponse(err error, trans ut.Translator) ErrorResponse {
 	return InternalServerError("")
 }
 
+// codedErrorResponse builds an error response from an error which wraps a
+// coded error, ok is false for other errors.
+func codedErrorResponse(err error) (_ ErrorResponse, ok bool) {
+	var coded Coder
+	if !goerrors.As(err, &coded) {
+		return ErrorResponse{}, false
+	}
+	res, ok := codeResponses[coded.Code()]
+	if !ok {
+		return ErrorResponse{}, false
+	}
+	msg := res.message
+	if msg == "" {
+		msg = err.Error()
+	}
+	return ErrorResponse{
+		Status:  res.status,
+		Message: msg,
+		Code:    coded.Code(),
+	}, true
+}
+
 // invalidInput creates a new error response representing a data validation
 // error (HTTP 400).
 func invalidInput(err error, trans ut.Translator) ErrorResponse {
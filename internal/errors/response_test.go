@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
 
@@ -21,6 +22,13 @@ func TestErrorResponse_StatusCode(t *testing.T) {
 	assert.Equal(t, 400, e.StatusCode())
 }
 
+func TestErrorResponse_WithCode(t *testing.T) {
+	res := Conflict("test").WithCode("abc")
+	assert.Equal(t, http.StatusConflict, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	assert.Equal(t, "abc", res.Code)
+}
+
 func TestInternalServerError(t *testing.T) {
 	res := InternalServerError("test")
 	assert.Equal(t, http.StatusInternalServerError, res.StatusCode())
@@ -61,6 +69,73 @@ func TestBadRequest(t *testing.T) {
 	assert.NotEmpty(t, res.Error())
 }
 
+func TestConflict(t *testing.T) {
+	res := Conflict("test")
+	assert.Equal(t, http.StatusConflict, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = Conflict("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestServiceUnavailable(t *testing.T) {
+	res := ServiceUnavailable("test")
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = ServiceUnavailable("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestGatewayTimeout(t *testing.T) {
+	res := GatewayTimeout("test")
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = GatewayTimeout("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestNotImplemented(t *testing.T) {
+	res := NotImplemented("test")
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode())
+	assert.Equal(t, "test", res.Error())
+	res = NotImplemented("")
+	assert.NotEmpty(t, res.Error())
+}
+
+func TestBuildErrorResponse(t *testing.T) {
+	res := BuildErrorResponse(Conflict("test").WithCode("abc"), nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode())
+	assert.Equal(t, "abc", res.Code)
+
+	res = BuildErrorResponse(fmt.Errorf("boom"), nil)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode())
+	assert.Empty(t, res.Code)
+}
+
+// codedError is an error carrying a code, as reported by the hypervisor.
+type codedError string
+
+func (e codedError) Error() string { return "coded error" }
+func (e codedError) Code() string  { return string(e) }
+
+func TestBuildErrorResponse_Coded(t *testing.T) {
+	res := BuildErrorResponse(fmt.Errorf("%w: detail", codedError("vm_exists")), nil)
+	assert.Equal(t, http.StatusConflict, res.StatusCode())
+	assert.Equal(t, "vm_exists", res.Code)
+	assert.Equal(t, "coded error: detail", res.Message)
+
+	// Some messages are not exposed as is.
+	res = BuildErrorResponse(fmt.Errorf("%w: detail", codedError("vm_not_found")), nil)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode())
+	assert.Equal(t, "VM not found", res.Message)
+
+	res = BuildErrorResponse(codedError("shutdown_timeout"), nil)
+	assert.Equal(t, http.StatusGatewayTimeout, res.StatusCode())
+
+	res = BuildErrorResponse(codedError("unknown"), nil)
+	assert.Equal(t, http.StatusInternalServerError, res.StatusCode())
+	assert.Empty(t, res.Code)
+}
+
 // func TestInvalidInput(t *testing.T) {
 // 	err := invalidInput(validator.ValidationErrors{
 // 		"xyz": fmt.Errorf("2"),
@@ -0,0 +1,77 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Interval between keep-alive comments sent on idle streams.
+	heartbeatInterval = 15 * time.Second
+)
+
+type resource struct {
+	hub    *Hub
+	logger log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, hub *Hub, logger log.Logger) {
+
+	res := resource{hub, logger}
+
+	g.GET("/events/", res.stream)
+}
+
+// stream sends the events as Server-Sent Events until the client goes away.
+func (r resource) stream(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	vmID := c.QueryParam("vm_id")
+	if vmID != "" {
+		if _, err := uuid.Parse(vmID); err != nil {
+			return errors.BadRequest("invalid VM id")
+		}
+	}
+
+	events, unsubscribe := r.hub.Subscribe(vmID)
+	defer unsubscribe()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "no-cache")
+	w.Header().Set(echo.HeaderConnection, "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	w.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				r.logger.With(ctx).Errorf("failed to marshal event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n",
+				e.ID, e.Type, data); err != nil {
+				return nil
+			}
+		}
+		w.Flush()
+	}
+}
@@ -0,0 +1,60 @@
+package event
+
+import (
+	"sync"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+)
+
+const (
+	// Number of events buffered per subscriber before dropping.
+	subscriberBufferSize = 64
+)
+
+// Hub fans out events to the subscribers currently listening.
+type Hub struct {
+	mu   sync.RWMutex
+	subs map[chan entity.Event]string
+}
+
+// NewHub creates a new event hub.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[chan entity.Event]string)}
+}
+
+// Subscribe registers a subscriber interested in the events of the given
+// VM, or in all events if vmID is empty. The returned function must be
+// called to unsubscribe.
+func (h *Hub) Subscribe(vmID string) (<-chan entity.Event, func()) {
+	ch := make(chan entity.Event, subscriberBufferSize)
+
+	h.mu.Lock()
+	h.subs[ch] = vmID
+	h.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subs, ch)
+			h.mu.Unlock()
+		})
+	}
+}
+
+// Broadcast delivers the event to the matching subscribers. Slow subscribers
+// miss events rather than blocking the publisher.
+func (h *Hub) Broadcast(e entity.Event) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch, vmID := range h.subs {
+		if vmID != "" && vmID != e.VMID {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Package event publishes VM lifecycle events to the message broker and
+// streams them to the API clients.
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/queue"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/google/uuid"
+)
+
+// Publisher encapsulates the publication of VM lifecycle events.
+type Publisher interface {
+	// Publish stamps the event envelope and writes it to the broker.
+	// Failures are logged but never interrupt the caller.
+	Publish(ctx context.Context, e entity.Event)
+	// Expect drops the hypervisor events of the given types on the VM,
+	// identified by its id or its name, until done is called and for a
+	// grace period afterwards. The API publishes its own event for the
+	// transitions it requests, which are thus published only once.
+	Expect(vm string, types ...entity.EventType) (done func())
+}
+
+const (
+	// Period during which the hypervisor events caused by an API request
+	// are still expected once the request completed, as they are
+	// delivered asynchronously.
+	expectGracePeriod = 5 * time.Second
+)
+
+// expectation holds the hypervisor events expected on a VM.
+type expectation struct {
+	vm    string
+	types []entity.EventType
+	until time.Time // Zero until the request completes
+}
+
+// matches returns true when the expectation covers the event.
+func (x *expectation) matches(e entity.Event) bool {
+	if x.vm != e.VMID && x.vm != e.VMName {
+		return false
+	}
+	for _, typ := range x.types {
+		if typ == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+type publisher struct {
+	producer queue.Publisher
+	topic    string
+	node     string
+	hub      *Hub
+	logger   log.Logger
+
+	mu       *sync.Mutex
+	expected map[*expectation]struct{}
+}
+
+// NewPublisher creates a new event publisher writing to the given topic and
+// broadcasting to the subscribers of hub. node identifies the hypervisor
+// host the events originate from.
+func NewPublisher(producer queue.Publisher, topic, node string, hub *Hub,
+	logger log.Logger) Publisher {
+	return publisher{producer, topic, node, hub, logger,
+		&sync.Mutex{}, make(map[*expectation]struct{})}
+}
+
+// Forward publishes the events read from src until it is closed.
+func Forward(src <-chan entity.Event, p Publisher) {
+	for e := range src {
+		p.Publish(context.Background(), e)
+	}
+}
+
+// Expect registers the hypervisor events caused by an API request on vm.
+func (p publisher) Expect(vm string, types ...entity.EventType) (done func()) {
+	x := &expectation{vm: vm, types: types}
+	p.mu.Lock()
+	p.expected[x] = struct{}{}
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		x.until = time.Now().Add(expectGracePeriod)
+		p.mu.Unlock()
+	}
+}
+
+// isExpected returns true when the event was caused by an API request,
+// expired expectations are removed on the way.
+func (p publisher) isExpected(e entity.Event) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	expected := false
+	for x := range p.expected {
+		if !x.until.IsZero() && now.After(x.until) {
+			delete(p.expected, x)
+			continue
+		}
+		expected = expected || x.matches(e)
+	}
+	return expected
+}
+
+// Publish writes the event to the broker and broadcasts it. Hypervisor
+// events caused by an API request are dropped.
+func (p publisher) Publish(ctx context.Context, e entity.Event) {
+
+	if e.Actor == entity.ActorHypervisor && p.isExpected(e) {
+		p.logger.With(ctx, "vm_id", e.VMID).Debugf(
+			"dropped event %s: published by the API", e.Type)
+		return
+	}
+
+	e.Version = entity.EventVersion
+	if e.ID == "" {
+		e.ID = uuid.New().String()
+	}
+	if e.Node == "" {
+		e.Node = p.node
+	}
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+
+	logger := p.logger.With(ctx, "event_id", e.ID, "vm_id", e.VMID)
+	msg, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorf("failed to marshal event %s: %v", e.Type, err)
+		return
+	}
+	if err := p.producer.Produce(p.topic, msg); err != nil {
+		logger.Errorf("failed to publish event %s: %v", e.Type, err)
+	} else {
+		logger.Debugf("published event %s", e.Type)
+	}
+
+	p.hub.Broadcast(e)
+}
@@ -0,0 +1,104 @@
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockProducer struct {
+	topic   string
+	message []byte
+	err     error
+}
+
+func (m *mockProducer) Produce(topic string, message []byte) error {
+	m.topic, m.message = topic, message
+	return m.err
+}
+
+func TestPublisher_Publish(t *testing.T) {
+	logger, _ := log.NewForTest()
+	m := &mockProducer{}
+	p := NewPublisher(m, "topic-vm", "node-1", NewHub(), logger)
+
+	p.Publish(context.Background(), entity.Event{
+		Type:   entity.EventVMStarted,
+		VMID:   "56071446-7713-4cbb-ac21-9d685878b128",
+		Actor:  entity.ActorAPI,
+		Before: entity.VMStateShutOff,
+		After:  entity.VMStateRunning,
+	})
+	assert.Equal(t, "topic-vm", m.topic)
+
+	var e entity.Event
+	assert.NoError(t, json.Unmarshal(m.message, &e))
+	assert.Equal(t, entity.EventVersion, e.Version)
+	assert.NotEmpty(t, e.ID)
+	assert.Equal(t, "node-1", e.Node)
+	assert.False(t, e.Timestamp.IsZero())
+	assert.Equal(t, entity.EventVMStarted, e.Type)
+	assert.Equal(t, entity.VMStateShutOff, e.Before)
+	assert.Equal(t, entity.VMStateRunning, e.After)
+}
+
+func TestPublisher_PublishError(t *testing.T) {
+	logger, logs := log.NewForTest()
+	m := &mockProducer{err: errors.New("broker down")}
+	p := NewPublisher(m, "topic-vm", "node-1", NewHub(), logger)
+
+	p.Publish(context.Background(), entity.Event{Type: entity.EventVMDeleted})
+	assert.Equal(t, 1, logs.Len())
+}
+
+func TestPublisher_Expect(t *testing.T) {
+	logger, _ := log.NewForTest()
+	m := &mockProducer{}
+	p := NewPublisher(m, "topic-vm", "node-1", NewHub(), logger)
+	hypervisorEvent := func(typ entity.EventType, vmID, vmName string) entity.Event {
+		return entity.Event{Type: typ, VMID: vmID, VMName: vmName, Actor: entity.ActorHypervisor}
+	}
+
+	done := p.Expect("vm-1", entity.EventVMStopped)
+	p.Publish(context.Background(), hypervisorEvent(entity.EventVMStopped, "id-1", "vm-1"))
+	assert.Nil(t, m.message)
+
+	// Other events and the ones of the API go through.
+	p.Publish(context.Background(), hypervisorEvent(entity.EventVMCrashed, "id-1", "vm-1"))
+	assert.Contains(t, string(m.message), `"vm.crashed"`)
+	p.Publish(context.Background(), hypervisorEvent(entity.EventVMStopped, "id-2", "vm-2"))
+	assert.Contains(t, string(m.message), `"id-2"`)
+	p.Publish(context.Background(), entity.Event{Type: entity.EventVMStopped,
+		VMID: "id-1", Actor: entity.ActorAPI})
+	assert.Contains(t, string(m.message), `"api"`)
+
+	// Events delivered shortly after the request completed are dropped too.
+	done()
+	m.message = nil
+	p.Publish(context.Background(), hypervisorEvent(entity.EventVMStopped, "id-1", "vm-1"))
+	assert.Nil(t, m.message)
+}
+
+func TestHub_Broadcast(t *testing.T) {
+	hub := NewHub()
+	all, unsubscribeAll := hub.Subscribe("")
+	defer unsubscribeAll()
+	one, unsubscribeOne := hub.Subscribe("vm-1")
+
+	hub.Broadcast(entity.Event{Type: entity.EventVMStarted, VMID: "vm-2"})
+	hub.Broadcast(entity.Event{Type: entity.EventVMStopped, VMID: "vm-1"})
+
+	assert.Equal(t, "vm-2", (<-all).VMID)
+	assert.Equal(t, "vm-1", (<-all).VMID)
+	assert.Equal(t, "vm-1", (<-one).VMID)
+
+	unsubscribeOne()
+	hub.Broadcast(entity.Event{Type: entity.EventVMDeleted, VMID: "vm-1"})
+	assert.Len(t, one, 0)
+	assert.Equal(t, entity.EventVMDeleted, (<-all).Type)
+}
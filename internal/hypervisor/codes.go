@@ -0,0 +1,55 @@
+package hypervisor
+
+import "errors"
+
+// Machine readable codes of the errors reported by the hypervisor, for the
+// API clients to tell them apart. They also label the hypervisor metrics.
+const (
+	CodeVMNotFound            = "vm_not_found"
+	CodeVMExists              = "vm_exists"
+	CodeOperationInvalid      = "operation_invalid"
+	CodeOperationUnsupported  = "operation_unsupported"
+	CodeHypervisorTimeout     = "hypervisor_timeout"
+	CodeHypervisorUnavailable = "hypervisor_unavailable"
+	CodeStatsNotReady         = "stats_not_ready"
+	CodeDiskNotFound          = "disk_not_found"
+	CodeShutdownTimeout       = "shutdown_timeout"
+	CodeImageNotFound         = "image_not_found"
+	CodeImageExists           = "image_exists"
+	CodeImageInUse            = "image_in_use"
+	CodeImageChecksum         = "image_checksum"
+	CodeImageFormat           = "image_format"
+	CodeSnapshotNotFound      = "snapshot_not_found"
+	CodeSnapshotExists        = "snapshot_exists"
+	CodeSnapshotMemory        = "snapshot_memory"
+)
+
+// codedError is an error reported by the hypervisor, along with its code.
+// The API maps the code to the status of the error responses.
+type codedError struct {
+	msg  string
+	code string
+}
+
+func newError(code, msg string) error {
+	return &codedError{msg: msg, code: code}
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// Code returns the machine readable code of the error.
+func (e *codedError) Code() string {
+	return e.code
+}
+
+// Code returns the code of err, which may wrap one of the errors reported
+// by the hypervisor. It is empty for other errors.
+func Code(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package hypervisor
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCode(t *testing.T) {
+	assert.Equal(t, CodeVMNotFound, Code(fmt.Errorf("%w: detail", ErrVMNotFound)))
+	assert.Empty(t, Code(fmt.Errorf("boom")))
+	assert.Empty(t, Code(nil))
+}
+
+func TestErrorResponses(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrVMNotFound, http.StatusNotFound, CodeVMNotFound},
+		{ErrVMExists, http.StatusConflict, CodeVMExists},
+		{ErrOperationInvalid, http.StatusConflict, CodeOperationInvalid},
+		{ErrUnsupported, http.StatusNotImplemented, CodeOperationUnsupported},
+		{ErrTimeout, http.StatusGatewayTimeout, CodeHypervisorTimeout},
+		{ErrUnavailable, http.StatusServiceUnavailable, CodeHypervisorUnavailable},
+		{ErrStatsNotReady, http.StatusServiceUnavailable, CodeStatsNotReady},
+		{ErrDiskNotFound, http.StatusNotFound, CodeDiskNotFound},
+		{ErrShutdownTimeout, http.StatusGatewayTimeout, CodeShutdownTimeout},
+		{ErrImageNotFound, http.StatusNotFound, CodeImageNotFound},
+		{ErrImageExists, http.StatusConflict, CodeImageExists},
+		{ErrImageInUse, http.StatusConflict, CodeImageInUse},
+		{ErrImageChecksum, http.StatusBadRequest, CodeImageChecksum},
+		{ErrImageFormat, http.StatusBadRequest, CodeImageFormat},
+		{ErrSnapshotNotFound, http.StatusNotFound, CodeSnapshotNotFound},
+		{ErrSnapshotExists, http.StatusConflict, CodeSnapshotExists},
+		{ErrSnapshotMemory, http.StatusConflict, CodeSnapshotMemory},
+	}
+	for _, tt := range tests {
+		res := errors.BuildErrorResponse(fmt.Errorf("%w: detail", tt.err), nil)
+		assert.Equal(t, tt.status, res.StatusCode(), tt.code)
+		assert.Equal(t, tt.code, res.Code)
+	}
+}
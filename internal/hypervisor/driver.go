@@ -0,0 +1,196 @@
+// Package hypervisor defines the contract between the VM service and the
+// virtualization backend that actually runs the virtual machines.
+package hypervisor
+
+import (
+	"io"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+)
+
+var (
+	// ErrVMNotFound is returned when no VM matches an ID.
+	ErrVMNotFound = newError(CodeVMNotFound, "VM not found")
+	// ErrVMExists is returned when creating a VM whose name is already
+	// used by a VM or by its files.
+	ErrVMExists = newError(CodeVMExists, "VM already exists")
+	// ErrOperationInvalid is returned when the hypervisor refuses an
+	// operation in the current state of the VM.
+	ErrOperationInvalid = newError(CodeOperationInvalid, "operation not valid in the current VM state")
+	// ErrTimeout is returned when the hypervisor did not complete an
+	// operation in time.
+	ErrTimeout = newError(CodeHypervisorTimeout, "hypervisor operation timed out")
+	// ErrUnsupported is returned when the hypervisor does not support an
+	// operation.
+	ErrUnsupported = newError(CodeOperationUnsupported, "operation not supported by the hypervisor")
+	// ErrUnavailable is returned when the hypervisor cannot be reached.
+	ErrUnavailable = newError(CodeHypervisorUnavailable, "hypervisor unavailable")
+	// ErrImageInUse is returned when removing an image other images are
+	// built on, e.g. the base image of copy-on-write overlays.
+	ErrImageInUse = newError(CodeImageInUse, "image is in use by other images")
+	// ErrImageNotFound is returned when no base image matches a name.
+	ErrImageNotFound = newError(CodeImageNotFound, "image not found")
+	// ErrImageExists is returned when registering an image twice.
+	ErrImageExists = newError(CodeImageExists, "image already exists")
+	// ErrImageChecksum is returned when an imported image does not match
+	// its expected checksum.
+	ErrImageChecksum = newError(CodeImageChecksum, "image checksum mismatch")
+	// ErrImageFormat is returned when importing an image whose format is
+	// not supported.
+	ErrImageFormat = newError(CodeImageFormat, "unsupported image format")
+	// ErrSnapshotNotFound is returned when no snapshot of a VM matches a
+	// name.
+	ErrSnapshotNotFound = newError(CodeSnapshotNotFound, "snapshot not found")
+	// ErrSnapshotExists is returned when a VM already has a snapshot with
+	// the same name.
+	ErrSnapshotExists = newError(CodeSnapshotExists, "snapshot already exists")
+	// ErrSnapshotMemory is returned when capturing the memory of a VM which
+	// is not running.
+	ErrSnapshotMemory = newError(CodeSnapshotMemory, "memory can only be captured from a running VM")
+	// ErrStatsNotReady is returned when the usage of a VM was not sampled
+	// long enough yet to compute rates.
+	ErrStatsNotReady = newError(CodeStatsNotReady, "stats not collected yet")
+	// ErrDiskNotFound is returned when a VM has no disk matching a target
+	// device, e.g. vda.
+	ErrDiskNotFound = newError(CodeDiskNotFound, "disk not found")
+	// ErrShutdownTimeout is returned when a guest did not shut down in time
+	// and was left running.
+	ErrShutdownTimeout = newError(CodeShutdownTimeout, "guest did not shut down in time")
+)
+
+// ShutdownMode selects how a guest is asked to shut down.
+type ShutdownMode string
+
+// Shutdown modes.
+const (
+	// ShutdownACPI presses the ACPI power button.
+	ShutdownACPI ShutdownMode = "acpi"
+	// ShutdownAgent asks the QEMU guest agent running in the guest.
+	ShutdownAgent ShutdownMode = "agent"
+)
+
+// StopOptions controls how a VM is stopped.
+type StopOptions struct {
+	// Force powers the VM off right away, without asking the guest.
+	Force bool
+	// Mode is how the guest is asked to shut down.
+	Mode ShutdownMode
+	// Timeout is how long to wait for the guest to shut down.
+	Timeout time.Duration
+	// Fallback powers the VM off when the guest did not shut down in time.
+	Fallback bool
+}
+
+// Progress reports the completion percentage of an operation as it goes
+// through its steps.
+type Progress func(percent int)
+
+// Report reports percent, progress may be nil.
+func (p Progress) Report(percent int) {
+	if p != nil {
+		p(percent)
+	}
+}
+
+// Completion percentages reported at the steps of the creation and of the
+// shutdown of VMs.
+const (
+	ProgressOverlayCreated    = 25
+	ProgressSeedBuilt         = 50
+	ProgressDefined           = 75
+	ProgressStarted           = 90
+	ProgressShutdownRequested = 50
+	ProgressForcedOff         = 90
+)
+
+// ImageSource describes the content of an image being imported.
+type ImageSource struct {
+	// Reader streams the image file.
+	Reader io.Reader
+	// SHA256 is the expected hex encoded digest of the file. The file is
+	// not verified when empty.
+	SHA256 string
+	// Convert requests images in another format (raw, vmdk, vdi) to be
+	// converted to qcow2 instead of being rejected.
+	Convert bool
+}
+
+// Driver encapsulates the operations a hypervisor backend (e.g. libvirt)
+// must support to manage the lifecycle of virtual machines.
+type Driver interface {
+	// CreateVM defines and boots a new VM, reporting its progress. A VM
+	// failing to boot is deleted, its ID is still returned along with the
+	// error.
+	CreateVM(vm entity.VM, progress Progress) (entity.VM, int, error)
+	// CheckVMName returns ErrVMExists if a VM, or the files of a VM, already
+	// use the name.
+	CheckVMName(name string) error
+	// GetVM retrieves a VM given its ID.
+	GetVM(id string) (entity.VM, error)
+	// StartVM starts a VM given its ID.
+	StartVM(id string) error
+	// StopVM shuts down a VM given its ID, or powers it off when forced to,
+	// reporting its progress.
+	StopVM(id string, opts StopOptions, progress Progress) (entity.StopOutcome, error)
+	// RebootVM reboots a VM given its ID.
+	RebootVM(id string) error
+	// PauseVM suspends the execution of a VM, keeping it in memory.
+	PauseVM(id string) error
+	// ResumeVM resumes a paused or PM suspended VM.
+	ResumeVM(id string) error
+	// SaveVM saves the memory of a VM to disk and stops it. The VM resumes
+	// where it left off on its next start.
+	SaveVM(id string) error
+	// ResetVM resets a VM, like pressing the reset button.
+	ResetVM(id string) error
+	// DeleteVM stops a VM if running, then removes it along with its disks.
+	DeleteVM(id string) error
+	// ResizeVM changes the vCPUs and memory, in MiB, of a VM, zero leaves
+	// them unchanged. Running VMs are changed live when possible, otherwise
+	// the change takes effect on their next boot and a reboot is required.
+	ResizeVM(id string, cpu, memory uint) (rebootRequired bool, err error)
+	// FlattenVM turns the disks of a VM into standalone images which no
+	// longer depend on a base image.
+	FlattenVM(id string) error
+	// ListVMs enumerates the active and/or inactive VMs.
+	ListVMs(active, inactive bool) ([]entity.VM, error)
+	// GetStats returns the latest usage rates sampled for a running VM.
+	GetStats(id string) (entity.VMStats, error)
+	// GetMetrics returns the usage rates sampled for a VM between from and
+	// to, oldest first. They may be averaged over windows of at most step,
+	// e.g. when the hypervisor keeps the history at a coarser resolution.
+	GetMetrics(id string, from, to time.Time, step time.Duration) ([]entity.VMStats, error)
+	// GetDiskIOTune returns the I/O throttling of a disk of a VM given its
+	// target device.
+	GetDiskIOTune(id, dev string) (entity.IOTune, error)
+	// SetDiskIOTune replaces the I/O throttling of a disk of a VM, both in
+	// its definition and, when it runs, live.
+	SetDiskIOTune(id, dev string, tune entity.IOTune) error
+	// ListImages enumerates the base images of the catalog.
+	ListImages() ([]entity.Image, error)
+	// GetImage retrieves a base image given its name.
+	GetImage(name string) (entity.Image, error)
+	// CreateImage registers an image file of the image directory as a base
+	// image in the catalog.
+	CreateImage(img entity.Image) (entity.Image, error)
+	// ImportImage stores the image file streamed by src in the image
+	// directory and registers it in the catalog.
+	ImportImage(img entity.Image, src ImageSource) (entity.Image, error)
+	// DeleteImage removes a base image from the catalog along with its file.
+	DeleteImage(name string) error
+	// CreateSnapshot captures the disks, and optionally the memory, of a VM.
+	CreateSnapshot(vmID string, snap entity.Snapshot) (entity.Snapshot, error)
+	// ListSnapshots enumerates the snapshots of a VM.
+	ListSnapshots(vmID string) ([]entity.Snapshot, error)
+	// GetSnapshot retrieves a snapshot of a VM given its name.
+	GetSnapshot(vmID, name string) (entity.Snapshot, error)
+	// RevertSnapshot restores a VM to the state captured by a snapshot.
+	RevertSnapshot(vmID, name string) error
+	// DeleteSnapshot removes a snapshot, its children are attached to its
+	// parent.
+	DeleteSnapshot(vmID, name string) error
+	// Events returns the channel on which state changes observed on the
+	// hypervisor are delivered.
+	Events() <-chan entity.Event
+}
@@ -0,0 +1,639 @@
+// Package fake provides an in-memory hypervisor driver, meant to exercise
+// the VM service and the HTTP stack without a running libvirt daemon.
+package fake
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/google/uuid"
+)
+
+const (
+	// Disk is the target device of the disk of the vms.
+	Disk = "sda"
+	// Headroom is how many times their vCPUs and memory at creation the
+	// vms can be grown to without a reboot.
+	Headroom = 2
+)
+
+var (
+	// ErrNotFound is returned when no VM matches the given ID.
+	ErrNotFound = hypervisor.ErrVMNotFound
+	// ErrNotRunning is returned when acting on a VM that is not running.
+	ErrNotRunning = fmt.Errorf("%w: domain is not running", hypervisor.ErrOperationInvalid)
+	// ErrAlreadyRunning is returned when starting a VM that is running.
+	ErrAlreadyRunning = fmt.Errorf("%w: domain is already running", hypervisor.ErrOperationInvalid)
+	// ErrNotPaused is returned when resuming a VM that is not paused.
+	ErrNotPaused = fmt.Errorf("%w: domain is not paused", hypervisor.ErrOperationInvalid)
+)
+
+// Driver is an in-memory hypervisor driver safe for concurrent use.
+type Driver struct {
+	mu        sync.Mutex
+	vms       map[string]entity.VM
+	images    map[string]entity.Image
+	snapshots map[string][]entity.Snapshot // By VM ID, in creation order
+	metrics   map[string][]entity.VMStats  // By VM ID, oldest first
+	iotunes   map[string]entity.IOTune     // By VM ID, once set
+	events    chan entity.Event
+	// Whether guests ignore shutdown requests.
+	ignoreShutdown bool
+	// Error new vms fail to start with, nil when they start.
+	startErr error
+	// Closed to let held state changes through, nil when none are held.
+	hold chan struct{}
+}
+
+// Ensure Driver satisfies the hypervisor driver interface.
+var _ hypervisor.Driver = (*Driver)(nil)
+
+// New creates a new empty fake driver.
+func New() *Driver {
+	return &Driver{
+		vms:       make(map[string]entity.VM),
+		images:    make(map[string]entity.Image),
+		snapshots: make(map[string][]entity.Snapshot),
+		metrics:   make(map[string][]entity.VMStats),
+		iotunes:   make(map[string]entity.IOTune),
+		events:    make(chan entity.Event, 64),
+	}
+}
+
+// CreateVM registers the vm and marks it as running.
+func (d *Driver) CreateVM(vm entity.VM, progress hypervisor.Progress) (
+	entity.VM, int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.images[vm.Image]; !ok {
+		return entity.VM{}, 400, hypervisor.ErrImageNotFound
+	}
+	if err := d.checkVMName(vm.Name); err != nil {
+		return entity.VM{}, 409, err
+	}
+	vm.ID = uuid.New().String()
+	progress.Report(hypervisor.ProgressOverlayCreated)
+	progress.Report(hypervisor.ProgressSeedBuilt)
+	progress.Report(hypervisor.ProgressDefined)
+	if d.startErr != nil {
+		return entity.VM{ID: vm.ID, Name: vm.Name}, 500, d.startErr
+	}
+	progress.Report(hypervisor.ProgressStarted)
+	vm.State = entity.VMStateRunning
+	vm.MaxCPU = vm.CPU * Headroom
+	vm.MaxMemory = vm.Memory * Headroom
+	d.vms[vm.ID] = vm
+	return vm, 200, nil
+}
+
+// FailStart makes new vms fail to start with err, they are then deleted as
+// by a hypervisor rolling back their creation. Nil lets them start.
+func (d *Driver) FailStart(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.startErr = err
+}
+
+// CheckVMName fails if a vm has the name.
+func (d *Driver) CheckVMName(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.checkVMName(name)
+}
+
+func (d *Driver) checkVMName(name string) error {
+	for _, vm := range d.vms {
+		if vm.Name == name {
+			return fmt.Errorf("%w: domain %s", hypervisor.ErrVMExists, name)
+		}
+	}
+	return nil
+}
+
+// GetVM gets the vm.
+func (d *Driver) GetVM(id string) (entity.VM, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return entity.VM{}, ErrNotFound
+	}
+	return vm, nil
+}
+
+// StartVM starts the vm, restoring its saved state if any.
+func (d *Driver) StartVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error {
+		if vm.State == entity.VMStateRunning {
+			return ErrAlreadyRunning
+		}
+		vm.State = entity.VMStateRunning
+		vm.Saved = false
+		return nil
+	})
+}
+
+// StopVM stops the vm, gracefully unless guests ignore shutdown requests.
+func (d *Driver) StopVM(id string, opts hypervisor.StopOptions,
+	progress hypervisor.Progress) (entity.StopOutcome, error) {
+	outcome := entity.StopGraceful
+	if !opts.Force {
+		progress.Report(hypervisor.ProgressShutdownRequested)
+	}
+	err := d.transition(id, func(vm *entity.VM) error {
+		if vm.State != entity.VMStateRunning {
+			return ErrNotRunning
+		}
+		if !opts.Force && d.ignoreShutdown {
+			if !opts.Fallback {
+				return hypervisor.ErrShutdownTimeout
+			}
+			opts.Force = true
+		}
+		if opts.Force {
+			progress.Report(hypervisor.ProgressForcedOff)
+			outcome = entity.StopForced
+		}
+		vm.State = entity.VMStateShutOff
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// IgnoreShutdown makes guests ignore shutdown requests, as if they hung.
+func (d *Driver) IgnoreShutdown(ignore bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ignoreShutdown = ignore
+}
+
+// Hold blocks the state changes of VMs until release is called, so that
+// operations can be observed while in progress.
+func (d *Driver) Hold() (release func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hold := make(chan struct{})
+	d.hold = hold
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.mu.Lock()
+			d.hold = nil
+			d.mu.Unlock()
+			close(hold)
+		})
+	}
+}
+
+// RebootVM reboots the vm.
+func (d *Driver) RebootVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error {
+		if vm.State != entity.VMStateRunning {
+			return ErrNotRunning
+		}
+		return nil
+	})
+}
+
+// PauseVM pauses the vm.
+func (d *Driver) PauseVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error {
+		if vm.State != entity.VMStateRunning {
+			return ErrNotRunning
+		}
+		vm.State = entity.VMStatePaused
+		return nil
+	})
+}
+
+// ResumeVM resumes the vm.
+func (d *Driver) ResumeVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error {
+		if vm.State != entity.VMStatePaused && vm.State != entity.VMStatePMSuspended {
+			return ErrNotPaused
+		}
+		vm.State = entity.VMStateRunning
+		return nil
+	})
+}
+
+// SaveVM saves the vm and stops it.
+func (d *Driver) SaveVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error {
+		if vm.State != entity.VMStateRunning && vm.State != entity.VMStatePaused {
+			return ErrNotRunning
+		}
+		vm.State = entity.VMStateShutOff
+		vm.Saved = true
+		return nil
+	})
+}
+
+// ResetVM resets the vm.
+func (d *Driver) ResetVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error {
+		if vm.State != entity.VMStateRunning && vm.State != entity.VMStatePaused {
+			return ErrNotRunning
+		}
+		return nil
+	})
+}
+
+// DeleteVM deletes the vm.
+func (d *Driver) DeleteVM(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.vms[id]; !ok {
+		return ErrNotFound
+	}
+	delete(d.vms, id)
+	delete(d.snapshots, id)
+	delete(d.metrics, id)
+	delete(d.iotunes, id)
+	return nil
+}
+
+// ResizeVM changes the vCPUs and memory of the vm. Running vms require a
+// reboot when grown beyond their maximum, which is raised.
+func (d *Driver) ResizeVM(id string, cpu, memory uint) (bool, error) {
+	var rebootRequired bool
+	err := d.transition(id, func(vm *entity.VM) error {
+		running := vm.State == entity.VMStateRunning || vm.State == entity.VMStatePaused
+		if cpu > 0 {
+			rebootRequired = rebootRequired || running && cpu > vm.MaxCPU
+			vm.CPU, vm.MaxCPU = cpu, max(vm.MaxCPU, cpu)
+		}
+		if memory > 0 {
+			rebootRequired = rebootRequired || running && memory > vm.MaxMemory
+			vm.Memory, vm.MaxMemory = memory, max(vm.MaxMemory, memory)
+		}
+		return nil
+	})
+	return rebootRequired, err
+}
+
+// FlattenVM flattens the disks of the vm, which is a no-op in memory.
+func (d *Driver) FlattenVM(id string) error {
+	return d.transition(id, func(vm *entity.VM) error { return nil })
+}
+
+// ListVMs lists the vms sorted by name.
+func (d *Driver) ListVMs(active, inactive bool) ([]entity.VM, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vms := make([]entity.VM, 0, len(d.vms))
+	for _, vm := range d.vms {
+		running := vm.State == entity.VMStateRunning
+		if (running && active) || (!running && inactive) {
+			vms = append(vms, vm)
+		}
+	}
+	sort.Slice(vms, func(i, j int) bool {
+		if vms[i].Name == vms[j].Name {
+			return vms[i].ID < vms[j].ID
+		}
+		return vms[i].Name < vms[j].Name
+	})
+	return vms, nil
+}
+
+// GetStats returns CPU and memory stats of a running vm.
+func (d *Driver) GetStats(id string) (entity.VMStats, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return entity.VMStats{}, ErrNotFound
+	}
+	if vm.State != entity.VMStateRunning {
+		return entity.VMStats{}, ErrNotRunning
+	}
+	if metrics := d.metrics[id]; len(metrics) > 0 {
+		return metrics[len(metrics)-1], nil
+	}
+	return entity.VMStats{}, nil
+}
+
+// GetMetrics returns the usage rates recorded for the vm between from and
+// to, as recorded whatever the step.
+func (d *Driver) GetMetrics(id string, from, to time.Time, step time.Duration) (
+	[]entity.VMStats, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.vms[id]; !ok {
+		return nil, ErrNotFound
+	}
+	metrics := []entity.VMStats{}
+	for _, m := range d.metrics[id] {
+		if !m.Timestamp.Before(from) && !m.Timestamp.After(to) {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics, nil
+}
+
+// RecordMetrics appends usage rates to the history of the vm, as sampled
+// by a hypervisor.
+func (d *Driver) RecordMetrics(id string, metrics ...entity.VMStats) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metrics[id] = append(d.metrics[id], metrics...)
+}
+
+// GetDiskIOTune returns the I/O throttling of the disk of the vm, as set at
+// creation until replaced.
+func (d *Driver) GetDiskIOTune(id, dev string) (entity.IOTune, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return entity.IOTune{}, ErrNotFound
+	}
+	if dev != Disk {
+		return entity.IOTune{}, fmt.Errorf("%w: %s", hypervisor.ErrDiskNotFound, dev)
+	}
+	if tune, ok := d.iotunes[id]; ok {
+		return tune, nil
+	}
+	return entity.IOTune{
+		ReadBytesSec:  vm.ReadBytesSec,
+		WriteBytesSec: vm.WriteBytesSec,
+		ReadIopsSec:   vm.ReadIopsSec,
+		WriteIopsSec:  vm.WriteIopsSec,
+	}, nil
+}
+
+// SetDiskIOTune replaces the I/O throttling of the disk of the vm.
+func (d *Driver) SetDiskIOTune(id, dev string, tune entity.IOTune) error {
+	if dev != Disk {
+		if _, err := d.GetVM(id); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %s", hypervisor.ErrDiskNotFound, dev)
+	}
+	return d.transition(id, func(vm *entity.VM) error {
+		vm.TotalBytesSec, vm.ReadBytesSec, vm.WriteBytesSec =
+			tune.TotalBytesSec, tune.ReadBytesSec, tune.WriteBytesSec
+		vm.TotalIopsSec, vm.ReadIopsSec, vm.WriteIopsSec =
+			tune.TotalIopsSec, tune.ReadIopsSec, tune.WriteIopsSec
+		d.iotunes[id] = tune
+		return nil
+	})
+}
+
+// ListImages lists the images sorted by name.
+func (d *Driver) ListImages() ([]entity.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	images := make([]entity.Image, 0, len(d.images))
+	for _, img := range d.images {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+// GetImage gets the image.
+func (d *Driver) GetImage(name string) (entity.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img, ok := d.images[name]
+	if !ok {
+		return entity.Image{}, hypervisor.ErrImageNotFound
+	}
+	return img, nil
+}
+
+// CreateImage registers the image.
+func (d *Driver) CreateImage(img entity.Image) (entity.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.images[img.Name]; ok {
+		return entity.Image{}, hypervisor.ErrImageExists
+	}
+	img.Format = "qcow2"
+	d.images[img.Name] = img
+	return img, nil
+}
+
+// ImportImage consumes the image file and registers the image. The file is
+// verified against its checksum but otherwise assumed to be a qcow2 image.
+func (d *Driver) ImportImage(img entity.Image, src hypervisor.ImageSource) (
+	entity.Image, error) {
+
+	h := sha256.New()
+	if _, err := io.Copy(h, src.Reader); err != nil {
+		return entity.Image{}, err
+	}
+	if src.SHA256 != "" && !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), src.SHA256) {
+		return entity.Image{}, hypervisor.ErrImageChecksum
+	}
+	return d.CreateImage(img)
+}
+
+// DeleteImage deletes the image unless a vm was created from it.
+func (d *Driver) DeleteImage(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.images[name]; !ok {
+		return hypervisor.ErrImageNotFound
+	}
+	for _, vm := range d.vms {
+		if vm.Image == name {
+			return hypervisor.ErrImageInUse
+		}
+	}
+	delete(d.images, name)
+	return nil
+}
+
+// CreateSnapshot records a snapshot of the vm, which becomes the current one.
+func (d *Driver) CreateSnapshot(vmID string, snap entity.Snapshot) (
+	entity.Snapshot, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[vmID]
+	if !ok {
+		return entity.Snapshot{}, ErrNotFound
+	}
+	if _, i := d.findSnapshot(vmID, snap.Name); i >= 0 {
+		return entity.Snapshot{}, hypervisor.ErrSnapshotExists
+	}
+	running := vm.State == entity.VMStateRunning
+	if snap.Memory && !running {
+		return entity.Snapshot{}, hypervisor.ErrSnapshotMemory
+	}
+	// Like libvirt, internal snapshots of a running vm include its memory.
+	if snap.Type == entity.SnapshotInternal && running {
+		snap.Memory = true
+	}
+
+	snaps := d.snapshots[vmID]
+	for i := range snaps {
+		if snaps[i].Current {
+			snap.Parent = snaps[i].Name
+			snaps[i].Current = false
+		}
+	}
+	snap.State = vm.State
+	snap.Current = true
+	snap.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	d.snapshots[vmID] = append(snaps, snap)
+	return snap, nil
+}
+
+// ListSnapshots lists the snapshots of the vm in creation order.
+func (d *Driver) ListSnapshots(vmID string) ([]entity.Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.vms[vmID]; !ok {
+		return nil, ErrNotFound
+	}
+	return append([]entity.Snapshot{}, d.snapshots[vmID]...), nil
+}
+
+// GetSnapshot gets a snapshot of the vm.
+func (d *Driver) GetSnapshot(vmID, name string) (entity.Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.vms[vmID]; !ok {
+		return entity.Snapshot{}, ErrNotFound
+	}
+	snap, i := d.findSnapshot(vmID, name)
+	if i < 0 {
+		return entity.Snapshot{}, hypervisor.ErrSnapshotNotFound
+	}
+	return snap, nil
+}
+
+// RevertSnapshot restores the state of the vm captured by the snapshot.
+func (d *Driver) RevertSnapshot(vmID, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[vmID]
+	if !ok {
+		return ErrNotFound
+	}
+	snap, i := d.findSnapshot(vmID, name)
+	if i < 0 {
+		return hypervisor.ErrSnapshotNotFound
+	}
+	vm.State = entity.VMStateShutOff
+	if snap.Memory {
+		vm.State = snap.State
+	}
+	d.vms[vmID] = vm
+
+	snaps := d.snapshots[vmID]
+	for j := range snaps {
+		snaps[j].Current = j == i
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes a snapshot of the vm, attaching its children to
+// its parent.
+func (d *Driver) DeleteSnapshot(vmID, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.vms[vmID]; !ok {
+		return ErrNotFound
+	}
+	snap, i := d.findSnapshot(vmID, name)
+	if i < 0 {
+		return hypervisor.ErrSnapshotNotFound
+	}
+
+	snaps := append(d.snapshots[vmID][:i:i], d.snapshots[vmID][i+1:]...)
+	for j := range snaps {
+		if snaps[j].Parent == name {
+			snaps[j].Parent = snap.Parent
+		}
+		if snap.Current && snaps[j].Name == snap.Parent {
+			snaps[j].Current = true
+		}
+	}
+	d.snapshots[vmID] = snaps
+	return nil
+}
+
+// findSnapshot returns a snapshot of the vm and its index, or -1 when not
+// found. The caller must hold the lock.
+func (d *Driver) findSnapshot(vmID, name string) (entity.Snapshot, int) {
+	for i, snap := range d.snapshots[vmID] {
+		if snap.Name == name {
+			return snap, i
+		}
+	}
+	return entity.Snapshot{}, -1
+}
+
+// Events returns the channel on which emitted events are delivered.
+func (d *Driver) Events() <-chan entity.Event {
+	return d.events
+}
+
+// Emit simulates a state change observed on the hypervisor, e.g. a guest
+// shutting down by itself.
+func (d *Driver) Emit(e entity.Event) {
+	d.mu.Lock()
+	if vm, ok := d.vms[e.VMID]; ok && e.After != "" {
+		vm.State = e.After
+		d.vms[e.VMID] = vm
+	}
+	d.mu.Unlock()
+
+	if e.Actor == "" {
+		e.Actor = entity.ActorHypervisor
+	}
+	d.events <- e
+}
+
+// transition applies fn to the vm under lock and persists the result.
+func (d *Driver) transition(id string, fn func(vm *entity.VM) error) error {
+	d.mu.Lock()
+	if hold := d.hold; hold != nil {
+		d.mu.Unlock()
+		<-hold
+		d.mu.Lock()
+	}
+	defer d.mu.Unlock()
+
+	vm, ok := d.vms[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := fn(&vm); err != nil {
+		return err
+	}
+	d.vms[id] = vm
+	return nil
+}
@@ -0,0 +1,200 @@
+package image
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Maximum size of the form fields of an upload.
+	maxFieldSize = 4 << 10
+)
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, logger log.Logger) {
+
+	res := resource{service, logger}
+
+	g.POST("/images/", res.create)
+	g.POST("/images/upload/", res.upload)
+	g.POST("/images/import/", res.importURL)
+	g.GET("/images/", res.list)
+	g.GET("/images/:name/", res.get)
+	g.DELETE("/images/:name/", res.delete)
+}
+
+func (r resource) create(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	var input CreateImageRequest
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Error(err)
+		return err
+	}
+
+	img, err := r.service.Create(ctx, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, struct {
+		Status  string       `json:"status"`
+		Message string       `json:"message"`
+		Image   entity.Image `json:"item"`
+	}{"ok", "image created successfully", img})
+}
+
+// upload streams the image file of a multipart/form-data request to the
+// image directory. The image fields must come before the `file` part.
+func (r resource) upload(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	mr, err := c.Request().MultipartReader()
+	if err != nil {
+		return errors.BadRequest("expected a multipart/form-data body")
+	}
+
+	var input UploadImageRequest
+	var file *multipart.Part
+	for file == nil {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return errors.BadRequest("missing image file")
+		}
+		if err != nil {
+			return errors.BadRequest(err.Error())
+		}
+		if part.FormName() == "file" {
+			file = part
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+		if err != nil {
+			return errors.BadRequest(err.Error())
+		}
+		if err := setUploadField(&input, part.FormName(), string(value)); err != nil {
+			return err
+		}
+	}
+	if err := c.Validate(&input); err != nil {
+		return err
+	}
+
+	img, err := r.service.Upload(ctx, input, file)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, struct {
+		Status  string       `json:"status"`
+		Message string       `json:"message"`
+		Image   entity.Image `json:"item"`
+	}{"ok", "image uploaded successfully", img})
+}
+
+func (r resource) importURL(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	var input ImportImageRequest
+	if err := c.Bind(&input); err != nil {
+		r.logger.With(ctx).Error(err)
+		return err
+	}
+
+	j, err := r.service.Import(ctx, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, struct {
+		Status  string     `json:"status"`
+		Message string     `json:"message"`
+		Job     entity.Job `json:"item"`
+	}{"ok", "image import accepted", j})
+}
+
+func (r resource) list(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	images, err := r.service.List(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status  string         `json:"status"`
+		Message string         `json:"message"`
+		Images  []entity.Image `json:"items"`
+	}{"ok", "images enumerated successfully", images})
+}
+
+func (r resource) get(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	img, err := r.service.Get(ctx, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status  string       `json:"status"`
+		Message string       `json:"message"`
+		Image   entity.Image `json:"item"`
+	}{"ok", "image retrieved successfully", img})
+}
+
+func (r resource) delete(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	err := r.service.Delete(ctx, c.Param("name"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}{"ok", "image deleted successfully"})
+}
+
+// setUploadField sets the request field matching a form field name.
+func setUploadField(input *UploadImageRequest, name, value string) error {
+
+	var err error
+	switch name {
+	case "name":
+		input.Name = value
+	case "file_name":
+		input.File = value
+	case "flavor":
+		input.Flavor = value
+	case "os_family":
+		input.OSFamily = value
+	case "os_version":
+		input.OSVersion = value
+	case "arch":
+		input.Arch = value
+	case "default_user":
+		input.DefaultUser = value
+	case "min_disk":
+		input.MinDisk, err = strconv.ParseUint(value, 10, 64)
+	case "sha256":
+		input.SHA256 = value
+	case "convert":
+		input.Convert, err = strconv.ParseBool(value)
+	default:
+		return errors.BadRequest("unknown field " + name)
+	}
+	if err != nil {
+		return errors.BadRequest("invalid " + name + ": " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package image
+
+import (
+	"context"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+)
+
+// repository persists base images in the hypervisor image directory.
+type repository struct {
+	logger log.Logger
+	vmMgr  hypervisor.Driver
+}
+
+// Repository encapsulates the logic to access base images.
+type Repository interface {
+	// Create registers a new base image.
+	Create(ctx context.Context, img entity.Image) (entity.Image, error)
+	// Import stores the image file and registers the base image.
+	Import(ctx context.Context, img entity.Image, src hypervisor.ImageSource) (entity.Image, error)
+	// Get retrieves a base image given its name.
+	Get(ctx context.Context, name string) (entity.Image, error)
+	// List enumerates all base images.
+	List(ctx context.Context) ([]entity.Image, error)
+	// Delete removes a base image given its name.
+	Delete(ctx context.Context, name string) error
+}
+
+// NewRepository creates a new image repository.
+func NewRepository(logger log.Logger, vmMgr hypervisor.Driver) Repository {
+	return repository{logger, vmMgr}
+}
+
+// Create registers a new base image.
+func (r repository) Create(ctx context.Context, img entity.Image) (entity.Image, error) {
+	return r.vmMgr.CreateImage(img)
+}
+
+// Import stores the image file and registers the base image.
+func (r repository) Import(ctx context.Context, img entity.Image,
+	src hypervisor.ImageSource) (entity.Image, error) {
+	return r.vmMgr.ImportImage(img, src)
+}
+
+// Get retrieves a base image given its name.
+func (r repository) Get(ctx context.Context, name string) (entity.Image, error) {
+	return r.vmMgr.GetImage(name)
+}
+
+// List enumerates all base images.
+func (r repository) List(ctx context.Context) ([]entity.Image, error) {
+	return r.vmMgr.ListImages()
+}
+
+// Delete removes a base image given its name.
+func (r repository) Delete(ctx context.Context, name string) error {
+	return r.vmMgr.DeleteImage(name)
+}
@@ -0,0 +1,201 @@
+package image
+
+import (
+	"context"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/internal/job"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+)
+
+const (
+	// Operations performed asynchronously through jobs.
+	opImport = "image_import"
+)
+
+// nameRegex matches the names allowed for images and their files.
+var nameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+type CreateImageRequest struct {
+	Name        string `json:"name" validate:"required,max=64" example:"alpinelinux3.21"`
+	File        string `json:"file" validate:"max=255" example:"alpinelinux3.21.qcow2"` // Defaults to <name>.qcow2
+	Flavor      string `json:"flavor" validate:"max=64" example:"linux-alpine"`         // Defaults to os_family
+	OSFamily    string `json:"os_family" validate:"required,max=64" example:"linux"`
+	OSVersion   string `json:"os_version" validate:"required,max=64" example:"3.21"`
+	Arch        string `json:"arch" validate:"required,oneof=x86_64 aarch64" example:"x86_64"`
+	DefaultUser string `json:"default_user" validate:"max=64" example:"alpine"`
+	MinDisk     uint64 `json:"min_disk" validate:"lte=2048000" example:"2"` // In GiB
+}
+
+// UploadImageRequest describes an image whose file is sent along with the
+// request.
+type UploadImageRequest struct {
+	CreateImageRequest
+	SHA256  string `json:"sha256" validate:"omitempty,len=64,hexadecimal"`
+	Convert bool   `json:"convert"` // Converts raw, vmdk and vdi images to qcow2
+}
+
+// ImportImageRequest describes an image whose file is downloaded from a URL.
+type ImportImageRequest struct {
+	UploadImageRequest
+	URL string `json:"url" validate:"required,http_url" example:"https://dl-cdn.alpinelinux.org/alpine/v3.21/releases/cloud/generic_alpine-3.21.0-x86_64-bios-cloudinit-r0.qcow2"`
+}
+
+type service struct {
+	repo   Repository
+	jobs   job.Service
+	client *http.Client
+	logger log.Logger
+}
+
+// Service encapsulates use case logic for base images.
+type Service interface {
+	Create(ctx context.Context, input CreateImageRequest) (entity.Image, error)
+	Get(ctx context.Context, name string) (entity.Image, error)
+	List(ctx context.Context) ([]entity.Image, error)
+	Delete(ctx context.Context, name string) error
+	// Upload stores the image file read from r and registers the image.
+	Upload(ctx context.Context, input UploadImageRequest, r io.Reader) (entity.Image, error)
+	// Import submits a job downloading the image file and registering the
+	// image.
+	Import(ctx context.Context, input ImportImageRequest) (entity.Job, error)
+}
+
+// NewService creates a new image service.
+func NewService(repo Repository, jobs job.Service, logger log.Logger) Service {
+	return service{repo, jobs, &http.Client{}, logger}
+}
+
+// Create registers a new base image.
+func (s service) Create(ctx context.Context, req CreateImageRequest) (
+	entity.Image, error) {
+
+	img, err := newImage(req)
+	if err != nil {
+		return entity.Image{}, err
+	}
+	img, err = s.repo.Create(ctx, img)
+	if err != nil {
+		return entity.Image{}, err
+	}
+	return img, nil
+}
+
+// Upload stores the uploaded image file and registers the image.
+func (s service) Upload(ctx context.Context, req UploadImageRequest, r io.Reader) (
+	entity.Image, error) {
+
+	img, err := newImage(req.CreateImageRequest)
+	if err != nil {
+		return entity.Image{}, err
+	}
+	img, err = s.repo.Import(ctx, img, hypervisor.ImageSource{
+		Reader:  r,
+		SHA256:  req.SHA256,
+		Convert: req.Convert,
+	})
+	if err != nil {
+		return entity.Image{}, err
+	}
+	return img, nil
+}
+
+// Import downloads the image file in the background and registers the image.
+// Names already taken are rejected before the download starts.
+func (s service) Import(ctx context.Context, req ImportImageRequest) (entity.Job, error) {
+
+	img, err := newImage(req.CreateImageRequest)
+	if err != nil {
+		return entity.Job{}, err
+	}
+	if _, err := s.repo.Get(ctx, img.Name); err == nil {
+		return entity.Job{}, errors.Conflict("image already exists")
+	} else if !goerrors.Is(err, hypervisor.ErrImageNotFound) {
+		return entity.Job{}, err
+	}
+
+	return s.jobs.Submit(ctx, opImport, "", func(ctx context.Context, t job.Tracker) (interface{}, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.client.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to download %s: %s", req.URL, res.Status)
+		}
+
+		s.logger.With(ctx).Infof("importing image %s from %s", img.Name, req.URL)
+		return s.repo.Import(ctx, img, hypervisor.ImageSource{
+			Reader:  &progressReader{r: res.Body, total: res.ContentLength, t: t},
+			SHA256:  req.SHA256,
+			Convert: req.Convert,
+		})
+	}), nil
+}
+
+// newImage applies the defaults of the request and validates the names.
+func newImage(req CreateImageRequest) (entity.Image, error) {
+
+	if req.File == "" {
+		req.File = req.Name + ".qcow2"
+	}
+	if req.Flavor == "" {
+		req.Flavor = req.OSFamily
+	}
+	if !nameRegex.MatchString(req.Name) || !nameRegex.MatchString(req.File) {
+		return entity.Image{}, errors.BadRequest(
+			"image name and file may only contain letters, digits, '.', '_' and '-'")
+	}
+
+	return entity.Image{
+		Name:        req.Name,
+		File:        req.File,
+		Flavor:      req.Flavor,
+		OSFamily:    req.OSFamily,
+		OSVersion:   req.OSVersion,
+		Arch:        req.Arch,
+		DefaultUser: req.DefaultUser,
+		MinDisk:     req.MinDisk,
+	}, nil
+}
+
+func (s service) Get(ctx context.Context, name string) (entity.Image, error) {
+	return s.repo.Get(ctx, name)
+}
+
+func (s service) List(ctx context.Context) ([]entity.Image, error) {
+	return s.repo.List(ctx)
+}
+
+func (s service) Delete(ctx context.Context, name string) error {
+	return s.repo.Delete(ctx, name)
+}
+
+// progressReader reports the progress of a download to its job.
+type progressReader struct {
+	r     io.Reader
+	read  int64
+	total int64 // Unknown when negative
+	t     job.Tracker
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.total > 0 {
+		// The last percent is left for the registration of the image.
+		p.t.Progress(int(p.read * 99 / p.total))
+	}
+	return n, err
+}
@@ -0,0 +1,41 @@
+package job
+
+import (
+	"net/http"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, logger log.Logger) {
+
+	res := resource{service, logger}
+
+	g.GET("/jobs/:id/", res.get)
+}
+
+func (r resource) get(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	if _, err := uuid.Parse(id); err != nil {
+		return errors.BadRequest("invalid job id")
+	}
+	job, err := r.service.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status  string     `json:"status"`
+		Message string     `json:"message"`
+		Job     entity.Job `json:"item"`
+	}{"ok", "job retrieved successfully", job})
+}
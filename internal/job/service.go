@@ -0,0 +1,163 @@
+package job
+
+import (
+	"context"
+	goerrors "errors"
+	"sync"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/google/uuid"
+)
+
+const (
+	// Retention is how long finished jobs are kept around for polling.
+	Retention = 24 * time.Hour
+)
+
+// Func is the unit of work executed by a job. The returned value is exposed
+// as the job result once it succeeds.
+type Func func(ctx context.Context, t Tracker) (interface{}, error)
+
+// Tracker lets a running job report its progress.
+type Tracker struct {
+	s  *service
+	id string
+}
+
+// Progress records the completion percentage of the job.
+func (t Tracker) Progress(percent int) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	t.s.update(t.id, func(j *entity.Job) { j.Progress = percent })
+}
+
+// SetVMID records the VM the job operates on, e.g. once a VM being created
+// is assigned an ID.
+func (t Tracker) SetVMID(id string) {
+	t.s.update(t.id, func(j *entity.Job) { j.VMID = id })
+}
+
+// SetResult records a partial result while the job is still running.
+func (t Tracker) SetResult(v interface{}) {
+	t.s.update(t.id, func(j *entity.Job) { j.Result = v })
+}
+
+// Service encapsulates the asynchronous execution of jobs.
+type Service interface {
+	// Submit schedules fn for execution and returns the pending job.
+	Submit(ctx context.Context, operation, vmID string, fn Func) entity.Job
+	// Get retrieves a job given its ID.
+	Get(ctx context.Context, id string) (entity.Job, error)
+}
+
+type service struct {
+	mu     sync.RWMutex
+	jobs   map[string]*entity.Job
+	logger log.Logger
+}
+
+// NewService creates a new in-memory job service.
+func NewService(logger log.Logger) Service {
+	return &service{jobs: make(map[string]*entity.Job), logger: logger}
+}
+
+// Submit schedules fn for execution in the background. The job outlives
+// the request which submitted it, but keeps its context values for logging.
+func (s *service) Submit(ctx context.Context, operation, vmID string, fn Func) entity.Job {
+
+	now := time.Now().UTC()
+	j := &entity.Job{
+		ID:        uuid.New().String(),
+		Operation: operation,
+		VMID:      vmID,
+		Status:    entity.JobStatusPending,
+		CreatedAt: now,
+	}
+
+	s.mu.Lock()
+	s.prune(now)
+	s.jobs[j.ID] = j
+	snapshot := *j
+	s.mu.Unlock()
+
+	go s.run(context.WithoutCancel(ctx), j.ID, fn)
+	return snapshot
+}
+
+// Get retrieves a job given its ID.
+func (s *service) Get(ctx context.Context, id string) (entity.Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	j, ok := s.jobs[id]
+	if !ok {
+		return entity.Job{}, errors.NotFound("job not found")
+	}
+	return *j, nil
+}
+
+// run executes the job and records its outcome.
+func (s *service) run(ctx context.Context, id string, fn Func) {
+
+	s.update(id, func(j *entity.Job) {
+		now := time.Now().UTC()
+		j.Status = entity.JobStatusRunning
+		j.StartedAt = &now
+	})
+
+	res, err := fn(ctx, Tracker{s, id})
+
+	s.update(id, func(j *entity.Job) {
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		if err != nil {
+			s.logger.With(ctx, "job_id", id).Errorf("job %s failed: %v", j.Operation, err)
+			j.Status = entity.JobStatusFailed
+			j.Error = &entity.JobError{Code: errorCode(err), Message: err.Error()}
+			return
+		}
+		j.Status = entity.JobStatusSucceeded
+		j.Progress = 100
+		if res != nil {
+			j.Result = res
+		}
+	})
+}
+
+// errorCode returns the machine readable code of err, if any, the same as
+// the one of the error responses.
+func errorCode(err error) string {
+	var res errors.ErrorResponse
+	if goerrors.As(err, &res) {
+		return res.Code
+	}
+	return hypervisor.Code(err)
+}
+
+// update applies fn to the job under lock.
+func (s *service) update(id string, fn func(j *entity.Job)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok {
+		fn(j)
+	}
+}
+
+// prune evicts finished jobs older than the retention period. The caller
+// must hold the write lock.
+func (s *service) prune(now time.Time) {
+	for id, j := range s.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > Retention {
+			delete(s.jobs, id)
+		}
+	}
+}
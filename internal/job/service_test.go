@@ -0,0 +1,99 @@
+package job
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	kerrors "github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitDone(t *testing.T, s Service, id string) entity.Job {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		j, err := s.Get(context.Background(), id)
+		assert.NoError(t, err)
+		if j.Done() {
+			return j
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not complete", id)
+	return entity.Job{}
+}
+
+func TestService_Submit(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(logger)
+
+	release := make(chan struct{})
+	running := make(chan struct{})
+	j := s.Submit(context.Background(), "create", "", func(ctx context.Context, tr Tracker) (interface{}, error) {
+		tr.Progress(40)
+		tr.SetVMID("vm-1")
+		close(running)
+		<-release
+		return "done", nil
+	})
+	assert.Equal(t, entity.JobStatusPending, j.Status)
+	assert.NotEmpty(t, j.ID)
+
+	<-running
+	got, err := s.Get(context.Background(), j.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.JobStatusRunning, got.Status)
+	assert.Equal(t, 40, got.Progress)
+	assert.Equal(t, "vm-1", got.VMID)
+	assert.NotNil(t, got.StartedAt)
+
+	close(release)
+	got = waitDone(t, s, j.ID)
+	assert.Equal(t, entity.JobStatusSucceeded, got.Status)
+	assert.Equal(t, 100, got.Progress)
+	assert.Equal(t, "done", got.Result)
+	assert.NotNil(t, got.FinishedAt)
+}
+
+func TestService_SubmitFailure(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(logger)
+
+	j := s.Submit(context.Background(), "stop", "vm-1", func(ctx context.Context, tr Tracker) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	got := waitDone(t, s, j.ID)
+	assert.Equal(t, entity.JobStatusFailed, got.Status)
+	if assert.NotNil(t, got.Error) {
+		assert.Equal(t, "boom", got.Error.Message)
+		assert.Empty(t, got.Error.Code)
+	}
+
+	// Failures carry the same codes as the error responses.
+	for code, err := range map[string]error{
+		hypervisor.CodeHypervisorTimeout: fmt.Errorf("%w: reboot", hypervisor.ErrTimeout),
+		"operation_in_progress":          kerrors.Conflict("busy").WithCode("operation_in_progress"),
+	} {
+		j := s.Submit(context.Background(), "stop", "vm-1", func(ctx context.Context, tr Tracker) (interface{}, error) {
+			return nil, err
+		})
+		got := waitDone(t, s, j.ID)
+		if assert.NotNil(t, got.Error) {
+			assert.Equal(t, code, got.Error.Code)
+			assert.Equal(t, err.Error(), got.Error.Message)
+		}
+	}
+}
+
+func TestService_GetNotFound(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(logger)
+
+	_, err := s.Get(context.Background(), "missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errorKind returns the label of the error: the code of the errors reported
+// by the hypervisor, which the API reports as well, other otherwise.
+func errorKind(err error) string {
+	if code := hypervisor.Code(err); code != "" {
+		return code
+	}
+	return "other"
+}
+
+// driver measures the latency and counts the errors of the calls made to a
+// hypervisor driver.
+type driver struct {
+	hypervisor.Driver
+	latency *prometheus.HistogramVec
+	errors  *prometheus.CounterVec
+}
+
+// InstrumentDriver wraps the hypervisor driver d so that its calls are
+// measured in the registry.
+func InstrumentDriver(reg prometheus.Registerer, d hypervisor.Driver) hypervisor.Driver {
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "hypervisor",
+		Name:      "call_duration_seconds",
+		Help:      "Latency of the calls made to the hypervisor.",
+		Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 120},
+	}, []string{"operation"})
+	errs := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "hypervisor",
+		Name:      "call_errors_total",
+		Help:      "Number of calls made to the hypervisor which failed.",
+	}, []string{"operation", "error"})
+	reg.MustRegister(latency, errs)
+	return driver{d, latency, errs}
+}
+
+// observe records a call of operation started at start, it is meant to be
+// deferred.
+func (d driver) observe(operation string, start time.Time, err *error) {
+	d.latency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		d.errors.WithLabelValues(operation, errorKind(*err)).Inc()
+	}
+}
+
+func (d driver) CreateVM(vm entity.VM, progress hypervisor.Progress) (
+	_ entity.VM, _ int, err error) {
+	defer d.observe("create_vm", time.Now(), &err)
+	return d.Driver.CreateVM(vm, progress)
+}
+
+func (d driver) CheckVMName(name string) (err error) {
+	defer d.observe("check_vm_name", time.Now(), &err)
+	return d.Driver.CheckVMName(name)
+}
+
+func (d driver) GetVM(id string) (_ entity.VM, err error) {
+	defer d.observe("get_vm", time.Now(), &err)
+	return d.Driver.GetVM(id)
+}
+
+func (d driver) StartVM(id string) (err error) {
+	defer d.observe("start_vm", time.Now(), &err)
+	return d.Driver.StartVM(id)
+}
+
+func (d driver) StopVM(id string, opts hypervisor.StopOptions,
+	progress hypervisor.Progress) (_ entity.StopOutcome, err error) {
+	defer d.observe("stop_vm", time.Now(), &err)
+	return d.Driver.StopVM(id, opts, progress)
+}
+
+func (d driver) RebootVM(id string) (err error) {
+	defer d.observe("reboot_vm", time.Now(), &err)
+	return d.Driver.RebootVM(id)
+}
+
+func (d driver) PauseVM(id string) (err error) {
+	defer d.observe("pause_vm", time.Now(), &err)
+	return d.Driver.PauseVM(id)
+}
+
+func (d driver) ResumeVM(id string) (err error) {
+	defer d.observe("resume_vm", time.Now(), &err)
+	return d.Driver.ResumeVM(id)
+}
+
+func (d driver) SaveVM(id string) (err error) {
+	defer d.observe("save_vm", time.Now(), &err)
+	return d.Driver.SaveVM(id)
+}
+
+func (d driver) ResetVM(id string) (err error) {
+	defer d.observe("reset_vm", time.Now(), &err)
+	return d.Driver.ResetVM(id)
+}
+
+func (d driver) DeleteVM(id string) (err error) {
+	defer d.observe("delete_vm", time.Now(), &err)
+	return d.Driver.DeleteVM(id)
+}
+
+func (d driver) ResizeVM(id string, cpu, memory uint) (_ bool, err error) {
+	defer d.observe("resize_vm", time.Now(), &err)
+	return d.Driver.ResizeVM(id, cpu, memory)
+}
+
+func (d driver) FlattenVM(id string) (err error) {
+	defer d.observe("flatten_vm", time.Now(), &err)
+	return d.Driver.FlattenVM(id)
+}
+
+func (d driver) ListVMs(active, inactive bool) (_ []entity.VM, err error) {
+	defer d.observe("list_vms", time.Now(), &err)
+	return d.Driver.ListVMs(active, inactive)
+}
+
+func (d driver) GetStats(id string) (_ entity.VMStats, err error) {
+	defer d.observe("get_stats", time.Now(), &err)
+	return d.Driver.GetStats(id)
+}
+
+func (d driver) GetMetrics(id string, from, to time.Time, step time.Duration) (
+	_ []entity.VMStats, err error) {
+	defer d.observe("get_metrics", time.Now(), &err)
+	return d.Driver.GetMetrics(id, from, to, step)
+}
+
+func (d driver) GetDiskIOTune(id, dev string) (_ entity.IOTune, err error) {
+	defer d.observe("get_disk_iotune", time.Now(), &err)
+	return d.Driver.GetDiskIOTune(id, dev)
+}
+
+func (d driver) SetDiskIOTune(id, dev string, tune entity.IOTune) (err error) {
+	defer d.observe("set_disk_iotune", time.Now(), &err)
+	return d.Driver.SetDiskIOTune(id, dev, tune)
+}
+
+func (d driver) ListImages() (_ []entity.Image, err error) {
+	defer d.observe("list_images", time.Now(), &err)
+	return d.Driver.ListImages()
+}
+
+func (d driver) GetImage(name string) (_ entity.Image, err error) {
+	defer d.observe("get_image", time.Now(), &err)
+	return d.Driver.GetImage(name)
+}
+
+func (d driver) CreateImage(img entity.Image) (_ entity.Image, err error) {
+	defer d.observe("create_image", time.Now(), &err)
+	return d.Driver.CreateImage(img)
+}
+
+func (d driver) ImportImage(img entity.Image, src hypervisor.ImageSource) (
+	_ entity.Image, err error) {
+	defer d.observe("import_image", time.Now(), &err)
+	return d.Driver.ImportImage(img, src)
+}
+
+func (d driver) DeleteImage(name string) (err error) {
+	defer d.observe("delete_image", time.Now(), &err)
+	return d.Driver.DeleteImage(name)
+}
+
+func (d driver) CreateSnapshot(vmID string, snap entity.Snapshot) (
+	_ entity.Snapshot, err error) {
+	defer d.observe("create_snapshot", time.Now(), &err)
+	return d.Driver.CreateSnapshot(vmID, snap)
+}
+
+func (d driver) ListSnapshots(vmID string) (_ []entity.Snapshot, err error) {
+	defer d.observe("list_snapshots", time.Now(), &err)
+	return d.Driver.ListSnapshots(vmID)
+}
+
+func (d driver) GetSnapshot(vmID, name string) (_ entity.Snapshot, err error) {
+	defer d.observe("get_snapshot", time.Now(), &err)
+	return d.Driver.GetSnapshot(vmID, name)
+}
+
+func (d driver) RevertSnapshot(vmID, name string) (err error) {
+	defer d.observe("revert_snapshot", time.Now(), &err)
+	return d.Driver.RevertSnapshot(vmID, name)
+}
+
+func (d driver) DeleteSnapshot(vmID, name string) (err error) {
+	defer d.observe("delete_snapshot", time.Now(), &err)
+	return d.Driver.DeleteSnapshot(vmID, name)
+}
@@ -4,6 +4,12 @@ import (
 	"github.com/nsqio/go-nsq"
 )
 
+// Publisher is implemented by message producers.
+type Publisher interface {
+	// Produce writes a message to the given topic.
+	Produce(topic string, message []byte) error
+}
+
 // Producer wraps the NSQ producer object.
 type Producer struct {
 	Producer *nsq.Producer
@@ -17,7 +23,7 @@ func New(address, topic string) (Producer, error) {
 	if err != nil {
 		return Producer{}, err
 	}
-	if p.Ping() != nil {
+	if err = p.Ping(); err != nil {
 		return Producer{}, err
 	}
 
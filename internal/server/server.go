@@ -3,17 +3,24 @@ package server
 import (
 	"net/http"
 	"runtime/debug"
+	"time"
 
 	"github.com/ayoubfaouzi/kvm-manager/internal/config"
 	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/event"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/internal/image"
+	"github.com/ayoubfaouzi/kvm-manager/internal/job"
+	"github.com/ayoubfaouzi/kvm-manager/internal/metrics"
 	"github.com/ayoubfaouzi/kvm-manager/internal/queue"
+	"github.com/ayoubfaouzi/kvm-manager/internal/snapshot"
 	"github.com/ayoubfaouzi/kvm-manager/internal/vm"
-	"github.com/ayoubfaouzi/kvm-manager/internal/vmmgr"
 	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
 	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -23,7 +30,7 @@ const (
 
 // BuildHandler sets up the HTTP routing and builds an HTTP handler.
 func BuildHandler(logger log.Logger, cfg *config.Config, version string,
-	trans ut.Translator, p queue.Producer, vmMgr vmmgr.VMManager) http.Handler {
+	trans ut.Translator, p queue.Publisher, vmMgr hypervisor.Driver) http.Handler {
 
 	// Create `echo` instance.
 	e := echo.New()
@@ -37,6 +44,17 @@ func BuildHandler(logger log.Logger, cfg *config.Config, version string,
 				`"bytes_in":${bytes_in},bytes_out":${bytes_out}}` + "\n",
 		}))
 
+	// Prometheus metrics middleware, it comes before the recover one
+	// for panics to be counted. The VM manager exports the metrics of
+	// the VMs when it is a collector.
+	reg := metrics.NewRegistry()
+	if c, ok := vmMgr.(prometheus.Collector); ok {
+		reg.MustRegister(c)
+	}
+	vmMgr = metrics.InstrumentDriver(reg, vmMgr)
+	e.Use(metrics.Middleware(reg))
+	e.GET("/metrics/", echo.WrapHandler(metrics.Handler(reg)))
+
 	// Recover from panic middleware.
 	e.Use(middleware.RecoverWithConfig(middleware.RecoverConfig{
 		DisablePrintStack: true,
@@ -63,13 +81,29 @@ func BuildHandler(logger log.Logger, cfg *config.Config, version string,
 	g := e.Group("/v1")
 
 	// Create the services and register the handlers.
-	vmSvc := vm.NewService(vm.NewRepository(logger, vmMgr), logger)
+	hub := event.NewHub()
+	events := event.NewPublisher(p, cfg.Broker.Topic, cfg.VMMgr.URI, hub, logger)
+	go event.Forward(vmMgr.Events(), events)
+	jobSvc := job.NewService(logger)
+	imageSvc := image.NewService(image.NewRepository(logger, vmMgr), jobSvc, logger)
+	vmSvc := vm.NewService(vm.NewRepository(logger, vmMgr), imageSvc, jobSvc,
+		events, hypervisor.StopOptions{
+			Mode:     hypervisor.ShutdownMode(cfg.VMMgr.ShutdownMode),
+			Timeout:  time.Duration(cfg.VMMgr.ShutdownTimeout) * time.Second,
+			Fallback: cfg.VMMgr.ShutdownFallback,
+		}, logger)
+	snapshotSvc := snapshot.NewService(snapshot.NewRepository(logger, vmMgr),
+		vmSvc, jobSvc, logger)
 
 	// Create the middlewares.
 	vmMiddleware := vm.NewMiddleware(vmSvc, logger)
 
 	// Register the handlers.
 	vm.RegisterHandlers(g, vmSvc, logger, vmMiddleware.VerifyID)
+	snapshot.RegisterHandlers(g, snapshotSvc, logger, vmMiddleware.VerifyID)
+	image.RegisterHandlers(g, imageSvc, logger)
+	job.RegisterHandlers(g, jobSvc, logger)
+	event.RegisterHandlers(g, hub, logger)
 
 	return e
 }
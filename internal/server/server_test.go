@@ -0,0 +1,879 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/config"
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor/fake"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const createVMBody = `{"name":"vm-test","cpu":1,"memory":512,"disk":4,"read_iops_sec":100}`
+
+// recordingProducer keeps the published events in memory.
+type recordingProducer struct {
+	mu     sync.Mutex
+	events []entity.Event
+}
+
+func (r *recordingProducer) Produce(topic string, message []byte) error {
+	var e entity.Event
+	if err := json.Unmarshal(message, &e); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recordingProducer) types() []entity.EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var types []entity.EventType
+	for _, e := range r.events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func newTestHandler(t *testing.T) (http.Handler, *fake.Driver, *recordingProducer) {
+	t.Helper()
+	logger, _ := log.NewForTest()
+	trans, _ := ut.New(en.New()).GetTranslator("en")
+	drv := fake.New()
+	_, _ = drv.CreateImage(entity.Image{Name: "alpinelinux3.21", Flavor: "linux-alpine", MinDisk: 2})
+	p := &recordingProducer{}
+	return BuildHandler(logger, &config.Config{}, "test", trans, p, drv), drv, p
+}
+
+func doRequest(h http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// waitJob polls the job resource until the job is done.
+func waitJob(t *testing.T, h http.Handler, rec *httptest.ResponseRecorder) entity.Job {
+	t.Helper()
+	var res struct {
+		Item entity.Job `json:"item"`
+	}
+	assert.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	for i := 0; i < 50 && !res.Item.Done(); i++ {
+		time.Sleep(20 * time.Millisecond)
+		rec = doRequest(h, http.MethodGet, "/v1/jobs/"+res.Item.ID, "")
+		assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	}
+	assert.True(t, res.Item.Done(), "job %s did not complete", res.Item.ID)
+	return res.Item
+}
+
+func TestBuildHandler_VMLifecycle(t *testing.T) {
+	h, drv, p := newTestHandler(t)
+
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status)
+	assert.Equal(t, 100, job.Progress)
+	id := job.VMID
+
+	rec := doRequest(h, http.MethodGet, "/v1/vms/"+id, "")
+	assert.Contains(t, rec.Body.String(), `"name":"vm-test"`)
+
+	rec = doRequest(h, http.MethodGet, "/v1/vms", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"total_count":1`)
+
+	job = waitJob(t, h, doRequest(h, http.MethodPost, "/v1/vms/"+id+"/stop", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status)
+	vm, _ := drv.GetVM(id)
+	assert.Equal(t, entity.VMStateShutOff, vm.State)
+
+	job = waitJob(t, h, doRequest(h, http.MethodPost, "/v1/vms/"+id+"/start", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status)
+
+	job = waitJob(t, h, doRequest(h, http.MethodPost, "/v1/vms/"+id+"/restart", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status)
+
+	rec = doRequest(h, http.MethodGet, "/v1/vms/"+id+"/stats", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	job = waitJob(t, h, doRequest(h, http.MethodDelete, "/v1/vms/"+id, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status)
+	_, err := drv.GetVM(id)
+	assert.Equal(t, fake.ErrNotFound, err)
+
+	// The hypervisor events caused by the API requests are not published
+	// twice.
+	drv.Emit(entity.Event{Type: entity.EventVMDeleted, VMID: id})
+	drv.Emit(entity.Event{Type: entity.EventVMCrashed, VMID: id})
+	assert.Eventually(t, func() bool {
+		return len(p.types()) == 6
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []entity.EventType{
+		entity.EventVMCreated, entity.EventVMStopped, entity.EventVMStarted,
+		entity.EventVMRebooted, entity.EventVMDeleted, entity.EventVMCrashed}, p.types())
+	stopped := p.events[1]
+	assert.Equal(t, entity.EventVersion, stopped.Version)
+	assert.Equal(t, id, stopped.VMID)
+	assert.Equal(t, entity.ActorAPI, stopped.Actor)
+	assert.Equal(t, entity.VMStateRunning, stopped.Before)
+	assert.Equal(t, entity.VMStateShutOff, stopped.After)
+}
+
+func TestBuildHandler_InvalidInput(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+
+	rec := doRequest(h, http.MethodPut, "/v1/vms", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(h, http.MethodPut, "/v1/vms", `{"cpu":0}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(h, http.MethodGet, "/v1/vms/not-a-uuid", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(h, http.MethodPost, "/v1/vms/0b7f2a4e-5d3c-4c4e-9d55-1f2a3b4c5d6e/stop", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"vm_not_found"`)
+}
+
+func TestBuildHandler_FailedJob(t *testing.T) {
+	h, drv, p := newTestHandler(t)
+
+	vm, _, _ := drv.CreateVM(entity.VM{Name: "vm-running", Image: "alpinelinux3.21"}, nil)
+	drv.IgnoreShutdown(true)
+	job := waitJob(t, h, doRequest(h, http.MethodPost, "/v1/vms/"+vm.ID+"/stop?fallback=false", ""))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	if assert.NotNil(t, job.Error) {
+		assert.Equal(t, hypervisor.ErrShutdownTimeout.Error(), job.Error.Message)
+	}
+	assert.Equal(t, []entity.EventType{entity.EventVMOperationFailed}, p.types())
+
+	// A VM failing to start is deleted, the event still names it.
+	drv.FailStart(errors.New("boom"))
+	job = waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	if assert.Len(t, p.events, 2) {
+		failed := p.events[1]
+		assert.Equal(t, entity.EventVMOperationFailed, failed.Type)
+		assert.Equal(t, "create", failed.Operation)
+		assert.Equal(t, "vm-test", failed.VMName)
+		assert.NotEmpty(t, failed.VMID)
+		assert.Equal(t, "boom", failed.Error)
+	}
+	assert.Equal(t, "vm-running", p.events[0].VMName)
+
+	rec := doRequest(h, http.MethodGet, "/v1/jobs/0b7f2a4e-5d3c-4c4e-9d55-1f2a3b4c5d6e", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestBuildHandler_EventStream(t *testing.T) {
+	h, drv, p := newTestHandler(t)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	vm, _, _ := drv.CreateVM(entity.VM{Name: "vm-events", Image: "alpinelinux3.21"}, nil)
+	other, _, _ := drv.CreateVM(entity.VM{Name: "vm-other", Image: "alpinelinux3.21"}, nil)
+
+	res, err := http.Get(srv.URL + "/v1/events/?vm_id=" + vm.ID)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	drv.Emit(entity.Event{Type: entity.EventVMStopped, VMID: other.ID, After: entity.VMStateShutOff})
+	drv.Emit(entity.Event{Type: entity.EventVMCrashed, VMID: vm.ID, After: entity.VMStateCrashed})
+
+	var data string
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+			break
+		}
+	}
+	var e entity.Event
+	assert.NoError(t, json.Unmarshal([]byte(data), &e))
+	assert.Equal(t, entity.EventVMCrashed, e.Type)
+	assert.Equal(t, vm.ID, e.VMID)
+	assert.Equal(t, entity.ActorHypervisor, e.Actor)
+
+	// Hypervisor events are published to the broker as well.
+	assert.Contains(t, p.types(), entity.EventVMStopped)
+	assert.Contains(t, p.types(), entity.EventVMCrashed)
+
+	rec := doRequest(h, http.MethodGet, "/v1/vms/"+vm.ID, "")
+	assert.Contains(t, rec.Body.String(), `"state":"crashed"`)
+
+	rec = doRequest(h, http.MethodGet, "/v1/events/?vm_id=invalid", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestBuildHandler_Images(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+
+	rec := doRequest(h, http.MethodPost, "/v1/images",
+		`{"name":"debian12","os_family":"linux","os_version":"12","arch":"x86_64","flavor":"linux-debian","min_disk":10}`)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"file":"debian12.qcow2"`)
+
+	rec = doRequest(h, http.MethodPost, "/v1/images",
+		`{"name":"debian12","os_family":"linux","os_version":"12","arch":"x86_64"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec = doRequest(h, http.MethodPost, "/v1/images",
+		`{"name":"../etc","os_family":"linux","os_version":"12","arch":"x86_64"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(h, http.MethodGet, "/v1/images", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"alpinelinux3.21"`)
+	assert.Contains(t, rec.Body.String(), `"name":"debian12"`)
+
+	rec = doRequest(h, http.MethodGet, "/v1/images/debian12", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"min_disk":10`)
+
+	// The image is validated against the catalog.
+	rec = doRequest(h, http.MethodPut, "/v1/vms",
+		`{"image":"centos","cpu":1,"memory":512,"disk":20,"read_iops_sec":100}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(h, http.MethodPut, "/v1/vms",
+		`{"image":"debian12","cpu":1,"memory":512,"disk":4,"read_iops_sec":100}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// The default name is derived from the image flavor.
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms",
+		`{"image":"debian12","cpu":1,"memory":512,"disk":20,"read_iops_sec":100}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status)
+	vm, _ := drv.GetVM(job.VMID)
+	assert.Equal(t, "debian12", vm.Image)
+	assert.True(t, strings.HasPrefix(vm.Name, "lx-linux-debian-"), vm.Name)
+
+	rec = doRequest(h, http.MethodDelete, "/v1/images/debian12", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	_ = drv.DeleteVM(vm.ID)
+	rec = doRequest(h, http.MethodDelete, "/v1/images/debian12", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(h, http.MethodGet, "/v1/images/debian12", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestBuildHandler_ImageUploadAndImport(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	content := []byte("qcow2 image")
+	sum := sha256.Sum256(content)
+
+	upload := func(fields map[string]string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		for k, v := range fields {
+			_ = w.WriteField(k, v)
+		}
+		fw, _ := w.CreateFormFile("file", "image.qcow2")
+		_, _ = fw.Write(content)
+		_ = w.Close()
+		req := httptest.NewRequest(http.MethodPost, "/v1/images/upload", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	fields := map[string]string{"name": "debian12", "os_family": "linux",
+		"os_version": "12", "arch": "x86_64", "min_disk": "10"}
+	fields["sha256"] = strings.Repeat("0", 64)
+	rec := upload(fields)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "checksum mismatch")
+
+	fields["sha256"] = hex.EncodeToString(sum[:])
+	rec = upload(fields)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	img, err := drv.GetImage("debian12")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10), img.MinDisk)
+
+	rec = upload(map[string]string{"name": "debian13", "os_family": "linux"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(h, http.MethodPost, "/v1/images/upload", `{"name":"debian13"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Import from a URL.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.qcow2" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	body := `{"name":"fedora41","os_family":"linux","os_version":"41","arch":"x86_64",` +
+		`"url":"%s","sha256":"` + hex.EncodeToString(sum[:]) + `"}`
+	job := waitJob(t, h, doRequest(h, http.MethodPost, "/v1/images/import",
+		fmt.Sprintf(body, srv.URL+"/image.qcow2")))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	_, err = drv.GetImage("fedora41")
+	assert.NoError(t, err)
+
+	rec = doRequest(h, http.MethodPost, "/v1/images/import",
+		fmt.Sprintf(body, srv.URL+"/image.qcow2"))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	body = strings.Replace(body, "fedora41", "fedora42", 1)
+	job = waitJob(t, h, doRequest(h, http.MethodPost, "/v1/images/import",
+		fmt.Sprintf(body, srv.URL+"/missing.qcow2")))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	_, err = drv.GetImage("fedora42")
+	assert.Error(t, err)
+
+	rec = doRequest(h, http.MethodPost, "/v1/images/import",
+		fmt.Sprintf(body, "file:///etc/passwd"))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestBuildHandler_CloudInit(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGZ3b3Jk user@host"
+
+	for _, body := range []string{
+		`{"cpu":1,"memory":512,"disk":4,"read_iops_sec":100,"ssh_authorized_keys":["not a key"]}`,
+		`{"cpu":1,"memory":512,"disk":4,"read_iops_sec":100,"hostname":"under_score"}`,
+		`{"cpu":1,"memory":512,"disk":4,"read_iops_sec":100,"user_data":"#cloud-config\n: ["}`,
+		`{"cpu":1,"memory":512,"disk":4,"read_iops_sec":100,"network_config":"ethernets: {}"}`,
+	} {
+		rec := doRequest(h, http.MethodPut, "/v1/vms", body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms",
+		`{"name":"vm-ci","cpu":1,"memory":512,"disk":4,"read_iops_sec":100,`+
+			`"hostname":"web-1","ssh_authorized_keys":["`+key+`"],`+
+			`"user_data":"#cloud-config\npackages: [nginx]\n",`+
+			`"network_config":"version: 2\nethernets:\n  eth0:\n    dhcp4: true\n"}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	vm, err := drv.GetVM(job.VMID)
+	assert.NoError(t, err)
+	if assert.NotNil(t, vm.CloudInit) {
+		assert.Equal(t, "web-1", vm.CloudInit.Hostname)
+		assert.Equal(t, []string{key}, vm.CloudInit.SSHAuthorizedKeys)
+		assert.Contains(t, vm.CloudInit.UserData, "nginx")
+	}
+}
+
+func TestBuildHandler_Snapshots(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	vm, _, _ := drv.CreateVM(entity.VM{Name: "vm-snap", Image: "alpinelinux3.21"}, nil)
+	base := "/v1/vms/" + vm.ID + "/snapshots"
+
+	job := waitJob(t, h, doRequest(h, http.MethodPost, base, `{"name":"first","description":"clean install"}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = waitJob(t, h, doRequest(h, http.MethodPost, base, `{"name":"second","type":"external"}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+
+	rec := doRequest(h, http.MethodPost, base, `{"name":"first"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	rec = doRequest(h, http.MethodPost, base, `{"name":"../x"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(h, http.MethodPost, base, `{"type":"differential"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	var snap struct {
+		Item entity.Snapshot `json:"item"`
+	}
+	rec = doRequest(h, http.MethodGet, base+"/first", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &snap))
+	assert.Equal(t, "clean install", snap.Item.Description)
+	assert.Equal(t, entity.SnapshotInternal, snap.Item.Type)
+	assert.Equal(t, entity.VMStateRunning, snap.Item.State)
+	assert.True(t, snap.Item.Memory)
+	assert.False(t, snap.Item.CreatedAt.IsZero())
+	rec = doRequest(h, http.MethodGet, base+"/missing", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Branch off the first snapshot.
+	job = waitJob(t, h, doRequest(h, http.MethodPost, base+"/first/revert", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = waitJob(t, h, doRequest(h, http.MethodPost, base, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+
+	var tree struct {
+		Items []entity.SnapshotNode `json:"items"`
+	}
+	rec = doRequest(h, http.MethodGet, base+"?tree=true", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tree))
+	if assert.Len(t, tree.Items, 1) && assert.Len(t, tree.Items[0].Children, 2) {
+		assert.Equal(t, "first", tree.Items[0].Name)
+		assert.Equal(t, "second", tree.Items[0].Children[0].Name)
+		assert.True(t, strings.HasPrefix(tree.Items[0].Children[1].Name, "snap-"))
+		assert.True(t, tree.Items[0].Children[1].Current)
+	}
+
+	// Memory can only be captured from a running VM.
+	_, _ = drv.StopVM(vm.ID, hypervisor.StopOptions{Force: true}, nil)
+	rec = doRequest(h, http.MethodPost, base, `{"type":"external","memory":true}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	job = waitJob(t, h, doRequest(h, http.MethodDelete, base+"/first", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	rec = doRequest(h, http.MethodGet, base+"?tree=true", "")
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tree))
+	assert.Len(t, tree.Items, 2)
+	rec = doRequest(h, http.MethodDelete, base+"/first", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestBuildHandler_Stop(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	vm, _, _ := drv.CreateVM(entity.VM{Name: "vm-stop", Image: "alpinelinux3.21"}, nil)
+	url := "/v1/vms/" + vm.ID + "/stop"
+
+	outcome := func(job entity.Job) string {
+		res, _ := job.Result.(map[string]interface{})
+		outcome, _ := res["outcome"].(string)
+		return outcome
+	}
+
+	rec := doRequest(h, http.MethodPost, url+"?mode=magic", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(h, http.MethodPost, url+"?force=maybe", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	job := waitJob(t, h, doRequest(h, http.MethodPost, url+"?mode=agent", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "graceful", outcome(job))
+
+	_ = drv.StartVM(vm.ID)
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"?force=true", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "forced", outcome(job))
+
+	// Hung guests are left running unless the fallback is enabled.
+	drv.IgnoreShutdown(true)
+	_ = drv.StartVM(vm.ID)
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"?timeout=1&fallback=false", ""))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	assert.Contains(t, job.Error.Message, "did not shut down")
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"?fallback=true", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "forced", outcome(job))
+}
+
+func TestBuildHandler_PauseResumeSave(t *testing.T) {
+	h, drv, p := newTestHandler(t)
+	vm, _, _ := drv.CreateVM(entity.VM{Name: "vm-pause", Image: "alpinelinux3.21"}, nil)
+	url := "/v1/vms/" + vm.ID
+
+	rec := doRequest(h, http.MethodPost, url+"/resume", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cannot resume a VM in state running")
+
+	job := waitJob(t, h, doRequest(h, http.MethodPost, url+"/pause", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	got, _ := drv.GetVM(vm.ID)
+	assert.Equal(t, entity.VMStatePaused, got.State)
+
+	rec = doRequest(h, http.MethodPost, url+"/pause", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"/reset", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"/resume", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	got, _ = drv.GetVM(vm.ID)
+	assert.Equal(t, entity.VMStateRunning, got.State)
+
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"/save", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	rec = doRequest(h, http.MethodGet, url, "")
+	assert.Contains(t, rec.Body.String(), `"state":"shutoff"`)
+	assert.Contains(t, rec.Body.String(), `"saved":true`)
+
+	for _, action := range []string{"pause", "resume", "save", "reset"} {
+		rec = doRequest(h, http.MethodPost, url+"/"+action, "")
+		assert.Equal(t, http.StatusConflict, rec.Code, action)
+	}
+
+	job = waitJob(t, h, doRequest(h, http.MethodPost, url+"/start", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	got, _ = drv.GetVM(vm.ID)
+	assert.False(t, got.Saved)
+
+	assert.Equal(t, []entity.EventType{
+		entity.EventVMPaused, entity.EventVMReset, entity.EventVMResumed,
+		entity.EventVMSaved, entity.EventVMStarted}, p.types())
+}
+
+func TestBuildHandler_StateTransitions(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	vm, _, _ := drv.CreateVM(entity.VM{Name: "vm-state", Image: "alpinelinux3.21"}, nil)
+	url := "/v1/vms/" + vm.ID
+
+	rec := doRequest(h, http.MethodPost, url+"/start", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"invalid_state_transition"`)
+
+	// A single operation runs at a time on a VM.
+	release := drv.Hold()
+	stop := doRequest(h, http.MethodPost, url+"/stop", "")
+	assert.Equal(t, http.StatusAccepted, stop.Code)
+	rec = doRequest(h, http.MethodGet, url, "")
+	assert.Contains(t, rec.Body.String(), `"state":"stopping"`)
+	// The shutdown was requested, the guest did not shut down yet.
+	var pending struct {
+		Item entity.Job `json:"item"`
+	}
+	assert.NoError(t, json.Unmarshal(stop.Body.Bytes(), &pending))
+	assert.Eventually(t, func() bool {
+		rec := doRequest(h, http.MethodGet, "/v1/jobs/"+pending.Item.ID, "")
+		return json.Unmarshal(rec.Body.Bytes(), &pending) == nil &&
+			pending.Item.Progress == hypervisor.ProgressShutdownRequested
+	}, time.Second, 10*time.Millisecond)
+	for _, req := range []struct{ method, url string }{
+		{http.MethodPost, url + "/stop"},
+		{http.MethodDelete, url},
+		{http.MethodPost, url + "/snapshots"},
+		{http.MethodPost, url + "/snapshots/first/revert"},
+		{http.MethodDelete, url + "/snapshots/first"},
+	} {
+		rec = doRequest(h, req.method, req.url, "")
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"code":"operation_in_progress"`)
+	}
+	rec = doRequest(h, http.MethodPatch, url+"/disks/"+fake.Disk+"/iotune", `{"read_iops_sec":200}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cannot tune the VM: stop in progress")
+	release()
+	job := waitJob(t, h, stop)
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+
+	rec = doRequest(h, http.MethodPost, url+"/stop", "")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cannot stop a VM in state shutoff")
+	job = waitJob(t, h, doRequest(h, http.MethodDelete, url, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+}
+
+func TestBuildHandler_VMNames(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+
+	for _, name := range []string{"Web-1", "web_1", "1web", "web-", strings.Repeat("a", 64)} {
+		rec := doRequest(h, http.MethodPut, "/v1/vms",
+			`{"name":"`+name+`","cpu":1,"memory":512,"disk":4,"read_iops_sec":100}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, name)
+	}
+
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	rec := doRequest(h, http.MethodPut, "/v1/vms", createVMBody)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"vm_exists"`)
+
+	// Default names are unique, even when created on the same day.
+	body := `{"cpu":1,"memory":512,"disk":4,"read_iops_sec":100}`
+	names := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", body))
+		assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+		vm, _ := drv.GetVM(job.VMID)
+		assert.Regexp(t, `^lx-linux-alpine-\d{8}-[a-z0-9]{5}$`, vm.Name)
+		names[vm.Name] = true
+	}
+	assert.Len(t, names, 3)
+}
+
+func TestBuildHandler_ListVMs(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	for i, name := range []string{"web-1", "web-2", "web-3", "db-1", "db-2"} {
+		vm, _, _ := drv.CreateVM(entity.VM{Name: name, Image: "alpinelinux3.21",
+			CPU: uint(i + 1), Memory: 512 * uint(i+1),
+			Labels: map[string]string{"app": name[:strings.Index(name, "-")]}}, nil)
+		if name == "db-2" {
+			_, _ = drv.StopVM(vm.ID, hypervisor.StopOptions{Force: true}, nil)
+		}
+	}
+
+	names := func(rec *httptest.ResponseRecorder) []string {
+		var res struct {
+			TotalCount int `json:"total_count"`
+			Items      []entity.VM
+		}
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		names := []string{}
+		for _, vm := range res.Items {
+			names = append(names, vm.Name)
+		}
+		return names
+	}
+
+	rec := doRequest(h, http.MethodGet, "/v1/vms", "")
+	assert.Equal(t, []string{"db-1", "db-2", "web-1", "web-2", "web-3"}, names(rec))
+	assert.Empty(t, rec.Header().Get("Link"))
+
+	for url, expected := range map[string][]string{
+		"/v1/vms?state=shutoff":                  {"db-2"},
+		"/v1/vms?name=web":                       {"web-1", "web-2", "web-3"},
+		"/v1/vms?image=debian12":                 {},
+		"/v1/vms?label=app=db":                   {"db-1", "db-2"},
+		"/v1/vms?label=app&label=app=web":        {"web-1", "web-2", "web-3"},
+		"/v1/vms?cpu_min=2&cpu_max=3":            {"web-2", "web-3"},
+		"/v1/vms?memory_min=2048":                {"db-1", "db-2"},
+		"/v1/vms?sort=-cpu":                      {"db-2", "db-1", "web-3", "web-2", "web-1"},
+		"/v1/vms?sort=state&name=db":             {"db-1", "db-2"},
+		"/v1/vms?name=web&sort=-name&per_page=2": {"web-3", "web-2"},
+	} {
+		assert.Equal(t, expected, names(doRequest(h, http.MethodGet, url, "")), url)
+	}
+
+	// Pages are sliced from the matching VMs and linked to each other.
+	rec = doRequest(h, http.MethodGet, "/v1/vms?name=web&per_page=2&page=2", "")
+	assert.Equal(t, []string{"web-3"}, names(rec))
+	assert.Contains(t, rec.Body.String(), `"total_count":3`)
+	assert.Contains(t, rec.Body.String(), `"page_count":2`)
+	assert.Equal(t, `</v1/vms/?name=web&page=1&per_page=2>; rel="first", `+
+		`</v1/vms/?name=web&page=1&per_page=2>; rel="prev"`, rec.Header().Get("Link"))
+	rec = doRequest(h, http.MethodGet, "/v1/vms?per_page=2&page=5", "")
+	assert.Empty(t, names(rec))
+
+	for _, url := range []string{"/v1/vms?state=asleep", "/v1/vms?sort=id", "/v1/vms?cpu_min=many"} {
+		rec = doRequest(h, http.MethodGet, url, "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code, url)
+	}
+
+	rec = doRequest(h, http.MethodPut, "/v1/vms",
+		`{"name":"vm-labels","cpu":1,"memory":512,"disk":4,"read_iops_sec":100,"labels":{"bad key":"x"}}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms",
+		`{"name":"vm-labels","cpu":1,"memory":512,"disk":4,"read_iops_sec":100,"labels":{"team":"infra"}}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	rec = doRequest(h, http.MethodGet, "/v1/vms/"+job.VMID, "")
+	assert.Contains(t, rec.Body.String(), `"labels":{"team":"infra"}`)
+}
+
+func TestBuildHandler_Metrics(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	id := job.VMID
+
+	start := time.Date(2025, 5, 2, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		drv.RecordMetrics(id, entity.VMStats{
+			Timestamp:        start.Add(time.Duration(i) * 10 * time.Second),
+			Interval:         10,
+			CPUUsage:         float64(i * 10),
+			NetRxBytesSec:    100,
+			DiskReadBytesSec: float64(i),
+		})
+	}
+
+	type response struct {
+		Metrics struct {
+			Step   float64 `json:"step_sec"`
+			Series []struct {
+				Metric string
+				Points []struct {
+					Timestamp time.Time
+					Value     float64
+				}
+			}
+		}
+	}
+	get := func(query string) response {
+		rec := doRequest(h, http.MethodGet, "/v1/vms/"+id+"/metrics?"+query, "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+
+	// Every metric is returned as sampled by default.
+	res := get("from=2025-05-02T09:00:00Z&to=2025-05-02T11:00:00Z")
+	require.Len(t, res.Metrics.Series, 10)
+	assert.Equal(t, "cpu_usage", res.Metrics.Series[0].Metric)
+	assert.Len(t, res.Metrics.Series[0].Points, 6)
+	assert.Equal(t, 50.0, res.Metrics.Series[0].Points[5].Value)
+
+	// Points are averaged over windows of step.
+	res = get("from=2025-05-02T10:00:00Z&to=2025-05-02T10:01:00Z&step=30s&metric=cpu_usage&metric=net_rx_bytes_sec")
+	assert.Equal(t, 30.0, res.Metrics.Step)
+	require.Len(t, res.Metrics.Series, 2)
+	cpu := res.Metrics.Series[0].Points
+	require.Len(t, cpu, 2)
+	assert.Equal(t, start, cpu[0].Timestamp)
+	assert.Equal(t, 10.0, cpu[0].Value)
+	assert.Equal(t, start.Add(30*time.Second), cpu[1].Timestamp)
+	assert.Equal(t, 40.0, cpu[1].Value)
+	assert.Equal(t, "net_rx_bytes_sec", res.Metrics.Series[1].Metric)
+	assert.Equal(t, 100.0, res.Metrics.Series[1].Points[0].Value)
+
+	// The time range defaults to the last hour.
+	res = get("metric=cpu_usage")
+	assert.Empty(t, res.Metrics.Series[0].Points)
+
+	for _, query := range []string{
+		"metric=load", "step=-1m", "step=soon", "from=yesterday",
+		"from=2025-05-02T11:00:00Z&to=2025-05-02T10:00:00Z",
+		"from=2025-05-01T00:00:00Z&to=2025-05-02T00:00:00Z&step=1s",
+	} {
+		rec := doRequest(h, http.MethodGet, "/v1/vms/"+id+"/metrics?"+query, "")
+		assert.Equal(t, http.StatusBadRequest, rec.Code, query)
+	}
+}
+
+func TestBuildHandler_PrometheusMetrics(t *testing.T) {
+	h, _, _ := newTestHandler(t)
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	doRequest(h, http.MethodGet, "/v1/vms/"+job.VMID, "")
+	doRequest(h, http.MethodGet, "/v1/vms/"+uuid.NewString(), "")
+
+	rec := doRequest(h, http.MethodGet, "/metrics", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, metric := range []string{
+		`kvmm_http_requests_total{method="GET",route="/v1/vms/:id/",status="201"} 1`,
+		`kvmm_http_requests_total{method="GET",route="/v1/vms/:id/",status="404"} 1`,
+		`kvmm_http_request_duration_seconds_count{method="PUT",route="/v1/vms/",status="202"} 1`,
+		`kvmm_hypervisor_call_duration_seconds_count{operation="create_vm"} 1`,
+		`kvmm_hypervisor_call_errors_total{error="vm_not_found",operation="get_vm"} 1`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, body, metric)
+	}
+}
+
+func TestBuildHandler_IOTune(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	url := "/v1/vms/" + job.VMID + "/disks/" + fake.Disk + "/iotune"
+
+	type response struct {
+		IOTune entity.IOTune
+	}
+	patch := func(body string) response {
+		rec := doRequest(h, http.MethodPatch, url, body)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var res response
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		return res
+	}
+
+	// Throttles left out keep the value set at creation.
+	res := patch(`{"write_iops_sec":200,"read_iops_sec_max":300,"read_iops_sec_max_length":10}`)
+	assert.Equal(t, entity.IOTune{
+		ReadIopsSec:          100,
+		WriteIopsSec:         200,
+		ReadIopsSecMax:       300,
+		ReadIopsSecMaxLength: 10,
+	}, res.IOTune)
+
+	// A total throttle replaces the read and write ones, their bursts are
+	// to be removed as well.
+	res = patch(`{"total_iops_sec":500,"read_iops_sec_max":0,"read_iops_sec_max_length":0,` +
+		`"total_bytes_sec":50,"group_name":"db"}`)
+	assert.Equal(t, entity.IOTune{
+		TotalIopsSec:  500,
+		TotalBytesSec: 50,
+		GroupName:     "db",
+	}, res.IOTune)
+	vm, err := drv.GetVM(job.VMID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(500), vm.TotalIopsSec)
+	assert.Zero(t, vm.ReadIopsSec)
+
+	// An empty group name leaves the group.
+	res = patch(`{"group_name":""}`)
+	assert.Empty(t, res.IOTune.GroupName)
+	assert.Equal(t, uint64(500), res.IOTune.TotalIopsSec)
+
+	for _, body := range []string{
+		`{"total_bytes_sec":10,"read_bytes_sec":5}`,
+		`{"write_iops_sec_max":100}`,
+		`{"total_iops_sec_max":100}`,
+		`{"total_bytes_sec_max_length":10}`,
+		`{"total_iops_sec_max_length":7200}`,
+		`{"read_iops_sec":-1}`,
+		`{"write_bytes_sec_max":18446744073709551615}`,
+	} {
+		rec := doRequest(h, http.MethodPatch, url, body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	rec := doRequest(h, http.MethodPatch, "/v1/vms/"+job.VMID+"/disks/vdz/iotune",
+		`{"read_iops_sec":100}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"disk_not_found"`)
+}
+
+func TestBuildHandler_Resize(t *testing.T) {
+	h, drv, _ := newTestHandler(t)
+	job := waitJob(t, h, doRequest(h, http.MethodPut, "/v1/vms", createVMBody))
+	url := "/v1/vms/" + job.VMID
+
+	outcome := func(job entity.Job) string {
+		res, _ := job.Result.(map[string]interface{})
+		outcome, _ := res["outcome"].(string)
+		return outcome
+	}
+
+	vm, err := drv.GetVM(job.VMID)
+	require.NoError(t, err)
+	require.Equal(t, entity.VMStateRunning, vm.State)
+	assert.Equal(t, uint(fake.Headroom), vm.MaxCPU)
+	assert.Equal(t, uint(512*fake.Headroom), vm.MaxMemory)
+
+	// Within the headroom the change is applied live.
+	job = waitJob(t, h, doRequest(h, http.MethodPatch, url, `{"cpu":2,"memory":1024}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "applied", outcome(job))
+	vm, err = drv.GetVM(job.VMID)
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), vm.CPU)
+	assert.Equal(t, uint(1024), vm.Memory)
+
+	// Beyond it the change takes effect at the next boot.
+	job = waitJob(t, h, doRequest(h, http.MethodPatch, url, `{"cpu":4}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "reboot_required", outcome(job))
+	vm, err = drv.GetVM(job.VMID)
+	require.NoError(t, err)
+	assert.Equal(t, uint(4), vm.CPU)
+	assert.Equal(t, uint(4), vm.MaxCPU)
+	assert.Equal(t, uint(1024), vm.Memory)
+
+	for _, body := range []string{"", `{}`, `{"cpu":2000}`, `{"memory":64}`, `{"cpu":-1}`} {
+		rec := doRequest(h, http.MethodPatch, url, body)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+	rec := doRequest(h, http.MethodPatch, "/v1/vms/"+uuid.NewString(), `{"cpu":2}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,116 @@
+package snapshot
+
+import (
+	"net/http"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/labstack/echo/v4"
+)
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func RegisterHandlers(g *echo.Group, service Service, logger log.Logger, verifyID echo.MiddlewareFunc) {
+
+	res := resource{service, logger}
+
+	g.POST("/vms/:id/snapshots/", res.create, verifyID)
+	g.GET("/vms/:id/snapshots/", res.list, verifyID)
+	g.GET("/vms/:id/snapshots/:name/", res.get, verifyID)
+	g.DELETE("/vms/:id/snapshots/:name/", res.delete, verifyID)
+	g.POST("/vms/:id/snapshots/:name/revert/", res.revert, verifyID)
+}
+
+func (r resource) create(c echo.Context) error {
+
+	ctx := c.Request().Context()
+
+	// Every field is optional, so is the body.
+	var input CreateSnapshotRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&input); err != nil {
+			r.logger.With(ctx).Error(err)
+			return err
+		}
+	}
+
+	job, err := r.service.Create(ctx, c.Param("id"), input)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "snapshot creation accepted", job)
+}
+
+// list enumerates the snapshots, or returns them as a tree when the `tree`
+// query parameter is set.
+func (r resource) list(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	if c.QueryParam("tree") == "true" {
+		tree, err := r.service.Tree(ctx, c.Param("id"))
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, struct {
+			Status  string                `json:"status"`
+			Message string                `json:"message"`
+			Tree    []entity.SnapshotNode `json:"items"`
+		}{"ok", "snapshots enumerated successfully", tree})
+	}
+
+	snaps, err := r.service.List(ctx, c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status    string            `json:"status"`
+		Message   string            `json:"message"`
+		Snapshots []entity.Snapshot `json:"items"`
+	}{"ok", "snapshots enumerated successfully", snaps})
+}
+
+func (r resource) get(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	snap, err := r.service.Get(ctx, c.Param("id"), c.Param("name"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status   string          `json:"status"`
+		Message  string          `json:"message"`
+		Snapshot entity.Snapshot `json:"item"`
+	}{"ok", "snapshot retrieved successfully", snap})
+}
+
+func (r resource) delete(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	job, err := r.service.Delete(ctx, c.Param("id"), c.Param("name"))
+	if err != nil {
+		return err
+	}
+	return accepted(c, "snapshot deletion accepted", job)
+}
+
+func (r resource) revert(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	job, err := r.service.Revert(ctx, c.Param("id"), c.Param("name"))
+	if err != nil {
+		return err
+	}
+	return accepted(c, "snapshot revert accepted", job)
+}
+
+// accepted responds with the job tracking an asynchronous operation.
+func accepted(c echo.Context, msg string, job entity.Job) error {
+	return c.JSON(http.StatusAccepted, struct {
+		Status  string     `json:"status"`
+		Message string     `json:"message"`
+		Job     entity.Job `json:"item"`
+	}{"ok", msg, job})
+}
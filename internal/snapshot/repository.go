@@ -0,0 +1,67 @@
+package snapshot
+
+import (
+	"context"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+)
+
+// repository manages VM snapshots through the hypervisor.
+type repository struct {
+	logger log.Logger
+	vmMgr  hypervisor.Driver
+}
+
+// Repository encapsulates the logic to access VM snapshots.
+type Repository interface {
+	// GetVM retrieves the VM the snapshots belong to.
+	GetVM(ctx context.Context, vmID string) (entity.VM, error)
+	// Create captures a new snapshot of a VM.
+	Create(ctx context.Context, vmID string, snap entity.Snapshot) (entity.Snapshot, error)
+	// Get retrieves a snapshot of a VM given its name.
+	Get(ctx context.Context, vmID, name string) (entity.Snapshot, error)
+	// List enumerates the snapshots of a VM.
+	List(ctx context.Context, vmID string) ([]entity.Snapshot, error)
+	// Revert restores a VM to a snapshot.
+	Revert(ctx context.Context, vmID, name string) error
+	// Delete removes a snapshot of a VM.
+	Delete(ctx context.Context, vmID, name string) error
+}
+
+// NewRepository creates a new snapshot repository.
+func NewRepository(logger log.Logger, vmMgr hypervisor.Driver) Repository {
+	return repository{logger, vmMgr}
+}
+
+// GetVM retrieves the VM the snapshots belong to.
+func (r repository) GetVM(ctx context.Context, vmID string) (entity.VM, error) {
+	return r.vmMgr.GetVM(vmID)
+}
+
+// Create captures a new snapshot of a VM.
+func (r repository) Create(ctx context.Context, vmID string, snap entity.Snapshot) (
+	entity.Snapshot, error) {
+	return r.vmMgr.CreateSnapshot(vmID, snap)
+}
+
+// Get retrieves a snapshot of a VM given its name.
+func (r repository) Get(ctx context.Context, vmID, name string) (entity.Snapshot, error) {
+	return r.vmMgr.GetSnapshot(vmID, name)
+}
+
+// List enumerates the snapshots of a VM.
+func (r repository) List(ctx context.Context, vmID string) ([]entity.Snapshot, error) {
+	return r.vmMgr.ListSnapshots(vmID)
+}
+
+// Revert restores a VM to a snapshot.
+func (r repository) Revert(ctx context.Context, vmID, name string) error {
+	return r.vmMgr.RevertSnapshot(vmID, name)
+}
+
+// Delete removes a snapshot of a VM.
+func (r repository) Delete(ctx context.Context, vmID, name string) error {
+	return r.vmMgr.DeleteSnapshot(vmID, name)
+}
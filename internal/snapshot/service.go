@@ -0,0 +1,200 @@
+package snapshot
+
+import (
+	"context"
+	goerrors "errors"
+	"regexp"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/internal/job"
+	"github.com/ayoubfaouzi/kvm-manager/internal/vm"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+)
+
+const (
+	// Operations performed asynchronously through jobs.
+	opCreate = vm.OpSnapshotCreate
+	opRevert = vm.OpSnapshotRevert
+	opDelete = vm.OpSnapshotDelete
+)
+
+// nameRegex matches the names allowed for snapshots, which end up in the
+// name of the files of external snapshots.
+var nameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]*$`)
+
+type CreateSnapshotRequest struct {
+	Name        string              `json:"name" validate:"max=64" example:"before-upgrade"` // Defaults to snap-<date>
+	Description string              `json:"description" validate:"max=1024" example:"Before upgrading to 3.22"`
+	Type        entity.SnapshotType `json:"type" validate:"omitempty,oneof=internal external" example:"internal"` // Defaults to internal
+	Memory      bool                `json:"memory"`                                                               // Captures the memory of a running VM
+}
+
+// VMs serializes the snapshot operations with the other operations
+// performed on the VMs.
+type VMs interface {
+	// Acquire claims the VM for operation, it fails if the operation is
+	// illegal from the VM state or if another one is in progress.
+	Acquire(ctx context.Context, id, operation string) (release func(), err error)
+}
+
+type service struct {
+	repo   Repository
+	vms    VMs
+	jobs   job.Service
+	logger log.Logger
+}
+
+// Service encapsulates use case logic for VM snapshots.
+type Service interface {
+	Create(ctx context.Context, vmID string, input CreateSnapshotRequest) (entity.Job, error)
+	Get(ctx context.Context, vmID, name string) (entity.Snapshot, error)
+	List(ctx context.Context, vmID string) ([]entity.Snapshot, error)
+	Tree(ctx context.Context, vmID string) ([]entity.SnapshotNode, error)
+	Revert(ctx context.Context, vmID, name string) (entity.Job, error)
+	Delete(ctx context.Context, vmID, name string) (entity.Job, error)
+}
+
+// NewService creates a new snapshot service.
+func NewService(repo Repository, vms VMs, jobs job.Service, logger log.Logger) Service {
+	return service{repo, vms, jobs, logger}
+}
+
+// Create submits a job which snapshots the VM.
+func (s service) Create(ctx context.Context, vmID string, req CreateSnapshotRequest) (
+	entity.Job, error) {
+
+	if req.Name == "" {
+		req.Name = "snap-" + time.Now().UTC().Format("20060102-150405")
+	}
+	if !nameRegex.MatchString(req.Name) {
+		return entity.Job{}, errors.BadRequest(
+			"snapshot name may only contain letters, digits, '_' and '-'")
+	}
+	if req.Type == "" {
+		req.Type = entity.SnapshotInternal
+	}
+
+	release, err := s.vms.Acquire(ctx, vmID, opCreate)
+	if err != nil {
+		return entity.Job{}, err
+	}
+	submitted := false
+	defer func() {
+		if !submitted {
+			release()
+		}
+	}()
+
+	vm, err := s.repo.GetVM(ctx, vmID)
+	if err != nil {
+		return entity.Job{}, err
+	}
+	if req.Memory && vm.State != entity.VMStateRunning {
+		return entity.Job{}, hypervisor.ErrSnapshotMemory
+	}
+	if _, err := s.repo.Get(ctx, vmID, req.Name); err == nil {
+		return entity.Job{}, hypervisor.ErrSnapshotExists
+	} else if !goerrors.Is(err, hypervisor.ErrSnapshotNotFound) {
+		return entity.Job{}, err
+	}
+
+	submitted = true
+	return s.jobs.Submit(ctx, opCreate, vmID, func(ctx context.Context, t job.Tracker) (interface{}, error) {
+		defer release()
+		return s.repo.Create(ctx, vmID, entity.Snapshot{
+			Name:        req.Name,
+			Description: req.Description,
+			Type:        req.Type,
+			Memory:      req.Memory,
+		})
+	}), nil
+}
+
+func (s service) Get(ctx context.Context, vmID, name string) (entity.Snapshot, error) {
+	snap, err := s.repo.Get(ctx, vmID, name)
+	if err != nil {
+		return entity.Snapshot{}, err
+	}
+	return snap, nil
+}
+
+func (s service) List(ctx context.Context, vmID string) ([]entity.Snapshot, error) {
+	return s.repo.List(ctx, vmID)
+}
+
+// Tree returns the snapshots without parent, along with their descendants.
+func (s service) Tree(ctx context.Context, vmID string) ([]entity.SnapshotNode, error) {
+	snaps, err := s.repo.List(ctx, vmID)
+	if err != nil {
+		return nil, err
+	}
+	return buildTree(snaps), nil
+}
+
+// Revert submits a job which reverts the VM to the snapshot. The job
+// result is the VM once reverted.
+func (s service) Revert(ctx context.Context, vmID, name string) (entity.Job, error) {
+	return s.submit(ctx, opRevert, vmID, name, func(ctx context.Context) (interface{}, error) {
+		if err := s.repo.Revert(ctx, vmID, name); err != nil {
+			return nil, err
+		}
+		return s.repo.GetVM(ctx, vmID)
+	})
+}
+
+// Delete submits a job which deletes the snapshot.
+func (s service) Delete(ctx context.Context, vmID, name string) (entity.Job, error) {
+	return s.submit(ctx, opDelete, vmID, name, func(ctx context.Context) (interface{}, error) {
+		return nil, s.repo.Delete(ctx, vmID, name)
+	})
+}
+
+// submit runs op asynchronously once the snapshot is known to exist. The
+// VM is acquired until op completes.
+func (s service) submit(ctx context.Context, operation, vmID, name string,
+	op func(ctx context.Context) (interface{}, error)) (entity.Job, error) {
+
+	release, err := s.vms.Acquire(ctx, vmID, operation)
+	if err != nil {
+		return entity.Job{}, err
+	}
+	if _, err := s.repo.Get(ctx, vmID, name); err != nil {
+		release()
+		return entity.Job{}, err
+	}
+	return s.jobs.Submit(ctx, operation, vmID, func(ctx context.Context, t job.Tracker) (interface{}, error) {
+		defer release()
+		return op(ctx)
+	}), nil
+}
+
+// buildTree arranges the snapshots by parent, keeping their order among
+// siblings. Snapshots whose parent is unknown are considered roots.
+func buildTree(snaps []entity.Snapshot) []entity.SnapshotNode {
+
+	known := make(map[string]bool, len(snaps))
+	for _, snap := range snaps {
+		known[snap.Name] = true
+	}
+	children := make(map[string][]entity.Snapshot)
+	for _, snap := range snaps {
+		parent := snap.Parent
+		if !known[parent] {
+			parent = ""
+		}
+		children[parent] = append(children[parent], snap)
+	}
+
+	var build func(parent string) []entity.SnapshotNode
+	build = func(parent string) []entity.SnapshotNode {
+		nodes := []entity.SnapshotNode{}
+		for _, snap := range children[parent] {
+			nodes = append(nodes, entity.SnapshotNode{Snapshot: snap, Children: build(snap.Name)})
+		}
+		return nodes
+	}
+	return build("")
+}
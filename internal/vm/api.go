@@ -2,11 +2,14 @@ package vm
 
 import (
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
 	"github.com/ayoubfaouzi/kvm-manager/pkg/pagination"
 
 	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
 	"github.com/labstack/echo/v4"
 )
 
@@ -22,11 +25,19 @@ func RegisterHandlers(g *echo.Group, service Service, logger log.Logger, verifyI
 	g.PUT("/vms/", res.create)
 	g.GET("/vms/", res.list)
 	g.GET("/vms/:id/", res.get, verifyID)
+	g.PATCH("/vms/:id/", res.resize, verifyID)
 	g.DELETE("/vms/:id/", res.delete, verifyID)
 	g.POST("/vms/:id/start/", res.start, verifyID)
 	g.POST("/vms/:id/stop/", res.stop, verifyID)
 	g.POST("/vms/:id/restart/", res.restart, verifyID)
+	g.POST("/vms/:id/pause/", res.pause, verifyID)
+	g.POST("/vms/:id/resume/", res.resume, verifyID)
+	g.POST("/vms/:id/save/", res.save, verifyID)
+	g.POST("/vms/:id/reset/", res.reset, verifyID)
+	g.POST("/vms/:id/flatten/", res.flatten, verifyID)
 	g.GET("/vms/:id/stats/", res.stats, verifyID)
+	g.GET("/vms/:id/metrics/", res.metrics, verifyID)
+	g.PATCH("/vms/:id/disks/:dev/iotune/", res.updateIOTune, verifyID)
 }
 
 func (r resource) create(c echo.Context) error {
@@ -39,33 +50,62 @@ func (r resource) create(c echo.Context) error {
 		return err
 	}
 
-	vm, err := r.service.Create(ctx, input)
+	job, err := r.service.Create(ctx, input)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, struct {
-		Status  string    `json:"status"`
-		Message string    `json:"message"`
-		VM      entity.VM `json:"item"`
-	}{"ok", "vm created successfully", vm.VM})
+	return accepted(c, "vm creation accepted", job)
 }
 
 func (r resource) list(c echo.Context) error {
 	ctx := c.Request().Context()
-	count, err := r.service.Count(ctx)
+
+	var input ListVMsRequest
+	err := echo.QueryParamsBinder(c).
+		String("state", &input.State).
+		String("name", &input.Name).
+		String("image", &input.Image).
+		Strings("label", &input.Labels).
+		Uint("cpu_min", &input.MinCPU).
+		Uint("cpu_max", &input.MaxCPU).
+		Uint("memory_min", &input.MinMemory).
+		Uint("memory_max", &input.MaxMemory).
+		String("sort", &input.Sort).
+		BindError()
 	if err != nil {
+		return errors.BadRequest("invalid query parameters")
+	}
+	if err := c.Validate(&input); err != nil {
 		return err
 	}
 
-	pages := pagination.NewFromRequest(c.Request(), count)
-	vms, err := r.service.List(ctx, pages.Offset(), pages.Limit())
+	// The total is only known once the VMs are filtered.
+	pages := pagination.NewFromRequest(c.Request(), -1)
+	vms, count, err := r.service.List(ctx, input, pages.Offset(), pages.Limit())
 	if err != nil {
 		return err
 	}
+	pages.SetTotal(count)
 	pages.Items = vms
+	if link := pages.BuildLinkHeader(linkBaseURL(c.Request()),
+		pagination.DefaultPageSize); link != "" {
+		c.Response().Header().Set("Link", link)
+	}
 	return c.JSON(http.StatusOK, pages)
 }
 
+// linkBaseURL returns the URL of the request without the pagination
+// parameters, for the links to the other pages to keep the filters.
+func linkBaseURL(req *http.Request) string {
+	query := req.URL.Query()
+	query.Del(pagination.PageVar)
+	query.Del(pagination.PageSizeVar)
+	if len(query) == 0 {
+		return req.URL.Path
+	}
+	return req.URL.Path + "?" + query.Encode()
+}
+
 func (r resource) get(c echo.Context) error {
 
 	ctx := c.Request().Context()
@@ -77,18 +117,32 @@ func (r resource) get(c echo.Context) error {
 	return c.JSON(http.StatusCreated, vm)
 }
 
+func (r resource) resize(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	var input ResizeVMRequest
+	if err := c.Bind(&input); err != nil {
+		return err
+	}
+
+	job, err := r.service.Resize(ctx, id, input)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm resize accepted", job)
+}
+
 func (r resource) delete(c echo.Context) error {
 
 	ctx := c.Request().Context()
 	id := c.Param("id")
-	err := r.service.Delete(ctx, id)
+	job, err := r.service.Delete(ctx, id)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}{"ok", "vm deleted successfully"})
+	return accepted(c, "vm deletion accepted", job)
 
 }
 
@@ -96,14 +150,11 @@ func (r resource) start(c echo.Context) error {
 
 	ctx := c.Request().Context()
 	id := c.Param("id")
-	err := r.service.Start(ctx, id)
+	job, err := r.service.Start(ctx, id)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}{"ok", "vm started successfully"})
+	return accepted(c, "vm start accepted", job)
 
 }
 
@@ -111,14 +162,34 @@ func (r resource) stop(c echo.Context) error {
 
 	ctx := c.Request().Context()
 	id := c.Param("id")
-	err := r.service.Stop(ctx, id)
+
+	var input StopVMRequest
+	var fallback string
+	err := echo.QueryParamsBinder(c).
+		Bool("force", &input.Force).
+		String("mode", &input.Mode).
+		Uint("timeout", &input.Timeout).
+		String("fallback", &fallback).
+		BindError()
 	if err != nil {
+		return errors.BadRequest("invalid query parameters")
+	}
+	if fallback != "" {
+		v, err := strconv.ParseBool(fallback)
+		if err != nil {
+			return errors.BadRequest("invalid fallback parameter")
+		}
+		input.Fallback = &v
+	}
+	if err := c.Validate(&input); err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}{"ok", "vm stopped successfully"})
+
+	job, err := r.service.Stop(ctx, id, input)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm stop accepted", job)
 
 }
 
@@ -126,14 +197,67 @@ func (r resource) restart(c echo.Context) error {
 
 	ctx := c.Request().Context()
 	id := c.Param("id")
-	err := r.service.Restart(ctx, id)
+	job, err := r.service.Restart(ctx, id)
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-	}{"ok", "vm restarted successfully"})
+	return accepted(c, "vm restart accepted", job)
+
+}
+
+func (r resource) pause(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	job, err := r.service.Pause(ctx, id)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm pause accepted", job)
+}
+
+func (r resource) resume(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	job, err := r.service.Resume(ctx, id)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm resume accepted", job)
+}
+
+func (r resource) save(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	job, err := r.service.Save(ctx, id)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm save accepted", job)
+}
+
+func (r resource) reset(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	job, err := r.service.Reset(ctx, id)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm reset accepted", job)
+}
+
+func (r resource) flatten(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	job, err := r.service.Flatten(ctx, id)
+	if err != nil {
+		return err
+	}
+	return accepted(c, "vm flatten accepted", job)
 
 }
 
@@ -151,3 +275,63 @@ func (r resource) stats(c echo.Context) error {
 		Stats   interface{} `json:"stats"`
 	}{"ok", "stats retrieved successfully", stats})
 }
+
+func (r resource) metrics(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	var input MetricsRequest
+	err := echo.QueryParamsBinder(c).
+		Time("from", &input.From, time.RFC3339).
+		Time("to", &input.To, time.RFC3339).
+		Duration("step", &input.Step).
+		Strings("metric", &input.Metrics).
+		BindError()
+	if err != nil {
+		return errors.BadRequest("invalid query parameters")
+	}
+	if err := c.Validate(&input); err != nil {
+		return err
+	}
+
+	metrics, err := r.service.Metrics(ctx, id, input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status  string  `json:"status"`
+		Message string  `json:"message"`
+		Metrics Metrics `json:"metrics"`
+	}{"ok", "metrics retrieved successfully", metrics})
+}
+
+func (r resource) updateIOTune(c echo.Context) error {
+
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	var input UpdateIOTuneRequest
+	if err := c.Bind(&input); err != nil {
+		return err
+	}
+
+	tune, err := r.service.UpdateIOTune(ctx, id, c.Param("dev"), input)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, struct {
+		Status  string        `json:"status"`
+		Message string        `json:"message"`
+		IOTune  entity.IOTune `json:"iotune"`
+	}{"ok", "iotune updated successfully", tune})
+}
+
+// accepted responds with the job tracking an asynchronous operation.
+func accepted(c echo.Context, msg string, job entity.Job) error {
+	return c.JSON(http.StatusAccepted, struct {
+		Status  string     `json:"status"`
+		Message string     `json:"message"`
+		Job     entity.Job `json:"item"`
+	}{"ok", msg, job})
+}
@@ -0,0 +1,153 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+)
+
+// UpdateIOTuneRequest updates the I/O throttling of a disk, throttles left
+// out keep their value and zero removes them. Like libvirt, setting a total
+// throttle removes the read and write ones left out, and the other way
+// round. Bandwidths are in MiB per second, up to a TiB, burst lengths in
+// seconds.
+type UpdateIOTuneRequest struct {
+	TotalBytesSec *uint64 `json:"total_bytes_sec" validate:"omitempty,lte=1048576"`
+	ReadBytesSec  *uint64 `json:"read_bytes_sec" validate:"omitempty,lte=1048576"`
+	WriteBytesSec *uint64 `json:"write_bytes_sec" validate:"omitempty,lte=1048576"`
+	TotalIopsSec  *uint64 `json:"total_iops_sec"`
+	ReadIopsSec   *uint64 `json:"read_iops_sec"`
+	WriteIopsSec  *uint64 `json:"write_iops_sec"`
+
+	TotalBytesSecMax       *uint64 `json:"total_bytes_sec_max" validate:"omitempty,lte=1048576"`
+	ReadBytesSecMax        *uint64 `json:"read_bytes_sec_max" validate:"omitempty,lte=1048576"`
+	WriteBytesSecMax       *uint64 `json:"write_bytes_sec_max" validate:"omitempty,lte=1048576"`
+	TotalIopsSecMax        *uint64 `json:"total_iops_sec_max"`
+	ReadIopsSecMax         *uint64 `json:"read_iops_sec_max"`
+	WriteIopsSecMax        *uint64 `json:"write_iops_sec_max"`
+	TotalBytesSecMaxLength *uint64 `json:"total_bytes_sec_max_length" validate:"omitempty,lte=3600"`
+	ReadBytesSecMaxLength  *uint64 `json:"read_bytes_sec_max_length" validate:"omitempty,lte=3600"`
+	WriteBytesSecMaxLength *uint64 `json:"write_bytes_sec_max_length" validate:"omitempty,lte=3600"`
+	TotalIopsSecMaxLength  *uint64 `json:"total_iops_sec_max_length" validate:"omitempty,lte=3600"`
+	ReadIopsSecMaxLength   *uint64 `json:"read_iops_sec_max_length" validate:"omitempty,lte=3600"`
+	WriteIopsSecMaxLength  *uint64 `json:"write_iops_sec_max_length" validate:"omitempty,lte=3600"`
+
+	GroupName *string `json:"group_name" validate:"omitempty,max=64,printascii"`
+}
+
+// throttle groups the total, read and write throttles of a kind, e.g. the
+// bandwidth ones, as requested and as set on the disk.
+type throttle struct {
+	kind string
+	req  [3]*uint64
+	cur  [3]*uint64
+}
+
+// throttleSides names the throttles of a group.
+var throttleSides = [3]string{"total", "read", "write"}
+
+// name returns the name of the i-th throttle of the group.
+func (t throttle) name(i int) string {
+	return throttleSides[i] + "_" + t.kind
+}
+
+// throttles returns the throttles of the request along with the ones of
+// tune, bursts follow their throttle and lengths their burst.
+func (req UpdateIOTuneRequest) throttles(tune *entity.IOTune) []throttle {
+	return []throttle{
+		{"bytes_sec",
+			[3]*uint64{req.TotalBytesSec, req.ReadBytesSec, req.WriteBytesSec},
+			[3]*uint64{&tune.TotalBytesSec, &tune.ReadBytesSec, &tune.WriteBytesSec}},
+		{"iops_sec",
+			[3]*uint64{req.TotalIopsSec, req.ReadIopsSec, req.WriteIopsSec},
+			[3]*uint64{&tune.TotalIopsSec, &tune.ReadIopsSec, &tune.WriteIopsSec}},
+		{"bytes_sec_max",
+			[3]*uint64{req.TotalBytesSecMax, req.ReadBytesSecMax, req.WriteBytesSecMax},
+			[3]*uint64{&tune.TotalBytesSecMax, &tune.ReadBytesSecMax, &tune.WriteBytesSecMax}},
+		{"iops_sec_max",
+			[3]*uint64{req.TotalIopsSecMax, req.ReadIopsSecMax, req.WriteIopsSecMax},
+			[3]*uint64{&tune.TotalIopsSecMax, &tune.ReadIopsSecMax, &tune.WriteIopsSecMax}},
+		{"bytes_sec_max_length",
+			[3]*uint64{req.TotalBytesSecMaxLength, req.ReadBytesSecMaxLength, req.WriteBytesSecMaxLength},
+			[3]*uint64{&tune.TotalBytesSecMaxLength, &tune.ReadBytesSecMaxLength, &tune.WriteBytesSecMaxLength}},
+		{"iops_sec_max_length",
+			[3]*uint64{req.TotalIopsSecMaxLength, req.ReadIopsSecMaxLength, req.WriteIopsSecMaxLength},
+			[3]*uint64{&tune.TotalIopsSecMaxLength, &tune.ReadIopsSecMaxLength, &tune.WriteIopsSecMaxLength}},
+	}
+}
+
+// apply updates tune with the throttles of the request, it fails when both
+// a total throttle and a read or write one are requested.
+func (req UpdateIOTuneRequest) apply(tune *entity.IOTune) error {
+	for _, t := range req.throttles(tune) {
+		total, read, write := t.req[0], t.req[1], t.req[2]
+		setTotal := total != nil && *total > 0
+		setSide := read != nil && *read > 0 || write != nil && *write > 0
+		if setTotal && setSide {
+			return errors.BadRequest(fmt.Sprintf(
+				"%s cannot be set together with %s or %s", t.name(0), t.name(1), t.name(2)))
+		}
+		for i, v := range t.req {
+			switch {
+			case v != nil:
+				*t.cur[i] = *v
+			case setTotal && i > 0, setSide && i == 0:
+				*t.cur[i] = 0
+			}
+		}
+	}
+	if req.GroupName != nil {
+		tune.GroupName = *req.GroupName
+	}
+	return nil
+}
+
+// validateIOTune checks the bursts of tune against their throttle, and the
+// burst lengths against their burst.
+func validateIOTune(tune entity.IOTune) error {
+	throttles := UpdateIOTuneRequest{}.throttles(&tune)
+	for k, t := range throttles[2:] {
+		base := throttles[k]
+		for i := range t.cur {
+			switch {
+			case *t.cur[i] == 0:
+			case *base.cur[i] == 0:
+				return errors.BadRequest(fmt.Sprintf("%s requires %s",
+					t.name(i), base.name(i)))
+			case k < 2 && *t.cur[i] < *base.cur[i]:
+				return errors.BadRequest(fmt.Sprintf("%s cannot be lower than %s",
+					t.name(i), base.name(i)))
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateIOTune updates the I/O throttling of the disk dev of a VM. It is
+// rejected while another operation is in progress on the VM, and the
+// other way round.
+func (s service) UpdateIOTune(ctx context.Context, id, dev string,
+	req UpdateIOTuneRequest) (entity.IOTune, error) {
+
+	if err := s.machine.acquire(id, opTune, ""); err != nil {
+		return entity.IOTune{}, err
+	}
+	defer s.machine.release(id)
+
+	tune, err := s.repo.IOTune(ctx, id, dev)
+	if err != nil {
+		return entity.IOTune{}, err
+	}
+	if err := req.apply(&tune); err != nil {
+		return entity.IOTune{}, err
+	}
+	if err := validateIOTune(tune); err != nil {
+		return entity.IOTune{}, err
+	}
+	if err := s.repo.SetIOTune(ctx, id, dev, tune); err != nil {
+		return entity.IOTune{}, err
+	}
+	return tune, nil
+}
@@ -0,0 +1,104 @@
+package vm
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+)
+
+const (
+	// Limits on the labels attached to a VM.
+	maxLabels         = 64
+	maxLabelValueSize = 255
+)
+
+// labelKeyRegex matches the valid label keys, e.g. team or app.kubernetes.io/name.
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,61}[A-Za-z0-9])?$`)
+
+// ListVMsRequest filters and sorts the listed VMs. Unset filters match
+// every VM.
+type ListVMsRequest struct {
+	State     string   `validate:"omitempty,oneof=nostate running blocked paused shutdown shutoff crashed pmsuspended unknown creating starting stopping"`
+	Name      string   // Name prefix
+	Image     string   // Base image
+	Labels    []string `validate:"max=16,dive,required,max=320"` // key or key=value
+	MinCPU    uint
+	MaxCPU    uint
+	MinMemory uint   // In MiB
+	MaxMemory uint   // In MiB
+	Sort      string `validate:"omitempty,oneof=name -name state -state image -image cpu -cpu memory -memory disk -disk"`
+}
+
+// validateLabels rejects the labels which cannot be filtered on.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return errors.BadRequest("too many labels")
+	}
+	for key, value := range labels {
+		if !labelKeyRegex.MatchString(key) {
+			return errors.BadRequest("invalid label key: " + key)
+		}
+		if len(value) > maxLabelValueSize {
+			return errors.BadRequest("label value too long: " + key)
+		}
+	}
+	return nil
+}
+
+// match tells whether the vm passes the filters.
+func (req ListVMsRequest) match(vm entity.VM) bool {
+	switch {
+	case req.State != "" && string(vm.State) != req.State,
+		!strings.HasPrefix(vm.Name, req.Name),
+		req.Image != "" && vm.Image != req.Image,
+		vm.CPU < req.MinCPU,
+		req.MaxCPU > 0 && vm.CPU > req.MaxCPU,
+		vm.Memory < req.MinMemory,
+		req.MaxMemory > 0 && vm.Memory > req.MaxMemory:
+		return false
+	}
+	for _, label := range req.Labels {
+		key, value, hasValue := strings.Cut(label, "=")
+		v, ok := vm.Labels[key]
+		if !ok || (hasValue && v != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortVMs sorts the vms on the field given by the sort parameter, in
+// descending order when prefixed with a minus sign, and by name otherwise.
+// Ties are broken by ID so that pages are stable.
+func sortVMs(vms []entity.VM, sort string) {
+	field, desc := strings.CutPrefix(sort, "-")
+	compare := func(a, b entity.VM) int {
+		switch field {
+		case "state":
+			return cmp.Compare(a.State, b.State)
+		case "image":
+			return cmp.Compare(a.Image, b.Image)
+		case "cpu":
+			return cmp.Compare(a.CPU, b.CPU)
+		case "memory":
+			return cmp.Compare(a.Memory, b.Memory)
+		case "disk":
+			return cmp.Compare(a.Disk, b.Disk)
+		}
+		return cmp.Compare(a.Name, b.Name)
+	}
+	slices.SortStableFunc(vms, func(a, b entity.VM) int {
+		c := compare(a, b)
+		if desc {
+			c = -c
+		}
+		if c == 0 {
+			c = cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.ID, b.ID))
+		}
+		return c
+	})
+}
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"context"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+)
+
+const (
+	// Window of the metrics returned when no time range is given.
+	defaultMetricsWindow = time.Hour
+	// Maximum number of points per series.
+	maxMetricsPoints = 10000
+)
+
+// metricNames lists the metrics in the order series are returned.
+var metricNames = []string{
+	"cpu_usage", "mem_percent",
+	"disk_read_bytes_sec", "disk_write_bytes_sec", "disk_read_iops", "disk_write_iops",
+	"net_rx_bytes_sec", "net_tx_bytes_sec", "net_rx_packets_sec", "net_tx_packets_sec",
+}
+
+// metricValues extracts the value of the metrics out of the usage of a VM.
+var metricValues = map[string]func(s entity.VMStats) float64{
+	"cpu_usage":            func(s entity.VMStats) float64 { return s.CPUUsage },
+	"mem_percent":          func(s entity.VMStats) float64 { return s.MemoryPercent },
+	"disk_read_bytes_sec":  func(s entity.VMStats) float64 { return s.DiskReadBytesSec },
+	"disk_write_bytes_sec": func(s entity.VMStats) float64 { return s.DiskWriteBytesSec },
+	"disk_read_iops":       func(s entity.VMStats) float64 { return s.DiskReadIOPS },
+	"disk_write_iops":      func(s entity.VMStats) float64 { return s.DiskWriteIOPS },
+	"net_rx_bytes_sec":     func(s entity.VMStats) float64 { return s.NetRxBytesSec },
+	"net_tx_bytes_sec":     func(s entity.VMStats) float64 { return s.NetTxBytesSec },
+	"net_rx_packets_sec":   func(s entity.VMStats) float64 { return s.NetRxPacketsSec },
+	"net_tx_packets_sec":   func(s entity.VMStats) float64 { return s.NetTxPacketsSec },
+}
+
+// MetricsRequest selects the metrics of a VM over a time range. Points are
+// averaged over windows of Step when set, and returned as sampled otherwise.
+type MetricsRequest struct {
+	From    time.Time     // Defaults to an hour before To
+	To      time.Time     // Defaults to now
+	Step    time.Duration `validate:"gte=0"`
+	Metrics []string      `validate:"dive,oneof=cpu_usage mem_percent disk_read_bytes_sec disk_write_bytes_sec disk_read_iops disk_write_iops net_rx_bytes_sec net_tx_bytes_sec net_rx_packets_sec net_tx_packets_sec"` // Defaults to all
+}
+
+// MetricPoint is the value of a metric at a point in time.
+type MetricPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// MetricSeries holds the values of a metric over time.
+type MetricSeries struct {
+	Metric string        `json:"metric"`
+	Points []MetricPoint `json:"points"`
+}
+
+// Metrics holds the series of the metrics of a VM over a time range.
+type Metrics struct {
+	From   time.Time      `json:"from"`
+	To     time.Time      `json:"to"`
+	Step   float64        `json:"step_sec,omitempty"`
+	Series []MetricSeries `json:"series"`
+}
+
+// Metrics returns the usage history of a VM.
+func (s service) Metrics(ctx context.Context, id string, req MetricsRequest) (
+	Metrics, error) {
+
+	if req.To.IsZero() {
+		req.To = time.Now().UTC()
+	}
+	if req.From.IsZero() {
+		req.From = req.To.Add(-defaultMetricsWindow)
+	}
+	if !req.From.Before(req.To) {
+		return Metrics{}, errors.BadRequest("from must be before to")
+	}
+	if req.Step > 0 && req.To.Sub(req.From)/req.Step > maxMetricsPoints {
+		return Metrics{}, errors.BadRequest("step too small for the time range")
+	}
+	if len(req.Metrics) == 0 {
+		req.Metrics = metricNames
+	}
+
+	stats, err := s.repo.Metrics(ctx, id, req.From, req.To, req.Step)
+	if err != nil {
+		return Metrics{}, err
+	}
+	metrics := Metrics{
+		From:   req.From,
+		To:     req.To,
+		Step:   req.Step.Seconds(),
+		Series: make([]MetricSeries, 0, len(req.Metrics)),
+	}
+	for _, name := range req.Metrics {
+		metrics.Series = append(metrics.Series, MetricSeries{
+			Metric: name,
+			Points: downsample(stats, metricValues[name], req.From, req.Step),
+		})
+	}
+	return metrics, nil
+}
+
+// downsample averages the values of the points falling in the same window
+// of step, starting from. Each window is stamped with its start, windows
+// without points are left out. Points are returned as is without a step.
+func downsample(stats []entity.VMStats, value func(entity.VMStats) float64,
+	from time.Time, step time.Duration) []MetricPoint {
+
+	points := make([]MetricPoint, 0, len(stats))
+	if step <= 0 {
+		for _, s := range stats {
+			points = append(points, MetricPoint{s.Timestamp, value(s)})
+		}
+		return points
+	}
+
+	var sum float64
+	var count int
+	var window time.Time
+	for _, s := range stats {
+		start := from.Add(s.Timestamp.Sub(from) / step * step)
+		if count > 0 && !start.Equal(window) {
+			points = append(points, MetricPoint{window, sum / float64(count)})
+			sum, count = 0, 0
+		}
+		window = start
+		sum += value(s)
+		count++
+	}
+	if count > 0 {
+		points = append(points, MetricPoint{window, sum / float64(count)})
+	}
+	return points
+}
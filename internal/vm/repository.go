@@ -2,49 +2,77 @@ package vm
 
 import (
 	"context"
+	"time"
 
 	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
-	"github.com/ayoubfaouzi/kvm-manager/internal/vmmgr"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
 	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
 )
 
 // repository persists files in database.
 type repository struct {
 	logger log.Logger
-	vmMgr  vmmgr.VMManager
+	vmMgr  hypervisor.Driver
 }
 
 // Repository encapsulates the logic to access files from the data source.
 type Repository interface {
-	// Create saves a new VM in the storage.
-	Create(ctx context.Context, vm CreateVMRequest) (entity.VM, error)
+	// Create saves a new VM in the storage, reporting its progress.
+	Create(ctx context.Context, vm CreateVMRequest, progress hypervisor.Progress) (
+		entity.VM, error)
+	// CheckName fails if the name is used by an existing VM.
+	CheckName(ctx context.Context, name string) error
 	// Get retrieves VM information from the server.
 	Get(ctx context.Context, id string) (entity.VM, error)
 	// List enumerates all VMs.
-	List(ctx context.Context, offset, limit int) ([]entity.VM, error)
+	List(ctx context.Context) ([]entity.VM, error)
 	// Deletes a VM given its ID.
 	Delete(ctx context.Context, id string) error
 	// Starts a VM given its ID.
 	Start(ctx context.Context, id string) error
-	// Stop a VM given its ID.
-	Stop(ctx context.Context, id string) error
+	// Stop a VM given its ID, reporting its progress.
+	Stop(ctx context.Context, id string, opts hypervisor.StopOptions,
+		progress hypervisor.Progress) (entity.StopOutcome, error)
 	// Restart a VM given its ID.
 	Restart(ctx context.Context, id string) error
+	// Pause suspends a VM given its ID.
+	Pause(ctx context.Context, id string) error
+	// Resume resumes a paused VM given its ID.
+	Resume(ctx context.Context, id string) error
+	// Save saves the memory of a VM to disk and stops it.
+	Save(ctx context.Context, id string) error
+	// Reset resets a VM given its ID.
+	Reset(ctx context.Context, id string) error
+	// Flatten makes the VM disks independent of their base image.
+	Flatten(ctx context.Context, id string) error
+	// Resize changes the vCPUs and memory of a VM, zero leaves them
+	// unchanged.
+	Resize(ctx context.Context, id string, cpu, memory uint) (rebootRequired bool, err error)
 	// Stats returns VM statistics and metrics.
 	Stats(ctx context.Context, id string) (interface{}, error)
+	// Metrics returns the usage rates of a VM sampled between from and to,
+	// possibly averaged over windows of at most step.
+	Metrics(ctx context.Context, id string, from, to time.Time, step time.Duration) (
+		[]entity.VMStats, error)
+	// IOTune returns the I/O throttling of a disk of a VM.
+	IOTune(ctx context.Context, id, dev string) (entity.IOTune, error)
+	// SetIOTune replaces the I/O throttling of a disk of a VM.
+	SetIOTune(ctx context.Context, id, dev string, tune entity.IOTune) error
 }
 
 // NewRepository creates a new vm repository.
-func NewRepository(logger log.Logger, vmMgr vmmgr.VMManager) Repository {
+func NewRepository(logger log.Logger, vmMgr hypervisor.Driver) Repository {
 	return repository{logger, vmMgr}
 }
 
 // Create saves a new VM in QEMU/KVM server.
 // It returns the ID of the newly inserted VM record.
-func (r repository) Create(ctx context.Context, req CreateVMRequest) (entity.VM, error) {
+func (r repository) Create(ctx context.Context, req CreateVMRequest,
+	progress hypervisor.Progress) (entity.VM, error) {
 
 	newVM, _, err := r.vmMgr.CreateVM(entity.VM{
 		Name:          req.Name,
+		Image:         req.Image,
 		CPU:           req.CPU,
 		Memory:        req.Memory,
 		Disk:          req.Disk,
@@ -52,17 +80,29 @@ func (r repository) Create(ctx context.Context, req CreateVMRequest) (entity.VM,
 		WriteIopsSec:  req.WriteIopsSec,
 		ReadBytesSec:  req.ReadBytesSec,
 		WriteBytesSec: req.WriteBytesSec,
-	})
+		CloudInit: &entity.CloudInit{
+			Hostname:          req.Hostname,
+			SSHAuthorizedKeys: req.SSHAuthorizedKeys,
+			UserData:          req.UserData,
+			NetworkConfig:     req.NetworkConfig,
+		},
+		Labels: req.Labels,
+	}, progress)
 	return newVM, err
 }
 
+// CheckName fails if the name is used by an existing VM or its files.
+func (r repository) CheckName(ctx context.Context, name string) error {
+	return r.vmMgr.CheckVMName(name)
+}
+
 // Get retrieves VM information.
 func (r repository) Get(ctx context.Context, id string) (entity.VM, error) {
 	return r.vmMgr.GetVM(id)
 }
 
 // List enumerates all VMs.
-func (r repository) List(ctx context.Context, offset, limit int) ([]entity.VM, error) {
+func (r repository) List(ctx context.Context) ([]entity.VM, error) {
 	return r.vmMgr.ListVMs(true, true)
 }
 
@@ -77,8 +117,9 @@ func (r repository) Start(ctx context.Context, id string) error {
 }
 
 // Stop a VM given its ID.
-func (r repository) Stop(ctx context.Context, id string) error {
-	return r.vmMgr.StopVM(id)
+func (r repository) Stop(ctx context.Context, id string,
+	opts hypervisor.StopOptions, progress hypervisor.Progress) (entity.StopOutcome, error) {
+	return r.vmMgr.StopVM(id, opts, progress)
 }
 
 // Restart a VM given its ID.
@@ -86,7 +127,53 @@ func (r repository) Restart(ctx context.Context, id string) error {
 	return r.vmMgr.RebootVM(id)
 }
 
+// Pause suspends a VM given its ID.
+func (r repository) Pause(ctx context.Context, id string) error {
+	return r.vmMgr.PauseVM(id)
+}
+
+// Resume resumes a paused VM given its ID.
+func (r repository) Resume(ctx context.Context, id string) error {
+	return r.vmMgr.ResumeVM(id)
+}
+
+// Save saves the memory of a VM to disk and stops it.
+func (r repository) Save(ctx context.Context, id string) error {
+	return r.vmMgr.SaveVM(id)
+}
+
+// Reset resets a VM given its ID.
+func (r repository) Reset(ctx context.Context, id string) error {
+	return r.vmMgr.ResetVM(id)
+}
+
+// Flatten makes the VM disks independent of their base image.
+func (r repository) Flatten(ctx context.Context, id string) error {
+	return r.vmMgr.FlattenVM(id)
+}
+
+// Resize changes the vCPUs and memory of a VM.
+func (r repository) Resize(ctx context.Context, id string, cpu, memory uint) (bool, error) {
+	return r.vmMgr.ResizeVM(id, cpu, memory)
+}
+
 // Stats returns VM statistics and metrics.
 func (r repository) Stats(ctx context.Context, id string) (interface{}, error) {
 	return r.vmMgr.GetStats(id)
 }
+
+// Metrics returns the usage history of a VM.
+func (r repository) Metrics(ctx context.Context, id string, from, to time.Time,
+	step time.Duration) ([]entity.VMStats, error) {
+	return r.vmMgr.GetMetrics(id, from, to, step)
+}
+
+// IOTune returns the I/O throttling of a disk of a VM.
+func (r repository) IOTune(ctx context.Context, id, dev string) (entity.IOTune, error) {
+	return r.vmMgr.GetDiskIOTune(id, dev)
+}
+
+// SetIOTune replaces the I/O throttling of a disk of a VM.
+func (r repository) SetIOTune(ctx context.Context, id, dev string, tune entity.IOTune) error {
+	return r.vmMgr.SetDiskIOTune(id, dev, tune)
+}
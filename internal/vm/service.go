@@ -2,24 +2,111 @@ package vm
 
 import (
 	"context"
+	"encoding/base64"
+	goerrors "errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
 	"time"
 
 	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
 
 	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/event"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/internal/image"
+	"github.com/ayoubfaouzi/kvm-manager/internal/job"
+	"gopkg.in/yaml.v3"
 )
 
 const (
-	// #TODO: allow user to choose OS image.
-	OSFlavor = "linux-alpine"
+	// DefaultShutdownTimeout is how long guests are given to shut down
+	// when no timeout is configured.
+	DefaultShutdownTimeout = 60 * time.Second
+
+	// DefaultImage is the base image used when none is requested.
+	DefaultImage = "alpinelinux3.21"
+
+	// Length of the random suffix of the default VM names, and how many
+	// names are tried before giving up.
+	nameSuffixLen      = 5
+	defaultNameRetries = 5
+
+	// Operations performed asynchronously through jobs.
+	opCreate  = "create"
+	opDelete  = "delete"
+	opStart   = "start"
+	opStop    = "stop"
+	opRestart = "restart"
+	opPause   = "pause"
+	opResume  = "resume"
+	opSave    = "save"
+	opReset   = "reset"
+	opFlatten = "flatten"
+	opResize  = "resize"
+
+	// Operations performed synchronously, which still exclude the others.
+	opTune = "tune"
+
+	// Outcomes of a resize, a reboot is required when the change could
+	// not be applied live.
+	outcomeApplied        = "applied"
+	outcomeRebootRequired = "reboot_required"
 )
 
+// sshKeyTypes are the accepted SSH public key types.
+var sshKeyTypes = map[string]bool{
+	"ssh-rsa":                            true,
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// opEvents maps the operations to the event emitted on success.
+var opEvents = map[string]entity.EventType{
+	opCreate:  entity.EventVMCreated,
+	opDelete:  entity.EventVMDeleted,
+	opStart:   entity.EventVMStarted,
+	opStop:    entity.EventVMStopped,
+	opRestart: entity.EventVMRebooted,
+	opPause:   entity.EventVMPaused,
+	opResume:  entity.EventVMResumed,
+	opSave:    entity.EventVMSaved,
+	opReset:   entity.EventVMReset,
+}
+
+// opHypervisorEvents maps the operations to the events the hypervisor
+// reports for them, which are dropped as the API publishes its own.
+var opHypervisorEvents = map[string][]entity.EventType{
+	opCreate:  {entity.EventVMStarted},
+	opDelete:  {entity.EventVMStopped, entity.EventVMDeleted},
+	opStart:   {entity.EventVMStarted},
+	opStop:    {entity.EventVMShutdown, entity.EventVMStopped},
+	opRestart: {entity.EventVMShutdown, entity.EventVMRebooted},
+	opPause:   {entity.EventVMPaused},
+	opResume:  {entity.EventVMResumed},
+	opSave:    {entity.EventVMPaused, entity.EventVMStopped},
+	opReset:   {entity.EventVMRebooted},
+}
+
 type VM struct {
 	entity.VM
 }
 
+// OperationResult is the result of the jobs acting on an existing VM.
+type OperationResult struct {
+	VM
+	// How the operation went, e.g. whether the VM was stopped gracefully.
+	Outcome string `json:"outcome,omitempty"`
+}
+
 type CreateVMRequest struct {
-	Name          string `json:"name"`
+	Name          string `json:"name" validate:"omitempty,max=63,dns_rfc1035_label"` // Defaults to lx-{flavor}-{date}-{suffix}
+	Image         string `json:"image" example:"alpinelinux3.21"`                    // Defaults to DefaultImage
 	CPU           uint   `json:"cpu" validate:"required,gte=1,lte=1024" example:"2"`
 	Memory        uint   `json:"memory" validate:"required,gte=128,lte=1048576" example:"8192"` // In MiB
 	Disk          uint64 `json:"disk" validate:"required,gte=2,lte=2048000" example:"40"`       // In GiB
@@ -27,102 +114,449 @@ type CreateVMRequest struct {
 	WriteIopsSec  uint64 `json:"write_iops_sec" validate:"at_least_one_io_throttle" example:"1000"`
 	ReadBytesSec  uint64 `json:"read_bytes_sec" validate:"at_least_one_io_throttle" example:"10"`  // In MiB
 	WriteBytesSec uint64 `json:"write_bytes_sec" validate:"at_least_one_io_throttle" example:"20"` // In MiB
+
+	// Cloud-init data, provided to the VM through a NoCloud seed.
+	Hostname          string   `json:"hostname" validate:"omitempty,hostname_rfc1123,max=63" example:"web-1"` // Defaults to the name
+	SSHAuthorizedKeys []string `json:"ssh_authorized_keys" validate:"max=32,dive,required,max=16384"`
+	UserData          string   `json:"user_data" validate:"max=65536" example:"#cloud-config"`
+	NetworkConfig     string   `json:"network_config" validate:"max=65536"`
+
+	Labels map[string]string `json:"labels"`
+}
+
+// ResizeVMRequest changes the vCPUs and memory of a VM, fields left out
+// are unchanged.
+type ResizeVMRequest struct {
+	CPU    uint `json:"cpu" validate:"omitempty,gte=1,lte=1024" example:"4"`
+	Memory uint `json:"memory" validate:"omitempty,gte=128,lte=1048576" example:"16384"` // In MiB
+}
+
+// StopVMRequest controls how a VM is stopped. Unset fields default to the
+// configured behavior.
+type StopVMRequest struct {
+	Force    bool   `query:"force"`
+	Mode     string `query:"mode" validate:"omitempty,oneof=acpi agent"`
+	Timeout  uint   `query:"timeout" validate:"lte=3600"` // In seconds
+	Fallback *bool  `query:"fallback"`                    // Powers off the VM on timeout
 }
 
 type service struct {
-	repo   Repository
-	logger log.Logger
+	repo    Repository
+	images  image.Service
+	jobs    job.Service
+	events  event.Publisher
+	machine *stateMachine
+	stop    hypervisor.StopOptions
+	logger  log.Logger
 }
 
 // Service encapsulates use case logic for vms.
 type Service interface {
-	Create(ctx context.Context, input CreateVMRequest) (VM, error)
+	Create(ctx context.Context, input CreateVMRequest) (entity.Job, error)
 	Get(ctx context.Context, id string) (VM, error)
-	List(ctx context.Context, offset, limit int) ([]VM, error)
-	Count(ctx context.Context) (int, error)
-	Delete(ctx context.Context, id string) error
-	Start(ctx context.Context, id string) error
-	Stop(ctx context.Context, id string) error
-	Restart(ctx context.Context, id string) error
+	List(ctx context.Context, req ListVMsRequest, offset, limit int) ([]VM, int, error)
+	Delete(ctx context.Context, id string) (entity.Job, error)
+	Start(ctx context.Context, id string) (entity.Job, error)
+	Stop(ctx context.Context, id string, input StopVMRequest) (entity.Job, error)
+	Restart(ctx context.Context, id string) (entity.Job, error)
+	Pause(ctx context.Context, id string) (entity.Job, error)
+	Resume(ctx context.Context, id string) (entity.Job, error)
+	Save(ctx context.Context, id string) (entity.Job, error)
+	Reset(ctx context.Context, id string) (entity.Job, error)
+	Flatten(ctx context.Context, id string) (entity.Job, error)
+	Resize(ctx context.Context, id string, input ResizeVMRequest) (entity.Job, error)
 	Stats(ctx context.Context, id string) (interface{}, error)
+	Metrics(ctx context.Context, id string, req MetricsRequest) (Metrics, error)
+	UpdateIOTune(ctx context.Context, id, dev string, req UpdateIOTuneRequest) (entity.IOTune, error)
+	Acquire(ctx context.Context, id, operation string) (release func(), err error)
 }
 
-// NewService creates a new File service.
-func NewService(repo Repository, logger log.Logger) Service {
-	return service{repo, logger}
+// NewService creates a new File service. stop holds the default options
+// used to stop VMs.
+func NewService(repo Repository, images image.Service, jobs job.Service,
+	events event.Publisher, stop hypervisor.StopOptions, logger log.Logger) Service {
+	if stop.Mode == "" {
+		stop.Mode = hypervisor.ShutdownACPI
+	}
+	if stop.Timeout <= 0 {
+		stop.Timeout = DefaultShutdownTimeout
+	}
+	return service{repo, images, jobs, events,
+		newStateMachine(), stop, logger}
 }
 
-// Create creates a new VM.
+// Create submits a job which creates a new VM.
 func (s service) Create(ctx context.Context, req CreateVMRequest) (
-	VM, error) {
+	entity.Job, error) {
 
 	now := time.Now().UTC()
 
-	if req.Name == "" {
-		req.Name = "lx-" + OSFlavor + now.Format("-01022006")
+	if req.Image == "" {
+		req.Image = DefaultImage
 	}
-	newVM, err := s.repo.Create(ctx, req)
+	img, err := s.images.Get(ctx, req.Image)
 	if err != nil {
-		s.logger.With(ctx).Error(err)
-		return VM{}, err
+		if goerrors.Is(err, hypervisor.ErrImageNotFound) {
+			return entity.Job{}, errors.BadRequest("image " + req.Image + " not found")
+		}
+		return entity.Job{}, err
+	}
+	if req.Disk < img.MinDisk {
+		return entity.Job{}, errors.BadRequest(fmt.Sprintf(
+			"image %s requires a disk of at least %d GiB", img.Name, img.MinDisk))
+	}
+
+	if err := validateCloudInit(req); err != nil {
+		return entity.Job{}, err
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		return entity.Job{}, err
+	}
+	req.Name, err = s.reserveName(ctx, req.Name, img.Flavor, now)
+	if err != nil {
+		return entity.Job{}, err
 	}
 
-	return VM{newVM}, nil
+	return s.jobs.Submit(ctx, opCreate, "", func(ctx context.Context, t job.Tracker) (interface{}, error) {
+		defer s.machine.unreserve(req.Name)
+		defer s.events.Expect(req.Name, opHypervisorEvents[opCreate]...)()
+		t.SetResult(VM{entity.VM{
+			Name:   req.Name,
+			State:  entity.VMStateCreating,
+			Image:  req.Image,
+			CPU:    req.CPU,
+			Memory: req.Memory,
+			Disk:   req.Disk,
+		}})
+		newVM, err := s.repo.Create(ctx, req, t.Progress)
+		if err != nil {
+			// The ID is only known when the failure happened once defined.
+			s.publish(ctx, opCreate, newVM.ID, req.Name, "", "", err)
+			return nil, err
+		}
+		t.SetVMID(newVM.ID)
+		s.publish(ctx, opCreate, newVM.ID, newVM.Name, "", newVM.State, nil)
+		return VM{newVM}, nil
+	}), nil
+}
+
+// reserveName reserves the name of a VM being created, failing if another
+// VM uses it. When no name is requested, a unique one is derived from the
+// flavor of the image.
+func (s service) reserveName(ctx context.Context, name, flavor string,
+	now time.Time) (string, error) {
 
+	if name != "" {
+		if err := s.machine.reserve(name); err != nil {
+			return "", err
+		}
+		if err := s.repo.CheckName(ctx, name); err != nil {
+			s.machine.unreserve(name)
+			return "", err
+		}
+		return name, nil
+	}
+
+	for i := 0; i < defaultNameRetries; i++ {
+		name, err := s.reserveName(ctx, defaultName(flavor, now), flavor, now)
+		if !goerrors.Is(err, hypervisor.ErrVMExists) {
+			return name, err
+		}
+	}
+	return "", errors.Conflict("failed to generate a unique VM name")
 }
 
-func (s service) Count(ctx context.Context) (int, error) {
+// defaultName generates a VM name such as lx-linux-alpine-05022025-x7k2p,
+// the flavor is turned into a valid DNS label.
+func defaultName(flavor string, now time.Time) string {
+
+	var label strings.Builder
+	for _, r := range strings.ToLower(flavor) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			label.WriteRune(r)
+		} else if label.Len() > 0 && !strings.HasSuffix(label.String(), "-") {
+			label.WriteByte('-')
+		}
+	}
+	// Leave room for the prefix, the date and the suffix within 63 chars.
+	prefix := strings.TrimRight(truncate(label.String(), 45), "-")
+	if prefix != "" {
+		prefix += "-"
+	}
 
-	vms, err := s.List(ctx, 0, 0)
+	const alphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	suffix := make([]byte, nameSuffixLen)
+	for i := range suffix {
+		suffix[i] = alphabet[rand.IntN(len(alphabet))]
+	}
+	return "lx-" + prefix + now.Format("01022006") + "-" + string(suffix)
+}
+
+// truncate returns the first n bytes of s.
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// validateCloudInit rejects cloud-init data the guest would fail to parse.
+func validateCloudInit(req CreateVMRequest) error {
+
+	for _, key := range req.SSHAuthorizedKeys {
+		fields := strings.Fields(key)
+		if len(fields) < 2 || !sshKeyTypes[fields[0]] {
+			return errors.BadRequest("invalid SSH public key: " + key)
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[1]); err != nil {
+			return errors.BadRequest("invalid SSH public key: " + key)
+		}
+	}
+
+	if strings.HasPrefix(req.UserData, "#cloud-config") {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal([]byte(req.UserData), &doc); err != nil {
+			return errors.BadRequest("invalid cloud-config user data: " + err.Error())
+		}
+	}
+
+	if req.NetworkConfig != "" {
+		var doc map[string]interface{}
+		if err := yaml.Unmarshal([]byte(req.NetworkConfig), &doc); err != nil {
+			return errors.BadRequest("invalid network config: " + err.Error())
+		}
+		if _, ok := doc["network"]; !ok {
+			if _, ok := doc["version"]; !ok {
+				return errors.BadRequest("invalid network config: missing version")
+			}
+		}
+	}
+	return nil
+}
+
+// vmOp acts on an existing VM, reporting its progress, and returns the
+// outcome to report, if any.
+type vmOp func(ctx context.Context, id string, progress hypervisor.Progress) (
+	outcome string, err error)
+
+// withoutOutcome adapts the actions which have no outcome nor progress to
+// report.
+func withoutOutcome(fn func(ctx context.Context, id string) error) vmOp {
+	return func(ctx context.Context, id string, _ hypervisor.Progress) (string, error) {
+		return "", fn(ctx, id)
+	}
+}
+
+// submit runs op asynchronously on an existing VM, reporting the given
+// intermediate state, if any, while the job runs. The operation is rejected
+// if it is illegal from the current VM state or if another one is in
+// progress on the VM. The job result is the VM as seen after op completes,
+// unless the VM is gone.
+func (s service) submit(ctx context.Context, operation, id string,
+	state entity.VMStateType, op vmOp) (entity.Job, error) {
+
+	before, err := s.claim(ctx, operation, id, state)
 	if err != nil {
-		return 0, err
+		return entity.Job{}, err
+	}
+
+	return s.jobs.Submit(ctx, operation, id, func(ctx context.Context, t job.Tracker) (interface{}, error) {
+		defer s.machine.release(id)
+		if types, ok := opHypervisorEvents[operation]; ok {
+			defer s.events.Expect(id, types...)()
+		}
+		outcome, err := op(ctx, id, t.Progress)
+		if err != nil {
+			s.publish(ctx, operation, id, before.Name, before.State, "", err)
+			return nil, err
+		}
+		if operation == opDelete {
+			s.publish(ctx, operation, id, before.Name, before.State, "", nil)
+			return nil, nil
+		}
+		vm, err := s.repo.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		s.publish(ctx, operation, id, vm.Name, before.State, vm.State, nil)
+		return OperationResult{VM{vm}, outcome}, nil
+	}), nil
+}
+
+// claim acquires the VM for operation once checked to be legal from the
+// VM state, which is returned.
+func (s service) claim(ctx context.Context, operation, id string,
+	state entity.VMStateType) (entity.VM, error) {
+
+	if err := s.machine.acquire(id, operation, state); err != nil {
+		return entity.VM{}, err
+	}
+	vm, err := s.repo.Get(ctx, id)
+	if err != nil {
+		s.machine.release(id)
+		return entity.VM{}, err
+	}
+	if err := checkTransition(operation, vm.State); err != nil {
+		s.machine.release(id)
+		return entity.VM{}, err
+	}
+	return vm, nil
+}
+
+// Acquire claims the VM for an operation performed by another service, e.g.
+// on its snapshots, so that it never overlaps with the VM operations. The
+// VM is released by calling release once the operation completes.
+func (s service) Acquire(ctx context.Context, id, operation string) (
+	release func(), err error) {
+
+	if _, err := s.claim(ctx, operation, id, ""); err != nil {
+		return nil, err
+	}
+	return func() { s.machine.release(id) }, nil
+}
+
+// publish emits the lifecycle event matching the outcome of an operation.
+func (s service) publish(ctx context.Context, operation, id, name string,
+	before, after entity.VMStateType, opErr error) {
+
+	e := entity.Event{
+		Type:      opEvents[operation],
+		VMID:      id,
+		VMName:    name,
+		Actor:     entity.ActorAPI,
+		Before:    before,
+		After:     after,
+		Operation: operation,
+	}
+	if opErr != nil {
+		e.Type = entity.EventVMOperationFailed
+		e.Error = opErr.Error()
+	}
+	// Not every operation is a lifecycle transition.
+	if e.Type == "" {
+		return
 	}
-	return len(vms), nil
+	s.events.Publish(ctx, e)
 }
 
 func (s service) Get(ctx context.Context, id string) (
 	VM, error) {
 
 	vm, err := s.repo.Get(ctx, id)
-	return VM{vm}, err
+	if err != nil {
+		return VM{}, err
+	}
+	s.machine.apply(&vm)
+	return VM{vm}, nil
 }
 
-func (s service) List(ctx context.Context, offset, limit int) (
-	[]VM, error) {
+// List returns the page of the VMs matching the filters given by offset and
+// limit, along with the number of VMs matching the filters.
+func (s service) List(ctx context.Context, req ListVMsRequest, offset, limit int) (
+	[]VM, int, error) {
 
-	vms, err := s.repo.List(ctx, offset, limit)
+	vms, err := s.repo.List(ctx)
 	if err != nil {
-		return []VM{}, err
+		return []VM{}, 0, err
 	}
 
-	if limit > 0 {
-		vms = vms[offset:limit]
+	matched := vms[:0]
+	for _, vm := range vms {
+		s.machine.apply(&vm)
+		if req.match(vm) {
+			matched = append(matched, vm)
+		}
 	}
+	sortVMs(matched, req.Sort)
 
+	offset = min(max(offset, 0), len(matched))
+	end := len(matched)
+	if limit > 0 {
+		end = min(offset+limit, end)
+	}
 	listVMs := []VM{}
-	for _, vm := range vms {
+	for _, vm := range matched[offset:end] {
 		listVMs = append(listVMs, VM{vm})
 	}
-	return listVMs, err
+	return listVMs, len(matched), nil
+}
+
+func (s service) Start(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opStart, id, entity.VMStateStarting, withoutOutcome(s.repo.Start))
+}
+
+// Stop submits a job which shuts the VM down, the job result tells whether
+// the guest shut down gracefully or was powered off.
+func (s service) Stop(ctx context.Context, id string, req StopVMRequest) (entity.Job, error) {
+
+	opts := s.stop
+	opts.Force = req.Force
+	if req.Mode != "" {
+		opts.Mode = hypervisor.ShutdownMode(req.Mode)
+	}
+	if req.Timeout > 0 {
+		opts.Timeout = time.Duration(req.Timeout) * time.Second
+	}
+	if req.Fallback != nil {
+		opts.Fallback = *req.Fallback
+	}
+
+	return s.submit(ctx, opStop, id, entity.VMStateStopping,
+		func(ctx context.Context, id string, progress hypervisor.Progress) (string, error) {
+			outcome, err := s.repo.Stop(ctx, id, opts, progress)
+			return string(outcome), err
+		})
+}
+
+func (s service) Restart(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opRestart, id, entity.VMStateStarting, withoutOutcome(s.repo.Restart))
+}
+
+func (s service) Pause(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opPause, id, "", withoutOutcome(s.repo.Pause))
 }
 
-func (s service) Start(ctx context.Context, id string) error {
-	return s.repo.Start(ctx, id)
+func (s service) Resume(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opResume, id, entity.VMStateStarting, withoutOutcome(s.repo.Resume))
 }
 
-func (s service) Stop(ctx context.Context, id string) error {
+// Save submits a job which saves the memory of the VM to disk and stops it,
+// the VM resumes where it left off on its next start.
+func (s service) Save(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opSave, id, entity.VMStateStopping, withoutOutcome(s.repo.Save))
+}
 
-	return s.repo.Stop(ctx, id)
+func (s service) Reset(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opReset, id, "", withoutOutcome(s.repo.Reset))
 }
 
-func (s service) Restart(ctx context.Context, id string) error {
+func (s service) Flatten(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opFlatten, id, "", withoutOutcome(s.repo.Flatten))
+}
 
-	return s.repo.Restart(ctx, id)
+// Resize submits a job which changes the vCPUs and memory of a VM. Its
+// outcome tells whether a reboot is required for the change to take effect.
+func (s service) Resize(ctx context.Context, id string, input ResizeVMRequest) (
+	entity.Job, error) {
 
+	if input.CPU == 0 && input.Memory == 0 {
+		return entity.Job{}, errors.BadRequest("cpu or memory is required")
+	}
+	return s.submit(ctx, opResize, id, "", func(ctx context.Context, id string,
+		_ hypervisor.Progress) (string, error) {
+		rebootRequired, err := s.repo.Resize(ctx, id, input.CPU, input.Memory)
+		if err != nil {
+			return "", err
+		}
+		if rebootRequired {
+			return outcomeRebootRequired, nil
+		}
+		return outcomeApplied, nil
+	})
 }
 
-func (s service) Delete(ctx context.Context, id string) error {
-	return s.repo.Delete(ctx, id)
+func (s service) Delete(ctx context.Context, id string) (entity.Job, error) {
+	return s.submit(ctx, opDelete, id, entity.VMStateStopping, withoutOutcome(s.repo.Delete))
 }
 
 func (s service) Stats(ctx context.Context, id string) (interface{}, error) {
@@ -0,0 +1,126 @@
+package vm
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/errors"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+)
+
+const (
+	// Error codes reported when an operation is rejected.
+	codeInvalidTransition   = "invalid_state_transition"
+	codeOperationInProgress = "operation_in_progress"
+)
+
+// Operations performed on the snapshots of a VM by the snapshot service,
+// which acquires the VM for them.
+const (
+	OpSnapshotCreate = "snapshot_create"
+	OpSnapshotRevert = "snapshot_revert"
+	OpSnapshotDelete = "snapshot_delete"
+)
+
+// transitions lists the states from which the operations can be performed.
+// Operations missing from the table, such as delete, are legal from any
+// state.
+var transitions = map[string][]entity.VMStateType{
+	opStart: {entity.VMStateShutOff, entity.VMStateCrashed},
+	opStop: {entity.VMStateRunning, entity.VMStateBlocked, entity.VMStatePaused,
+		entity.VMStateShutdown, entity.VMStatePMSuspended},
+	opRestart: {entity.VMStateRunning, entity.VMStateBlocked},
+	opPause:   {entity.VMStateRunning, entity.VMStateBlocked},
+	opResume:  {entity.VMStatePaused, entity.VMStatePMSuspended},
+	opSave:    {entity.VMStateRunning, entity.VMStateBlocked, entity.VMStatePaused},
+	opReset:   {entity.VMStateRunning, entity.VMStateBlocked, entity.VMStatePaused},
+	OpSnapshotCreate: {entity.VMStateRunning, entity.VMStateBlocked, entity.VMStatePaused,
+		entity.VMStateShutOff},
+	OpSnapshotRevert: {entity.VMStateRunning, entity.VMStateBlocked, entity.VMStatePaused,
+		entity.VMStateShutOff, entity.VMStateCrashed},
+	OpSnapshotDelete: {entity.VMStateRunning, entity.VMStateBlocked, entity.VMStatePaused,
+		entity.VMStateShutOff, entity.VMStateCrashed},
+}
+
+// checkTransition rejects operations which are illegal from the VM state.
+func checkTransition(operation string, state entity.VMStateType) error {
+	allowed, ok := transitions[operation]
+	if !ok || slices.Contains(allowed, state) {
+		return nil
+	}
+	return errors.Conflict(fmt.Sprintf("cannot %s a VM in state %s",
+		operation, state)).WithCode(codeInvalidTransition)
+}
+
+// inflight describes the operation in progress on a VM.
+type inflight struct {
+	operation string
+	// Intermediate state reported until the operation completes, if any.
+	state entity.VMStateType
+}
+
+// stateMachine serializes the operations performed on VMs: a single
+// operation runs at a time on a given VM, the others are rejected until it
+// completes. Likewise, a single VM is created at a time with a given name.
+type stateMachine struct {
+	mu    sync.RWMutex
+	ops   map[string]inflight
+	names map[string]bool // Names of the VMs being created
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{
+		ops:   make(map[string]inflight),
+		names: make(map[string]bool),
+	}
+}
+
+// reserve claims the name for a VM being created.
+func (m *stateMachine) reserve(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.names[name] {
+		return fmt.Errorf("%w: a VM named %s is being created",
+			hypervisor.ErrVMExists, name)
+	}
+	m.names[name] = true
+	return nil
+}
+
+// unreserve releases the name once the VM is created, or failed to be.
+func (m *stateMachine) unreserve(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.names, name)
+}
+
+// acquire claims the VM for operation, it fails if another operation is
+// already in progress on it.
+func (m *stateMachine) acquire(id, operation string, state entity.VMStateType) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if op, ok := m.ops[id]; ok {
+		return errors.Conflict(fmt.Sprintf("cannot %s the VM: %s in progress",
+			operation, op.operation)).WithCode(codeOperationInProgress)
+	}
+	m.ops[id] = inflight{operation, state}
+	return nil
+}
+
+// release ends the operation in progress on the VM.
+func (m *stateMachine) release(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.ops, id)
+}
+
+// apply overrides the state of the vm if an operation is in progress.
+func (m *stateMachine) apply(vm *entity.VM) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if op, ok := m.ops[vm.ID]; ok && op.state != "" {
+		vm.State = op.state
+	}
+}
@@ -0,0 +1,229 @@
+package vmmgr
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+)
+
+const (
+	// Suffix of the metadata files describing the base images. A base
+	// image `<name>` is described by `<name>.image.json` in the image dir.
+	imageMetadataSuffix = ".image.json"
+)
+
+// convertibleFormats are the image formats converted to qcow2 on import.
+var convertibleFormats = map[string]bool{"raw": true, "vmdk": true, "vdi": true}
+
+// ListImages enumerates the base images of the image directory.
+func (vmm VMManager) ListImages() ([]entity.Image, error) {
+
+	paths, err := filepath.Glob(filepath.Join(vmm.imgDir, "*"+imageMetadataSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]entity.Image, 0, len(paths))
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), imageMetadataSuffix)
+		img, err := vmm.GetImage(name)
+		if err != nil {
+			vmm.logger.Errorf("skipping image %s: %v", name, err)
+			continue
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images, nil
+}
+
+// GetImage retrieves a base image given its name.
+func (vmm VMManager) GetImage(name string) (entity.Image, error) {
+
+	data, err := os.ReadFile(vmm.imageMetadataPath(name))
+	if os.IsNotExist(err) {
+		return entity.Image{}, hypervisor.ErrImageNotFound
+	}
+	if err != nil {
+		return entity.Image{}, err
+	}
+	var img entity.Image
+	if err := json.Unmarshal(data, &img); err != nil {
+		return entity.Image{}, fmt.Errorf("invalid metadata for image %s: %w", name, err)
+	}
+
+	info, err := vmm.images.Info(vmm.imagePath(img))
+	if err != nil {
+		return entity.Image{}, fmt.Errorf("failed to inspect image %s: %w", name, err)
+	}
+	img.Format = info.Format
+	img.VirtualSize = info.VirtualSize
+	return img, nil
+}
+
+// CreateImage registers an image file of the image directory as a base image.
+func (vmm VMManager) CreateImage(img entity.Image) (entity.Image, error) {
+
+	if _, err := os.Stat(vmm.imageMetadataPath(img.Name)); err == nil {
+		return entity.Image{}, hypervisor.ErrImageExists
+	}
+	if filepath.Base(img.File) != img.File {
+		return entity.Image{}, fmt.Errorf("image file %s must be in the image directory", img.File)
+	}
+	if _, err := os.Stat(vmm.imagePath(img)); err != nil {
+		return entity.Image{}, fmt.Errorf("image file %s: %w", img.File, err)
+	}
+
+	// Detected fields are never persisted.
+	img.Format, img.VirtualSize = "", 0
+	data, err := json.MarshalIndent(img, "", "  ")
+	if err != nil {
+		return entity.Image{}, err
+	}
+	// Concurrent registrations of the same name are told apart on creation.
+	if err := writeNewFile(vmm.imageMetadataPath(img.Name), data, 0o644); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return entity.Image{}, hypervisor.ErrImageExists
+		}
+		return entity.Image{}, err
+	}
+	return vmm.GetImage(img.Name)
+}
+
+// writeNewFile writes data to the file at path, failing if it exists. A
+// partially written file is removed.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// ImportImage writes the image file to the image directory, converting it to
+// qcow2 if requested, and registers it as a base image. Partial files are
+// removed when the import fails.
+func (vmm VMManager) ImportImage(img entity.Image, src hypervisor.ImageSource) (
+	entity.Image, error) {
+
+	if _, err := os.Stat(vmm.imageMetadataPath(img.Name)); err == nil {
+		return entity.Image{}, hypervisor.ErrImageExists
+	}
+	if filepath.Base(img.File) != img.File {
+		return entity.Image{}, fmt.Errorf("image file %s must be in the image directory", img.File)
+	}
+	if _, err := os.Stat(vmm.imagePath(img)); err == nil {
+		return entity.Image{}, fmt.Errorf("%w: file %s", hypervisor.ErrImageExists, img.File)
+	}
+
+	// Hidden temporary files are never mistaken for images.
+	tmp, err := os.CreateTemp(vmm.imgDir, "."+img.Name+".import-*")
+	if err != nil {
+		return entity.Image{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), src.Reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return entity.Image{}, fmt.Errorf("failed to write image %s: %w", img.Name, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if src.SHA256 != "" && !strings.EqualFold(sum, src.SHA256) {
+		return entity.Image{}, fmt.Errorf("%w: expected %s, got %s",
+			hypervisor.ErrImageChecksum, src.SHA256, sum)
+	}
+
+	info, err := vmm.images.Info(tmp.Name())
+	if err != nil {
+		return entity.Image{}, fmt.Errorf("failed to inspect image %s: %w", img.Name, err)
+	}
+	if info.BackingFile != "" {
+		return entity.Image{}, fmt.Errorf("%w: %s has a backing file",
+			hypervisor.ErrImageFormat, img.Name)
+	}
+	path := tmp.Name()
+	switch {
+	case info.Format == "qcow2":
+	case src.Convert && convertibleFormats[info.Format]:
+		path = tmp.Name() + ".qcow2"
+		defer os.Remove(path)
+		vmm.logger.Info("Converting image", img.Name, "from", info.Format, "to qcow2")
+		if err := vmm.images.Convert(tmp.Name(), path); err != nil {
+			return entity.Image{}, fmt.Errorf("failed to convert image %s: %w", img.Name, err)
+		}
+	case convertibleFormats[info.Format]:
+		return entity.Image{}, fmt.Errorf("%w: %s is a %s image, request its conversion",
+			hypervisor.ErrImageFormat, img.Name, info.Format)
+	default:
+		return entity.Image{}, fmt.Errorf("%w: %s", hypervisor.ErrImageFormat, info.Format)
+	}
+
+	// Unlike a rename, linking never replaces the file of a concurrent
+	// import of the same image.
+	if err := os.Link(path, vmm.imagePath(img)); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return entity.Image{}, fmt.Errorf("%w: file %s", hypervisor.ErrImageExists, img.File)
+		}
+		return entity.Image{}, err
+	}
+	created, err := vmm.CreateImage(img)
+	if err != nil {
+		os.Remove(vmm.imagePath(img))
+		return entity.Image{}, err
+	}
+	return created, nil
+}
+
+// DeleteImage removes a base image unless VM disks are built on top of it.
+func (vmm VMManager) DeleteImage(name string) error {
+
+	img, err := vmm.GetImage(name)
+	if err != nil {
+		return err
+	}
+	overlays, err := vmm.Overlays(vmm.imagePath(img))
+	if err != nil {
+		return fmt.Errorf("failed to look for overlays of %s: %w", name, err)
+	}
+	if len(overlays) > 0 {
+		return fmt.Errorf("%w: %s backs %d overlay(s)",
+			hypervisor.ErrImageInUse, name, len(overlays))
+	}
+
+	if err := os.Remove(vmm.imagePath(img)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(vmm.imageMetadataPath(name))
+}
+
+// imagePath returns the location of the image file.
+func (vmm VMManager) imagePath(img entity.Image) string {
+	return filepath.Join(vmm.imgDir, img.File)
+}
+
+// imageMetadataPath returns the location of the image metadata file.
+func (vmm VMManager) imageMetadataPath(name string) string {
+	return filepath.Join(vmm.imgDir, name+imageMetadataSuffix)
+}
@@ -0,0 +1,66 @@
+package vmmgr
+
+import (
+	"path/filepath"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Volume label cloud-init looks for to find a NoCloud seed.
+	seedVolumeID = "cidata"
+	// Suffix of the seed ISO of a VM, next to its disk.
+	seedSuffix = "-cidata.iso"
+	// Target device of the seed CD-ROM.
+	seedDev = "sdb"
+)
+
+// seedMetadata is the NoCloud meta-data file.
+type seedMetadata struct {
+	InstanceID    string   `yaml:"instance-id"`
+	LocalHostname string   `yaml:"local-hostname"`
+	PublicKeys    []string `yaml:"public-keys,omitempty"`
+}
+
+// seedPath returns the location of the seed ISO of a VM.
+func (vmm VMManager) seedPath(name string) string {
+	return filepath.Join(vmm.imgDir, name+seedSuffix)
+}
+
+// seedFiles renders the files of the NoCloud seed of the VM. The instance ID
+// changes with every VM so that cloud-init runs on their first boot.
+func seedFiles(instanceID string, vm entity.VM) (map[string][]byte, error) {
+
+	ci := entity.CloudInit{}
+	if vm.CloudInit != nil {
+		ci = *vm.CloudInit
+	}
+	if ci.Hostname == "" {
+		ci.Hostname = vm.Name
+	}
+
+	metadata, err := yaml.Marshal(seedMetadata{
+		InstanceID:    instanceID,
+		LocalHostname: ci.Hostname,
+		PublicKeys:    ci.SSHAuthorizedKeys,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The user-data file is mandatory, even when empty.
+	userData := ci.UserData
+	if userData == "" {
+		userData = "#cloud-config\n"
+	}
+
+	files := map[string][]byte{
+		"meta-data": metadata,
+		"user-data": []byte(userData),
+	}
+	if ci.NetworkConfig != "" {
+		files["network-config"] = []byte(ci.NetworkConfig)
+	}
+	return files, nil
+}
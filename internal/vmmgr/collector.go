@@ -0,0 +1,127 @@
+package vmmgr
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"libvirt.org/go/libvirt"
+)
+
+// Statistics groups exported to Prometheus.
+const collectorStatsTypes = libvirt.DOMAIN_STATS_STATE | samplerStatsTypes
+
+var (
+	vmLabels    = []string{"id", "name"}
+	vmStateDesc = prometheus.NewDesc("kvmm_vm_state",
+		"State of the VM, the value is always 1.",
+		append(vmLabels, "state"), nil)
+	vmVcpusDesc = prometheus.NewDesc("kvmm_vm_vcpus",
+		"Number of vCPUs of the VM.", vmLabels, nil)
+	vmCPUSecondsDesc = prometheus.NewDesc("kvmm_vm_cpu_seconds_total",
+		"CPU time consumed by the VM.", vmLabels, nil)
+	vmMemoryAvailableDesc = prometheus.NewDesc("kvmm_vm_memory_available_bytes",
+		"Memory available to the guest, as reported by its balloon driver.",
+		vmLabels, nil)
+	vmMemoryUsedDesc = prometheus.NewDesc("kvmm_vm_memory_used_bytes",
+		"Memory used by the guest, as reported by its balloon driver.",
+		vmLabels, nil)
+	vmMemoryRSSDesc = prometheus.NewDesc("kvmm_vm_memory_rss_bytes",
+		"Resident memory of the VM process on the host.", vmLabels, nil)
+	vmBlockReadBytesDesc = prometheus.NewDesc("kvmm_vm_block_read_bytes_total",
+		"Bytes read from the disk.", append(vmLabels, "device"), nil)
+	vmBlockWriteBytesDesc = prometheus.NewDesc("kvmm_vm_block_write_bytes_total",
+		"Bytes written to the disk.", append(vmLabels, "device"), nil)
+	vmBlockReadOpsDesc = prometheus.NewDesc("kvmm_vm_block_read_ops_total",
+		"Read requests issued to the disk.", append(vmLabels, "device"), nil)
+	vmBlockWriteOpsDesc = prometheus.NewDesc("kvmm_vm_block_write_ops_total",
+		"Write requests issued to the disk.", append(vmLabels, "device"), nil)
+	vmNetRxBytesDesc = prometheus.NewDesc("kvmm_vm_network_receive_bytes_total",
+		"Bytes received by the interface.", append(vmLabels, "interface"), nil)
+	vmNetTxBytesDesc = prometheus.NewDesc("kvmm_vm_network_transmit_bytes_total",
+		"Bytes sent by the interface.", append(vmLabels, "interface"), nil)
+	vmNetRxPacketsDesc = prometheus.NewDesc("kvmm_vm_network_receive_packets_total",
+		"Packets received by the interface.", append(vmLabels, "interface"), nil)
+	vmNetTxPacketsDesc = prometheus.NewDesc("kvmm_vm_network_transmit_packets_total",
+		"Packets sent by the interface.", append(vmLabels, "interface"), nil)
+)
+
+// Describe sends the descriptors of the VM metrics, the VM manager is a
+// Prometheus collector.
+func (vmm VMManager) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		vmStateDesc, vmVcpusDesc, vmCPUSecondsDesc,
+		vmMemoryAvailableDesc, vmMemoryUsedDesc, vmMemoryRSSDesc,
+		vmBlockReadBytesDesc, vmBlockWriteBytesDesc,
+		vmBlockReadOpsDesc, vmBlockWriteOpsDesc,
+		vmNetRxBytesDesc, vmNetTxBytesDesc,
+		vmNetRxPacketsDesc, vmNetTxPacketsDesc,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect sends the metrics of all the VMs, read with a single bulk stats
+// call when scraped.
+func (vmm VMManager) Collect(ch chan<- prometheus.Metric) {
+	stats, err := vmm.conn.GetAllDomainStats(nil, collectorStatsTypes, 0)
+	if err != nil {
+		vmm.logger.Errorf("failed to collect domain stats: %v", classify(err))
+		return
+	}
+	for _, st := range stats {
+		vmm.collectDomain(ch, st)
+		st.Domain.Free()
+	}
+}
+
+// collectDomain sends the metrics of a domain.
+func (vmm VMManager) collectDomain(ch chan<- prometheus.Metric, st libvirt.DomainStats) {
+	id, err := st.Domain.GetUUIDString()
+	if err != nil {
+		vmm.logger.Errorf("failed to get domain id: %v", err)
+		return
+	}
+	name, err := st.Domain.GetName()
+	if err != nil {
+		vmm.logger.Errorf("failed to get domain name: %v", err)
+		return
+	}
+
+	gauge := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value,
+			append([]string{id, name}, labels...)...)
+	}
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue,
+			float64(value), append([]string{id, name}, labels...)...)
+	}
+
+	if st.State != nil && st.State.StateSet {
+		gauge(vmStateDesc, 1, string(ParseState(st.State.State)))
+	}
+	smp := newSample(time.Now(), st)
+	gauge(vmVcpusDesc, float64(smp.vcpus))
+	if st.Cpu != nil && st.Cpu.TimeSet {
+		ch <- prometheus.MustNewConstMetric(vmCPUSecondsDesc, prometheus.CounterValue,
+			float64(smp.cpuTime)/1e9, id, name)
+	}
+	if smp.guestMem && smp.memUsable <= smp.memAvailable {
+		gauge(vmMemoryAvailableDesc, float64(smp.memAvailable*1024))
+		gauge(vmMemoryUsedDesc, float64((smp.memAvailable-smp.memUsable)*1024))
+	}
+	if smp.memRSS > 0 {
+		gauge(vmMemoryRSSDesc, float64(smp.memRSS*1024))
+	}
+	for _, b := range smp.blocks {
+		counter(vmBlockReadBytesDesc, b.rdBytes, b.name)
+		counter(vmBlockWriteBytesDesc, b.wrBytes, b.name)
+		counter(vmBlockReadOpsDesc, b.rdReqs, b.name)
+		counter(vmBlockWriteOpsDesc, b.wrReqs, b.name)
+	}
+	for _, n := range smp.nets {
+		counter(vmNetRxBytesDesc, n.rxBytes, n.name)
+		counter(vmNetTxBytesDesc, n.txBytes, n.name)
+		counter(vmNetRxPacketsDesc, n.rxPkts, n.name)
+		counter(vmNetTxPacketsDesc, n.txPkts, n.name)
+	}
+}
@@ -0,0 +1,45 @@
+package vmmgr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"libvirt.org/go/libvirt"
+)
+
+// classify translates libvirt errors into the errors of the hypervisor
+// package, so that callers can tell failures apart without knowing about
+// libvirt. The libvirt message is kept as detail. Other errors are returned
+// as is.
+func classify(err error) error {
+	var lerr libvirt.Error
+	if !errors.As(err, &lerr) {
+		return err
+	}
+
+	var kind error
+	switch lerr.Code {
+	case libvirt.ERR_NO_DOMAIN:
+		kind = hypervisor.ErrVMNotFound
+	case libvirt.ERR_OPERATION_INVALID:
+		kind = hypervisor.ErrOperationInvalid
+	case libvirt.ERR_OPERATION_TIMEOUT, libvirt.ERR_AGENT_UNRESPONSIVE:
+		kind = hypervisor.ErrTimeout
+	case libvirt.ERR_NO_SUPPORT, libvirt.ERR_OPERATION_UNSUPPORTED,
+		libvirt.ERR_ARGUMENT_UNSUPPORTED:
+		kind = hypervisor.ErrUnsupported
+	case libvirt.ERR_NO_CONNECT, libvirt.ERR_INVALID_CONN, libvirt.ERR_RPC,
+		libvirt.ERR_AUTH_UNAVAILABLE:
+		kind = hypervisor.ErrUnavailable
+	default:
+		return err
+	}
+	return fmt.Errorf("%w: %s", kind, lerr.Message)
+}
+
+// classifyError classifies the error *err points to, it is meant to be
+// deferred by the methods returning libvirt errors.
+func classifyError(err *error) {
+	*err = classify(*err)
+}
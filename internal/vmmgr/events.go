@@ -0,0 +1,249 @@
+package vmmgr
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"libvirt.org/go/libvirt"
+)
+
+const (
+	// Size of the buffer holding domain events not yet consumed.
+	eventsBufferSize = 256
+
+	// Bounds of the delay before running the event loop again after it
+	// failed, e.g. when the connection dropped.
+	eventLoopMinBackoff = 100 * time.Millisecond
+	eventLoopMaxBackoff = 30 * time.Second
+)
+
+var eventLoopOnce sync.Once
+
+// startEventLoop registers libvirt's default event loop implementation and
+// runs it in the background. It must be called before opening connections
+// which register domain event callbacks.
+func startEventLoop(logger log.Logger) {
+	eventLoopOnce.Do(func() {
+		if err := libvirt.EventRegisterDefaultImpl(); err != nil {
+			logger.Errorf("failed to register libvirt event loop: %v", err)
+			return
+		}
+		go runEventLoop(logger)
+	})
+}
+
+// runEventLoop runs the iterations of libvirt's event loop forever. Failing
+// iterations are retried with an exponential backoff, so that a dropped
+// connection neither spins a core nor floods the log.
+func runEventLoop(logger log.Logger) {
+	backoff := time.Duration(0)
+	for {
+		if err := libvirt.EventRunDefaultImpl(); err != nil {
+			backoff = min(max(2*backoff, eventLoopMinBackoff), eventLoopMaxBackoff)
+			logger.Errorf("libvirt event loop iteration failed, retrying in %v: %v",
+				backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+	}
+}
+
+// Events returns the channel on which domain events are delivered.
+func (vmm VMManager) Events() <-chan entity.Event {
+	return vmm.events
+}
+
+// registerEvents subscribes to the domain events of all domains, it returns
+// the IDs of the callbacks to deregister them. None is left registered on
+// failure.
+func (vmm VMManager) registerEvents() (_ []int, err error) {
+	var ids []int
+	defer func() {
+		if err != nil {
+			vmm.deregisterEvents(ids)
+		}
+	}()
+	register := func(id int, err error) error {
+		if err == nil {
+			ids = append(ids, id)
+		}
+		return err
+	}
+
+	err = register(vmm.conn.DomainEventLifecycleRegister(nil,
+		func(c *libvirt.Connect, d *libvirt.Domain, e *libvirt.DomainEventLifecycle) {
+			if e.Event == libvirt.DOMAIN_EVENT_DEFINED ||
+				e.Event == libvirt.DOMAIN_EVENT_UNDEFINED {
+				vmm.forget(d)
+			}
+			typ, state, detail, ok := ParseLifecycleEvent(e)
+			if ok {
+				vmm.emit(d, typ, state, detail)
+			}
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register lifecycle events: %w", err)
+	}
+
+	err = register(vmm.conn.DomainEventRebootRegister(nil,
+		func(c *libvirt.Connect, d *libvirt.Domain) {
+			vmm.emit(d, entity.EventVMRebooted, entity.VMStateRunning, "")
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register reboot events: %w", err)
+	}
+
+	err = register(vmm.conn.DomainEventWatchdogRegister(nil,
+		func(c *libvirt.Connect, d *libvirt.Domain, e *libvirt.DomainEventWatchdog) {
+			vmm.emit(d, entity.EventVMWatchdog, "", parseWatchdogAction(e.Action))
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register watchdog events: %w", err)
+	}
+
+	err = register(vmm.conn.DomainEventIOErrorRegister(nil,
+		func(c *libvirt.Connect, d *libvirt.Domain, e *libvirt.DomainEventIOError) {
+			detail := fmt.Sprintf("%s (%s): %s", e.SrcPath, e.DevAlias,
+				parseIOErrorAction(e.Action))
+			vmm.emit(d, entity.EventVMIOError, "", detail)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register I/O error events: %w", err)
+	}
+
+	// Cached descriptions go stale when the I/O limits or the metadata of
+	// the domain change.
+	err = register(vmm.conn.DomainEventTunableRegister(nil,
+		func(c *libvirt.Connect, d *libvirt.Domain, e *libvirt.DomainEventTunable) {
+			vmm.forget(d)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register tunable events: %w", err)
+	}
+
+	err = register(vmm.conn.DomainEventMetadataChangeRegister(nil,
+		func(c *libvirt.Connect, d *libvirt.Domain, e *libvirt.DomainEventMetadataChange) {
+			vmm.forget(d)
+		}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metadata change events: %w", err)
+	}
+
+	return ids, nil
+}
+
+// deregisterEvents deregisters the domain event callbacks.
+func (vmm VMManager) deregisterEvents(ids []int) {
+	for _, id := range ids {
+		if err := vmm.conn.DomainEventDeregister(id); err != nil {
+			vmm.logger.Errorf("failed to deregister domain event callback %d: %v",
+				id, err)
+		}
+	}
+}
+
+// emit delivers a domain event without ever blocking the event loop. Events
+// are dropped when no one keeps up with them.
+func (vmm VMManager) emit(d *libvirt.Domain, typ entity.EventType,
+	state entity.VMStateType, detail string) {
+
+	id, err := d.GetUUIDString()
+	if err != nil {
+		vmm.logger.Errorf("failed to get domain id of %s event: %v", typ, err)
+		return
+	}
+	name, _ := d.GetName()
+
+	e := entity.Event{
+		Type:   typ,
+		VMID:   id,
+		VMName: name,
+		Actor:  entity.ActorHypervisor,
+		After:  state,
+		Detail: detail,
+	}
+	select {
+	case vmm.events <- e:
+	default:
+		vmm.logger.Errorf("dropping %s event of %s: buffer full", typ, id)
+	}
+}
+
+// ParseLifecycleEvent translates a libvirt lifecycle event into an event
+// type and the VM state it leads to. ok is false for events which are not
+// reported.
+func ParseLifecycleEvent(e *libvirt.DomainEventLifecycle) (
+	typ entity.EventType, state entity.VMStateType, detail string, ok bool) {
+
+	switch e.Event {
+	case libvirt.DOMAIN_EVENT_UNDEFINED:
+		return entity.EventVMDeleted, "", "", true
+	case libvirt.DOMAIN_EVENT_STARTED:
+		return entity.EventVMStarted, entity.VMStateRunning, "", true
+	case libvirt.DOMAIN_EVENT_SUSPENDED:
+		return entity.EventVMPaused, entity.VMStatePaused, "", true
+	case libvirt.DOMAIN_EVENT_RESUMED:
+		return entity.EventVMResumed, entity.VMStateRunning, "", true
+	case libvirt.DOMAIN_EVENT_SHUTDOWN:
+		return entity.EventVMShutdown, entity.VMStateShutdown, "", true
+	case libvirt.DOMAIN_EVENT_PMSUSPENDED:
+		return entity.EventVMPMSuspended, entity.VMStatePMSuspended, "", true
+	case libvirt.DOMAIN_EVENT_CRASHED:
+		return entity.EventVMCrashed, entity.VMStateCrashed, "", true
+	case libvirt.DOMAIN_EVENT_STOPPED:
+		switch libvirt.DomainEventStoppedDetailType(e.Detail) {
+		case libvirt.DOMAIN_EVENT_STOPPED_CRASHED:
+			return entity.EventVMCrashed, entity.VMStateCrashed, "crashed", true
+		case libvirt.DOMAIN_EVENT_STOPPED_FAILED:
+			return entity.EventVMCrashed, entity.VMStateShutOff, "failed", true
+		case libvirt.DOMAIN_EVENT_STOPPED_SHUTDOWN:
+			return entity.EventVMStopped, entity.VMStateShutOff, "shutdown", true
+		case libvirt.DOMAIN_EVENT_STOPPED_DESTROYED:
+			return entity.EventVMStopped, entity.VMStateShutOff, "destroyed", true
+		case libvirt.DOMAIN_EVENT_STOPPED_SAVED:
+			return entity.EventVMStopped, entity.VMStateShutOff, "saved", true
+		case libvirt.DOMAIN_EVENT_STOPPED_MIGRATED:
+			return entity.EventVMStopped, entity.VMStateShutOff, "migrated", true
+		}
+		return entity.EventVMStopped, entity.VMStateShutOff, "", true
+	}
+	return "", "", "", false
+}
+
+// parseWatchdogAction returns the action taken when a watchdog fired.
+func parseWatchdogAction(action libvirt.DomainEventWatchdogAction) string {
+	switch action {
+	case libvirt.DOMAIN_EVENT_WATCHDOG_NONE:
+		return "none"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_PAUSE:
+		return "pause"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_RESET:
+		return "reset"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_POWEROFF:
+		return "poweroff"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_SHUTDOWN:
+		return "shutdown"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_DEBUG:
+		return "debug"
+	case libvirt.DOMAIN_EVENT_WATCHDOG_INJECTNMI:
+		return "inject-nmi"
+	}
+	return "unknown"
+}
+
+// parseIOErrorAction returns the action taken on a disk I/O error.
+func parseIOErrorAction(action libvirt.DomainEventIOErrorAction) string {
+	switch action {
+	case libvirt.DOMAIN_EVENT_IO_ERROR_NONE:
+		return "none"
+	case libvirt.DOMAIN_EVENT_IO_ERROR_PAUSE:
+		return "pause"
+	case libvirt.DOMAIN_EVENT_IO_ERROR_REPORT:
+		return "report"
+	}
+	return "unknown"
+}
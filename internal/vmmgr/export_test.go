@@ -0,0 +1,101 @@
+//go:build libvirt
+
+package vmmgr
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// FailAfterDomainStart makes the creation of vms fail with err once their
+// domain has started, until restore is called.
+func FailAfterDomainStart(err error) (restore func()) {
+	prev := domainStarted
+	domainStarted = func(*libvirt.Domain) error { return err }
+	return func() { domainStarted = prev }
+}
+
+// ListVMsPerDomain lists the vms the way ListVMs used to, looking up every
+// domain then querying its state, info, description and disks one call at
+// a time. It is the baseline of the ListVMs benchmark.
+func (vmm VMManager) ListVMsPerDomain(active, inactive bool) ([]entity.VM, error) {
+	var flags libvirt.ConnectListAllDomainsFlags
+	if active {
+		flags |= libvirt.CONNECT_LIST_DOMAINS_ACTIVE
+	}
+	if inactive {
+		flags |= libvirt.CONNECT_LIST_DOMAINS_INACTIVE
+	}
+	domains, err := vmm.conn.ListAllDomains(flags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list domains: %w", err)
+	}
+	for _, domain := range domains {
+		defer domain.Free()
+	}
+	vms := make([]entity.VM, 0, len(domains))
+	for _, domain := range domains {
+		id, err := domain.GetUUIDString()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get domain id: %w", err)
+		}
+		vm, err := vmm.getVMPerDomain(id)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// getVMPerDomain gets a vm the way GetVM used to.
+func (vmm VMManager) getVMPerDomain(id string) (entity.VM, error) {
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return entity.VM{}, err
+	}
+	defer domain.Free()
+
+	vm := entity.VM{ID: id}
+	if vm.Name, err = domain.GetName(); err != nil {
+		return entity.VM{}, err
+	}
+	state, _, err := domain.GetState()
+	if err != nil {
+		return entity.VM{}, err
+	}
+	vm.State = ParseState(state)
+	info, err := domain.GetInfo()
+	if err != nil {
+		return entity.VM{}, err
+	}
+	vm.Memory = uint(info.Memory) / 1024
+	vm.CPU = info.NrVirtCpu
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return entity.VM{}, err
+	}
+	var domCfg libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &domCfg); err != nil {
+		return entity.VM{}, err
+	}
+	for _, disk := range domCfg.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+		info, err := domain.GetBlockInfo(disk.Target.Dev, 0)
+		if err != nil {
+			continue
+		}
+		vm.Disk = info.Capacity / (1 << 30)
+		// The I/O limits were read along, though no longer reported.
+		_, _ = domain.GetBlockIoTune(disk.Target.Dev, 0)
+		break
+	}
+	return vm, nil
+}
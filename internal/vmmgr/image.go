@@ -0,0 +1,145 @@
+package vmmgr
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+)
+
+// ImageInfo describes a disk image.
+type ImageInfo struct {
+	// Image format (e.g. qcow2).
+	Format string
+	// Size of the disk as seen by the guest, in bytes.
+	VirtualSize uint64
+	// Absolute path of the backing file, empty for standalone images.
+	BackingFile string
+}
+
+// ImageTool performs the disk image operations the VM manager relies on.
+// It is abstracted so that the manager can run against scratch directories
+// on hosts without qemu-img (e.g. in tests).
+type ImageTool interface {
+	// CreateOverlay creates a copy-on-write qcow2 image at dst backed by
+	// the base image.
+	CreateOverlay(base, dst string) error
+	// Resize grows or shrinks the image to newSize GiB.
+	Resize(image string, newSize int) error
+	// Flatten merges the backing chain into the image, turning it into a
+	// standalone image. The image must not be in use.
+	Flatten(image string) error
+	// Info describes the image.
+	Info(image string) (ImageInfo, error)
+	// Convert writes a qcow2 copy of the image to dst.
+	Convert(image, dst string) error
+	// CreateISO writes an ISO 9660 image labeled volumeID at dst holding
+	// the given files.
+	CreateISO(dst, volumeID string, files map[string][]byte) error
+}
+
+// qemuImg implements ImageTool using the qemu-img command line.
+type qemuImg struct {
+	logger log.Logger
+}
+
+// NewQemuImg creates an image tool backed by qemu-img.
+func NewQemuImg(logger log.Logger) ImageTool {
+	return qemuImg{logger}
+}
+
+// CreateOverlay creates a qcow2 overlay on top of the base image.
+func (q qemuImg) CreateOverlay(base, dst string) error {
+	base, err := filepath.Abs(base)
+	if err != nil {
+		return err
+	}
+	return q.run("create", "-f", "qcow2", "-F", "qcow2", "-b", base, dst)
+}
+
+// Resize resizes the image.
+func (q qemuImg) Resize(image string, newSize int) error {
+	info, err := q.Info(image)
+	if err != nil {
+		return err
+	}
+	size := strconv.Itoa(newSize) + "G"
+	if info.VirtualSize <= uint64(newSize)<<30 {
+		return q.run("resize", image, size)
+	}
+	return q.run("resize", "--shrink", image, size)
+}
+
+// Flatten rebases the image on top of nothing, which copies all the data
+// from its backing chain into it.
+func (q qemuImg) Flatten(image string) error {
+	return q.run("rebase", "-b", "", image)
+}
+
+// Info describes the image.
+func (q qemuImg) Info(image string) (ImageInfo, error) {
+	out, err := exec.Command("qemu-img", "info", "--output=json", image).Output()
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	var info struct {
+		Format              string `json:"format"`
+		VirtualSize         uint64 `json:"virtual-size"`
+		FullBackingFilename string `json:"full-backing-filename"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{info.Format, info.VirtualSize, info.FullBackingFilename}, nil
+}
+
+// Convert converts the image to qcow2.
+func (q qemuImg) Convert(image, dst string) error {
+	return q.run("convert", "-O", "qcow2", image, dst)
+}
+
+// CreateISO creates the ISO image using genisoimage.
+func (q qemuImg) CreateISO(dst, volumeID string, files map[string][]byte) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "kvmm-iso-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	names := make([]string, 0, len(files))
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := append([]string{"-output", dst, "-volid", volumeID, "-joliet", "-rock"}, names...)
+	cmd := exec.Command("genisoimage", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		q.logger.Info(string(output))
+		return err
+	}
+	return nil
+}
+
+// run executes qemu-img with the given arguments.
+func (q qemuImg) run(args ...string) error {
+	output, err := exec.Command("qemu-img", args...).CombinedOutput()
+	if err != nil {
+		q.logger.Info(string(output))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,646 @@
+//go:build libvirt
+
+package vmmgr_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/config"
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"github.com/ayoubfaouzi/kvm-manager/internal/server"
+	"github.com/ayoubfaouzi/kvm-manager/internal/vmmgr"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/go-playground/locales/en"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testURI points to libvirt's built-in test driver which runs in-process
+// and needs neither a libvirtd nor a KVM host.
+const testURI = "test:///default"
+
+// discardProducer drops every message.
+type discardProducer struct{}
+
+func (discardProducer) Produce(topic string, message []byte) error { return nil }
+
+// fakeImageTool tracks images and their backing files in memory, writing
+// placeholder files to the image directory.
+type fakeImageTool struct {
+	mu      sync.Mutex
+	backing map[string]string
+	resized map[string]int
+	seeds   map[string]map[string][]byte
+	isoErr  error // Returned by CreateISO when set
+}
+
+func (f *fakeImageTool) CreateOverlay(base, dst string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.backing[dst] = base
+	return os.WriteFile(dst, []byte("qcow2"), 0o644)
+}
+
+func (f *fakeImageTool) Resize(image string, newSize int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resized[image] = newSize
+	return nil
+}
+
+func (f *fakeImageTool) Flatten(image string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.backing, image)
+	return nil
+}
+
+// Info reads the image format from the placeholder files, which hold the
+// name of their format.
+func (f *fakeImageTool) Info(image string) (vmmgr.ImageInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	format := "qcow2"
+	if data, err := os.ReadFile(image); err == nil {
+		format = string(data)
+	}
+	return vmmgr.ImageInfo{Format: format, BackingFile: f.backing[image]}, nil
+}
+
+func (f *fakeImageTool) Convert(image, dst string) error {
+	return os.WriteFile(dst, []byte("qcow2"), 0o644)
+}
+
+func (f *fakeImageTool) CreateISO(dst, volumeID string, files map[string][]byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.isoErr != nil {
+		return f.isoErr
+	}
+	f.seeds[dst] = files
+	return os.WriteFile(dst, []byte("iso"), 0o644)
+}
+
+func (f *fakeImageTool) failISO(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.isoErr = err
+}
+
+func (f *fakeImageTool) seed(iso string) map[string][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.seeds[iso]
+}
+
+func (f *fakeImageTool) backingFile(image string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.backing[image]
+}
+
+type harness struct {
+	handler http.Handler
+	vmMgr   vmmgr.VMManager
+	imgDir  string
+	images  *fakeImageTool
+}
+
+// newVMManager connects a VM manager to the test driver, with an image
+// directory holding an alpinelinux3.21 image file.
+func newVMManager(tb testing.TB) (vmmgr.VMManager, string, *fakeImageTool) {
+	tb.Helper()
+	return newVMManagerAt(tb, testURI)
+}
+
+// newVMManagerAt is newVMManager connected to uri, which must point to the
+// test driver.
+func newVMManagerAt(tb testing.TB, uri string) (vmmgr.VMManager, string, *fakeImageTool) {
+	tb.Helper()
+
+	imgDir := tb.TempDir()
+	require.NoError(tb, os.WriteFile(
+		filepath.Join(imgDir, "alpinelinux3.21.qcow2"), []byte("qcow2"), 0o644))
+
+	logger, _ := log.NewForTest()
+	images := &fakeImageTool{
+		backing: make(map[string]string),
+		resized: make(map[string]int),
+		seeds:   make(map[string]map[string][]byte),
+	}
+	vmMgr, err := vmmgr.NewWithImageTool(logger, entity.NodeInstance{
+		LibVirtURI:      uri,
+		LibVirtImageDir: imgDir,
+		StatsInterval:   50 * time.Millisecond,
+		ResizeHeadroom:  2}, images)
+	require.NoError(tb, err)
+	tb.Cleanup(func() { assert.NoError(tb, vmMgr.Close()) })
+	return vmMgr, imgDir, images
+}
+
+func newHarness(t *testing.T) harness {
+	t.Helper()
+
+	vmMgr, imgDir, images := newVMManager(t)
+	logger, _ := log.NewForTest()
+	trans, _ := ut.New(en.New()).GetTranslator("en")
+	h := harness{server.BuildHandler(logger, &config.Config{}, "test", trans,
+		discardProducer{}, vmMgr), vmMgr, imgDir, images}
+
+	rec := h.do(t, http.MethodPost, "/v1/images",
+		`{"name":"alpinelinux3.21","os_family":"linux","os_version":"3.21","arch":"x86_64","flavor":"linux-alpine"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	return h
+}
+
+func (h harness) do(t *testing.T, method, url, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func (h harness) getVM(t *testing.T, id string) entity.VM {
+	t.Helper()
+	rec := h.do(t, http.MethodGet, "/v1/vms/"+id, "")
+	require.Less(t, rec.Code, 300, rec.Body.String())
+	var vm entity.VM
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &vm))
+	return vm
+}
+
+func (h harness) listVMs(t *testing.T) []entity.VM {
+	t.Helper()
+	rec := h.do(t, http.MethodGet, "/v1/vms", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var res struct {
+		Items []entity.VM `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	return res.Items
+}
+
+// waitJob polls the job returned by an accepted request until it is done.
+func (h harness) waitJob(t *testing.T, rec *httptest.ResponseRecorder) entity.Job {
+	t.Helper()
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var res struct {
+		Item entity.Job `json:"item"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	for i := 0; i < 100 && !res.Item.Done(); i++ {
+		time.Sleep(50 * time.Millisecond)
+		rec = h.do(t, http.MethodGet, "/v1/jobs/"+res.Item.ID, "")
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	}
+	require.True(t, res.Item.Done(), "job %s did not complete", res.Item.ID)
+	return res.Item
+}
+
+func TestIntegration_VMLifecycle(t *testing.T) {
+	h := newHarness(t)
+
+	// Create.
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-lifecycle","cpu":2,"memory":512,"disk":8,"read_iops_sec":100}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	id := job.VMID
+	require.NotEmpty(t, id)
+
+	disk := filepath.Join(h.imgDir, "it-lifecycle.qcow2")
+	assert.FileExists(t, disk)
+	assert.Equal(t, filepath.Join(h.imgDir, "alpinelinux3.21.qcow2"),
+		h.images.backingFile(disk))
+	assert.Equal(t, 8, h.images.resized[disk])
+
+	// The cloud-init seed defaults the hostname to the VM name.
+	seed := filepath.Join(h.imgDir, "it-lifecycle-cidata.iso")
+	assert.FileExists(t, seed)
+	assert.Contains(t, string(h.images.seed(seed)["meta-data"]), "local-hostname: it-lifecycle")
+	assert.Contains(t, string(h.images.seed(seed)["meta-data"]), "instance-id: "+id)
+	assert.Equal(t, "#cloud-config\n", string(h.images.seed(seed)["user-data"]))
+
+	// Get.
+	vm := h.getVM(t, id)
+	assert.Equal(t, "it-lifecycle", vm.Name)
+	assert.Equal(t, uint(2), vm.CPU)
+	assert.Equal(t, uint(512), vm.Memory)
+	assert.Equal(t, "alpinelinux3.21", vm.Image)
+	assert.Equal(t, entity.VMStateRunning, vm.State)
+
+	// List.
+	found := false
+	for _, item := range h.listVMs(t) {
+		if item.ID == id {
+			found = true
+		}
+	}
+	assert.True(t, found, "created vm is not listed")
+
+	// Stop.
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/stop", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "graceful", job.Result.(map[string]interface{})["outcome"])
+	assert.Equal(t, entity.VMStateShutOff, h.getVM(t, id).State)
+
+	// Forced stop.
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/start", ""))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/stop?force=true", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, "forced", job.Result.(map[string]interface{})["outcome"])
+	assert.Equal(t, entity.VMStateShutOff, h.getVM(t, id).State)
+
+	// Start.
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/start", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, entity.VMStateRunning, h.getVM(t, id).State)
+
+	// Restart.
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/restart", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, entity.VMStateRunning, h.getVM(t, id).State)
+
+	// Pause and resume.
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/pause", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, entity.VMStatePaused, h.getVM(t, id).State)
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/resume", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, entity.VMStateRunning, h.getVM(t, id).State)
+
+	// Delete.
+	job = h.waitJob(t, h.do(t, http.MethodDelete, "/v1/vms/"+id, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.NoFileExists(t, disk)
+	assert.NoFileExists(t, seed)
+	for _, item := range h.listVMs(t) {
+		assert.NotEqual(t, id, item.ID)
+	}
+}
+
+func TestIntegration_Stats(t *testing.T) {
+	h := newHarness(t)
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-stats","cpu":2,"memory":512,"disk":8,"read_iops_sec":100}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	id := job.VMID
+	defer h.do(t, http.MethodDelete, "/v1/vms/"+id, "")
+
+	// Rates are served from the samples, once two of them were collected.
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < 40; i++ {
+		rec = h.do(t, http.MethodGet, "/v1/vms/"+id+"/stats", "")
+		if rec.Code != http.StatusServiceUnavailable {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var res struct {
+		Stats entity.VMStats `json:"stats"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	assert.False(t, res.Stats.Timestamp.IsZero())
+	assert.Greater(t, res.Stats.Interval, 0.0)
+	if res.Stats.Memory != nil {
+		assert.Contains(t, []string{entity.MemoryStatsGuest, entity.MemoryStatsHost},
+			res.Stats.Memory.Source)
+	}
+	for _, disk := range res.Stats.Disks {
+		assert.NotEmpty(t, disk.Device)
+		assert.GreaterOrEqual(t, disk.ReadLatencyMs, 0.0)
+	}
+
+	// The rates are kept as history.
+	rec = h.do(t, http.MethodGet, "/v1/vms/"+id+"/metrics?metric=cpu_usage", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var metrics struct {
+		Metrics struct {
+			Series []struct {
+				Points []json.RawMessage
+			}
+		}
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &metrics))
+	require.Len(t, metrics.Metrics.Series, 1)
+	assert.NotEmpty(t, metrics.Metrics.Series[0].Points)
+
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/stop?force=true", ""))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	time.Sleep(100 * time.Millisecond)
+	rec = h.do(t, http.MethodGet, "/v1/vms/"+id+"/stats", "")
+	assert.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+}
+
+func TestIntegration_CloudInitSeed(t *testing.T) {
+	h := newHarness(t)
+
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-seed","cpu":1,"memory":256,"disk":4,"read_iops_sec":100,`+
+			`"hostname":"web-1","ssh_authorized_keys":["ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 me@host"],`+
+			`"user_data":"#!/bin/sh\necho hello\n","network_config":"version: 2\n"}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+
+	files := h.images.seed(filepath.Join(h.imgDir, "it-seed-cidata.iso"))
+	assert.Contains(t, string(files["meta-data"]), "local-hostname: web-1")
+	assert.Contains(t, string(files["meta-data"]), "- ssh-ed25519 AAAAC3NzaC1lZDI1NTE5 me@host")
+	assert.Equal(t, "#!/bin/sh\necho hello\n", string(files["user-data"]))
+	assert.Equal(t, "version: 2\n", string(files["network-config"]))
+}
+
+func TestIntegration_Snapshots(t *testing.T) {
+	h := newHarness(t)
+
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-snap","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	base := "/v1/vms/" + job.VMID + "/snapshots"
+
+	job = h.waitJob(t, h.do(t, http.MethodPost, base, `{"name":"first","description":"fresh"}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = h.waitJob(t, h.do(t, http.MethodPost, base, `{"name":"second"}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+
+	rec := h.do(t, http.MethodGet, base+"/second", "")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var snap struct {
+		Item entity.Snapshot `json:"item"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &snap))
+	assert.Equal(t, "first", snap.Item.Parent)
+	assert.Equal(t, entity.SnapshotInternal, snap.Item.Type)
+	assert.Equal(t, entity.VMStateRunning, snap.Item.State)
+	assert.True(t, snap.Item.Current)
+
+	job = h.waitJob(t, h.do(t, http.MethodPost, base+"/first/revert", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = h.waitJob(t, h.do(t, http.MethodDelete, base+"/second", ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, http.StatusNotFound, h.do(t, http.MethodGet, base+"/second", "").Code)
+
+	// VMs are deleted along with their snapshots.
+	job = h.waitJob(t, h.do(t, http.MethodDelete, "/v1/vms/"+job.VMID, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+}
+
+func TestIntegration_MissingBaseImage(t *testing.T) {
+	h := newHarness(t)
+	require.NoError(t, os.Remove(filepath.Join(h.imgDir, "alpinelinux3.21.qcow2")))
+
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-no-image","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	assert.NoFileExists(t, filepath.Join(h.imgDir, "it-no-image.qcow2"))
+}
+
+func TestIntegration_CreateRollback(t *testing.T) {
+	h := newHarness(t)
+	body := `{"name":"it-rollback","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`
+
+	h.images.failISO(errors.New("no space left on device"))
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms", body))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	assert.NoFileExists(t, filepath.Join(h.imgDir, "it-rollback.qcow2"))
+	orphans, err := h.vmMgr.OrphanedImages()
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	// Nothing is left behind which prevents a retry.
+	h.images.failISO(nil)
+	job = h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms", body))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = h.waitJob(t, h.do(t, http.MethodDelete, "/v1/vms/"+job.VMID, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+}
+
+func TestIntegration_CreateRollbackStartedDomain(t *testing.T) {
+	h := newHarness(t)
+
+	restore := vmmgr.FailAfterDomainStart(errors.New("connection reset"))
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-started","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`))
+	restore()
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+
+	// The domain is destroyed and undefined along with its files.
+	assert.NoError(t, h.vmMgr.CheckVMName("it-started"))
+	for _, vm := range h.listVMs(t) {
+		assert.NotEqual(t, "it-started", vm.Name)
+	}
+	assert.NoFileExists(t, filepath.Join(h.imgDir, "it-started.qcow2"))
+}
+
+func TestIntegration_UniqueNames(t *testing.T) {
+	h := newHarness(t)
+
+	// The test driver comes with a domain named test.
+	rec := h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"test","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"vm_exists"`)
+
+	// Existing disks are never overwritten.
+	taken := filepath.Join(h.imgDir, "it-taken.qcow2")
+	require.NoError(t, os.WriteFile(taken, []byte("qcow2"), 0o644))
+	rec = h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-taken","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Empty(t, h.images.backingFile(taken))
+}
+
+func TestIntegration_OrphanedImages(t *testing.T) {
+	h := newHarness(t)
+
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-orphans","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	stray := filepath.Join(h.imgDir, "it-stray.qcow2")
+	require.NoError(t, os.WriteFile(stray, []byte("qcow2"), 0o644))
+
+	orphans, err := h.vmMgr.OrphanedImages()
+	require.NoError(t, err)
+	assert.Equal(t, []string{stray}, orphans)
+
+	job = h.waitJob(t, h.do(t, http.MethodDelete, "/v1/vms/"+job.VMID, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+}
+
+func TestIntegration_UnknownVM(t *testing.T) {
+	h := newHarness(t)
+
+	rec := h.do(t, http.MethodGet, "/v1/vms/0b7f2a4e-5d3c-4c4e-9d55-1f2a3b4c5d6e", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"code":"vm_not_found"`)
+}
+
+func TestIntegration_UploadImage(t *testing.T) {
+	h := newHarness(t)
+
+	upload := func(name, content string, convert bool) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		_ = w.WriteField("name", name)
+		_ = w.WriteField("os_family", "linux")
+		_ = w.WriteField("os_version", "12")
+		_ = w.WriteField("arch", "x86_64")
+		_ = w.WriteField("convert", strconv.FormatBool(convert))
+		fw, _ := w.CreateFormFile("file", name+".img")
+		_, _ = fw.Write([]byte(content))
+		require.NoError(t, w.Close())
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/images/upload", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		rec := httptest.NewRecorder()
+		h.handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Raw images are only accepted when converted.
+	rec := upload("debian12", "raw", false)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+	rec = upload("debian12", "raw", true)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"format":"qcow2"`)
+	data, err := os.ReadFile(filepath.Join(h.imgDir, "debian12.qcow2"))
+	require.NoError(t, err)
+	assert.Equal(t, "qcow2", string(data))
+
+	// No temporary files are left behind.
+	tmp, _ := filepath.Glob(filepath.Join(h.imgDir, ".*"))
+	assert.Empty(t, tmp)
+
+	// VMs can be created from the uploaded image.
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-uploaded","image":"debian12","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Equal(t, filepath.Join(h.imgDir, "debian12.qcow2"),
+		h.images.backingFile(filepath.Join(h.imgDir, "it-uploaded.qcow2")))
+}
+
+func TestIntegration_ConcurrentImports(t *testing.T) {
+	vmMgr, imgDir, _ := newVMManager(t)
+
+	// Imports of the same image never overwrite each other.
+	const count = 8
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			_, err := vmMgr.ImportImage(entity.Image{Name: "debian12", File: "debian12.qcow2"},
+				hypervisor.ImageSource{Reader: strings.NewReader("qcow2")})
+			errs <- err
+		}()
+	}
+	imported := 0
+	for i := 0; i < count; i++ {
+		if err := <-errs; err == nil {
+			imported++
+		} else {
+			assert.ErrorIs(t, err, hypervisor.ErrImageExists)
+		}
+	}
+	assert.Equal(t, 1, imported)
+	_, err := vmMgr.GetImage("debian12")
+	assert.NoError(t, err)
+	tmp, _ := filepath.Glob(filepath.Join(imgDir, ".*"))
+	assert.Empty(t, tmp)
+}
+
+func TestIntegration_FlattenAndDeleteBackingImage(t *testing.T) {
+	h := newHarness(t)
+
+	job := h.waitJob(t, h.do(t, http.MethodPut, "/v1/vms",
+		`{"name":"it-backing","cpu":1,"memory":256,"disk":4,"read_iops_sec":100}`))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	id := job.VMID
+	disk := filepath.Join(h.imgDir, "it-backing.qcow2")
+
+	// Flattening drops the dependency on the base image. The test driver
+	// has no block jobs, so flatten the disk while the domain is off.
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/stop", ""))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	job = h.waitJob(t, h.do(t, http.MethodPost, "/v1/vms/"+id+"/flatten", ""))
+	require.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.Empty(t, h.images.backingFile(disk))
+
+	// An overlay built on the VM disk prevents its deletion.
+	require.NoError(t, h.images.CreateOverlay(disk,
+		filepath.Join(h.imgDir, "it-backing-child.qcow2")))
+	job = h.waitJob(t, h.do(t, http.MethodDelete, "/v1/vms/"+id, ""))
+	assert.Equal(t, entity.JobStatusFailed, job.Status)
+	assert.FileExists(t, disk)
+
+	require.NoError(t, os.Remove(filepath.Join(h.imgDir, "it-backing-child.qcow2")))
+	job = h.waitJob(t, h.do(t, http.MethodDelete, "/v1/vms/"+id, ""))
+	assert.Equal(t, entity.JobStatusSucceeded, job.Status, job.Error)
+	assert.NoFileExists(t, disk)
+}
+
+// BenchmarkListVMs compares listing hundreds of VMs out of a single bulk
+// stats call against the previous implementation, which looked them up one
+// by one. Every libvirt call is a round trip to libvirtd over a remote URI,
+// so the gain barely shows with the in-process test driver: set
+// KVMM_BENCH_URI to reach the test driver through libvirtd, e.g.
+//
+//	KVMM_BENCH_URI=test+unix:///default go test -tags libvirt -run '^$' -bench ListVMs ./internal/vmmgr
+func BenchmarkListVMs(b *testing.B) {
+	const count = 300
+
+	uri := os.Getenv("KVMM_BENCH_URI")
+	if uri == "" {
+		uri = testURI
+	}
+	vmMgr, _, _ := newVMManagerAt(b, uri)
+	_, err := vmMgr.CreateImage(entity.Image{Name: "alpinelinux3.21",
+		OSFamily: "linux", Flavor: "linux-alpine"})
+	require.NoError(b, err)
+
+	ids := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		vm, _, err := vmMgr.CreateVM(entity.VM{Name: fmt.Sprintf("bench-%03d", i),
+			Image: "alpinelinux3.21", CPU: 1, Memory: 512, Disk: 1,
+			Labels: map[string]string{"bench": "true"}}, nil)
+		require.NoError(b, err)
+		ids = append(ids, vm.ID)
+	}
+	b.Cleanup(func() {
+		for _, id := range ids {
+			_ = vmMgr.DeleteVM(id)
+		}
+	})
+
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			vms, err := vmMgr.ListVMs(true, true)
+			require.NoError(b, err)
+			require.GreaterOrEqual(b, len(vms), count)
+		}
+	})
+	b.Run("per-domain", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			vms, err := vmMgr.ListVMsPerDomain(true, true)
+			require.NoError(b, err)
+			require.GreaterOrEqual(b, len(vms), count)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package vmmgr
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"libvirt.org/go/libvirt"
+)
+
+// Bytes in a MiB, the unit of the bandwidth throttles.
+const mib = 1024 * 1024
+
+// GetDiskIOTune returns the I/O throttling of the disk dev of the vm.
+func (vmm VMManager) GetDiskIOTune(id, dev string) (_ entity.IOTune, err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return entity.IOTune{}, err
+	}
+	defer domain.Free()
+	if err := lookupDisk(domain, dev); err != nil {
+		return entity.IOTune{}, err
+	}
+
+	params, err := domain.GetBlockIoTune(dev, libvirt.DOMAIN_AFFECT_CURRENT)
+	if err != nil {
+		return entity.IOTune{}, err
+	}
+	return entity.IOTune{
+		TotalBytesSec:          toMiB(params.TotalBytesSec),
+		ReadBytesSec:           toMiB(params.ReadBytesSec),
+		WriteBytesSec:          toMiB(params.WriteBytesSec),
+		TotalIopsSec:           params.TotalIopsSec,
+		ReadIopsSec:            params.ReadIopsSec,
+		WriteIopsSec:           params.WriteIopsSec,
+		TotalBytesSecMax:       toMiB(params.TotalBytesSecMax),
+		ReadBytesSecMax:        toMiB(params.ReadBytesSecMax),
+		WriteBytesSecMax:       toMiB(params.WriteBytesSecMax),
+		TotalIopsSecMax:        params.TotalIopsSecMax,
+		ReadIopsSecMax:         params.ReadIopsSecMax,
+		WriteIopsSecMax:        params.WriteIopsSecMax,
+		TotalBytesSecMaxLength: params.TotalBytesSecMaxLength,
+		ReadBytesSecMaxLength:  params.ReadBytesSecMaxLength,
+		WriteBytesSecMaxLength: params.WriteBytesSecMaxLength,
+		TotalIopsSecMaxLength:  params.TotalIopsSecMaxLength,
+		ReadIopsSecMaxLength:   params.ReadIopsSecMaxLength,
+		WriteIopsSecMaxLength:  params.WriteIopsSecMaxLength,
+		GroupName:              params.GroupName,
+	}, nil
+}
+
+// SetDiskIOTune replaces the I/O throttling of the disk dev of the vm, in
+// its definition and live when it runs.
+func (vmm VMManager) SetDiskIOTune(id, dev string, tune entity.IOTune) (err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return err
+	}
+	defer domain.Free()
+	if err := lookupDisk(domain, dev); err != nil {
+		return err
+	}
+	defer vmm.descs.drop(id)
+
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	active, err := domain.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+
+	cur, err := domain.GetBlockIoTune(dev, libvirt.DOMAIN_AFFECT_CURRENT)
+	if err != nil {
+		return err
+	}
+
+	// Every throttle is set for the ones left out to be cleared, and so is
+	// the group which is left when empty.
+	params := &libvirt.DomainBlockIoTuneParameters{
+		TotalBytesSecSet:          true,
+		TotalBytesSec:             bandwidth(tune.TotalBytesSec, cur.TotalBytesSec),
+		ReadBytesSecSet:           true,
+		ReadBytesSec:              bandwidth(tune.ReadBytesSec, cur.ReadBytesSec),
+		WriteBytesSecSet:          true,
+		WriteBytesSec:             bandwidth(tune.WriteBytesSec, cur.WriteBytesSec),
+		TotalIopsSecSet:           true,
+		TotalIopsSec:              tune.TotalIopsSec,
+		ReadIopsSecSet:            true,
+		ReadIopsSec:               tune.ReadIopsSec,
+		WriteIopsSecSet:           true,
+		WriteIopsSec:              tune.WriteIopsSec,
+		TotalBytesSecMaxSet:       true,
+		TotalBytesSecMax:          bandwidth(tune.TotalBytesSecMax, cur.TotalBytesSecMax),
+		ReadBytesSecMaxSet:        true,
+		ReadBytesSecMax:           bandwidth(tune.ReadBytesSecMax, cur.ReadBytesSecMax),
+		WriteBytesSecMaxSet:       true,
+		WriteBytesSecMax:          bandwidth(tune.WriteBytesSecMax, cur.WriteBytesSecMax),
+		TotalIopsSecMaxSet:        true,
+		TotalIopsSecMax:           tune.TotalIopsSecMax,
+		ReadIopsSecMaxSet:         true,
+		ReadIopsSecMax:            tune.ReadIopsSecMax,
+		WriteIopsSecMaxSet:        true,
+		WriteIopsSecMax:           tune.WriteIopsSecMax,
+		TotalBytesSecMaxLengthSet: true,
+		TotalBytesSecMaxLength:    tune.TotalBytesSecMaxLength,
+		ReadBytesSecMaxLengthSet:  true,
+		ReadBytesSecMaxLength:     tune.ReadBytesSecMaxLength,
+		WriteBytesSecMaxLengthSet: true,
+		WriteBytesSecMaxLength:    tune.WriteBytesSecMaxLength,
+		TotalIopsSecMaxLengthSet:  true,
+		TotalIopsSecMaxLength:     tune.TotalIopsSecMaxLength,
+		ReadIopsSecMaxLengthSet:   true,
+		ReadIopsSecMaxLength:      tune.ReadIopsSecMaxLength,
+		WriteIopsSecMaxLengthSet:  true,
+		WriteIopsSecMaxLength:     tune.WriteIopsSecMaxLength,
+		GroupNameSet:              true,
+		GroupName:                 tune.GroupName,
+	}
+	return domain.SetBlockIoTune(dev, params, flags)
+}
+
+// toMiB converts a bandwidth in bytes to MiB, rounded up so that a limit
+// never reads as unlimited.
+func toMiB(bytes uint64) uint64 {
+	mibs := bytes / mib
+	if bytes%mib != 0 {
+		mibs++
+	}
+	return mibs
+}
+
+// bandwidth returns the bandwidth in bytes of a throttle set to mibs MiB.
+// The current one, in bytes, is kept when unchanged: limits which are not a
+// multiple of a MiB, e.g. set outside of the API, are thus preserved.
+func bandwidth(mibs, cur uint64) uint64 {
+	if mibs == toMiB(cur) {
+		return cur
+	}
+	return mibs * mib
+}
+
+// lookupDisk returns ErrDiskNotFound unless the domain has a disk, not a
+// cdrom, whose target is dev.
+func lookupDisk(domain *libvirt.Domain, dev string) error {
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+	var domCfg libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &domCfg); err != nil {
+		return fmt.Errorf("failed to unmarshal domain XML: %w", err)
+	}
+	if domCfg.Devices != nil {
+		for _, disk := range domCfg.Devices.Disks {
+			if disk.Device == "disk" && disk.Target != nil && disk.Target.Dev == dev {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", hypervisor.ErrDiskNotFound, dev)
+}
@@ -5,41 +5,124 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"io"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 
 	"libvirt.org/go/libvirtxml"
 
 	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
 	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"github.com/google/uuid"
 	"libvirt.org/go/libvirt"
 )
 
+// VMManager is the libvirt implementation of the hypervisor driver.
 type VMManager struct {
-	logger log.Logger
-	conn   *libvirt.Connect
-	imgDir string
+	logger     log.Logger
+	conn       *libvirt.Connect
+	imgDir     string
+	images     ImageTool
+	domainType string
+	events     chan entity.Event
+	descs      *descriptionCache
+	sampler    *sampler
+	headroom   uint
+	// Time after which the block jobs are aborted.
+	blockJobTimeout time.Duration
+	// Stops the sampler, which closes sampled once it returns.
+	stopSampler context.CancelFunc
+	sampled     chan struct{}
+	callbacks   []int // IDs of the registered domain event callbacks
 }
 
-type VMState struct {
-	CPUUsage      float64 `json:"cpu_usage"`
-	MemoryPercent float64 `json:"mem_percent"`
-}
+// Ensure VMManager satisfies the hypervisor driver interface.
+var _ hypervisor.Driver = VMManager{}
 
 const (
-	// Base images names.
-	linuxAlpineBaseImage = "alpinelinux3.21.qcow2"
+	// Interval between two checks of the state of a guest shutting down.
+	shutdownPollInterval = 500 * time.Millisecond
+
+	// Interval between two checks of the progress of a block job.
+	blockJobPollInterval = 500 * time.Millisecond
+	// Default time after which the block jobs are aborted.
+	defaultBlockJobTimeout = time.Hour
+
+	// XML namespace of the metadata attached to the domains we create.
+	metadataNamespace = "https://github.com/ayoubfaouzi/kvm-manager/xmlns/vm/1.0"
 )
 
+// domainMetadata holds the details about the VM libvirt is not aware of.
+type domainMetadata struct {
+	XMLName xml.Name      `xml:"https://github.com/ayoubfaouzi/kvm-manager/xmlns/vm/1.0 instance"`
+	Image   string        `xml:"image"`
+	Labels  []domainLabel `xml:"labels>label"`
+}
+
+// domainLabel is a label attached to the VM.
+type domainLabel struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// marshalMetadata renders the metadata element with an explicit namespace
+// prefix, as libvirt requires.
+func marshalMetadata(m domainMetadata) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<kvmm:instance xmlns:kvmm="%s"><kvmm:image>`, metadataNamespace)
+	if err := xml.EscapeText(&b, []byte(m.Image)); err != nil {
+		return "", err
+	}
+	b.WriteString(`</kvmm:image>`)
+	if len(m.Labels) > 0 {
+		b.WriteString(`<kvmm:labels>`)
+		for _, label := range m.Labels {
+			b.WriteString(`<kvmm:label key="`)
+			if err := xml.EscapeText(&b, []byte(label.Key)); err != nil {
+				return "", err
+			}
+			b.WriteString(`">`)
+			if err := xml.EscapeText(&b, []byte(label.Value)); err != nil {
+				return "", err
+			}
+			b.WriteString(`</kvmm:label>`)
+		}
+		b.WriteString(`</kvmm:labels>`)
+	}
+	b.WriteString(`</kvmm:instance>`)
+	return b.String(), nil
+}
+
+// metadataLabels returns the labels sorted by key, for the metadata to be
+// stable.
+func metadataLabels(labels map[string]string) []domainLabel {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := make([]domainLabel, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, domainLabel{key, labels[key]})
+	}
+	return res
+}
+
 // New initializes the VM manager service.
 func New(logger log.Logger, node entity.NodeInstance) (VMManager, error) {
+	return NewWithImageTool(logger, node, NewQemuImg(logger))
+}
+
+// NewWithImageTool initializes the VM manager service with a custom image
+// tool used to copy and resize the VM disks.
+func NewWithImageTool(logger log.Logger, node entity.NodeInstance,
+	images ImageTool) (VMManager, error) {
+
+	startEventLoop(logger)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -51,20 +134,101 @@ func New(logger log.Logger, node entity.NodeInstance) (VMManager, error) {
 		return VMManager{}, err
 	}
 
-	return VMManager{logger, conn, node.LibVirtImageDir}, nil
+	// The test driver (e.g. test:///default) only accepts `test` domains.
+	domainType := "kvm"
+	if hvType, err := conn.GetType(); err == nil && hvType == "Test" {
+		domainType = "test"
+	}
+
+	sampler := newSampler(logger, conn, node.StatsInterval, node.StatsRetention,
+		node.StatsRollup1mRetention, node.StatsRollup5mRetention)
+	vmm := VMManager{
+		logger:     logger,
+		conn:       conn,
+		imgDir:     node.LibVirtImageDir,
+		images:     images,
+		domainType: domainType,
+		events:     make(chan entity.Event, eventsBufferSize),
+		descs:      newDescriptionCache(),
+		sampler:    sampler,
+		headroom:   max(node.ResizeHeadroom, 1),
+		sampled:    make(chan struct{}),
+	}
+	vmm.blockJobTimeout = node.BlockJobTimeout
+	if vmm.blockJobTimeout <= 0 {
+		vmm.blockJobTimeout = defaultBlockJobTimeout
+	}
+	if vmm.callbacks, err = vmm.registerEvents(); err != nil {
+		conn.Close()
+		return VMManager{}, err
+	}
+	var samplerCtx context.Context
+	samplerCtx, vmm.stopSampler = context.WithCancel(context.Background())
+	go vmm.sampler.run(samplerCtx, vmm.sampled)
+
+	return vmm, nil
 }
 
-// CreateVM creates the vm.
-func (vmm VMManager) CreateVM(vm entity.VM) (entity.VM, int, error) {
+// Close stops sampling the domains, deregisters the domain event callbacks
+// and closes the connection to libvirt. The VM manager must not be used
+// afterwards.
+func (vmm VMManager) Close() error {
+	vmm.stopSampler()
+	<-vmm.sampled
+	vmm.deregisterEvents(vmm.callbacks)
+	if _, err := vmm.conn.Close(); err != nil {
+		return fmt.Errorf("failed to close the libvirt connection: %w", err)
+	}
+	return nil
+}
+
+// domainStarted is called once the domain of a new vm has started, tests
+// replace it to make the creation fail past that point.
+var domainStarted = func(domain *libvirt.Domain) error { return nil }
+
+// CreateVM creates the vm. Creation is undone step by step on failure so
+// that neither the disks nor the domain are left behind, the ID of the
+// domain is then returned if it was defined.
+func (vmm VMManager) CreateVM(vm entity.VM, progress hypervisor.Progress) (
+	created entity.VM, _ int, err error) {
+	defer classifyError(&err)
 
-	baseImgName := filepath.Join(vmm.imgDir, linuxAlpineBaseImage)
+	// The domain is freed once the rollback, which acts on it, is done.
+	var domain *libvirt.Domain
+	defer func() {
+		if domain != nil {
+			domain.Free()
+		}
+	}()
+	undo := rollback{logger: vmm.logger}
+	defer func() {
+		if err != nil {
+			if domain != nil {
+				if id, err := domain.GetUUIDString(); err == nil {
+					created = entity.VM{ID: id, Name: vm.Name}
+				}
+			}
+			undo.run()
+		}
+	}()
+
+	img, err := vmm.GetImage(vm.Image)
+	if err != nil {
+		return entity.VM{}, 400, fmt.Errorf("base image %s: %w", vm.Image, err)
+	}
+	baseImgName := vmm.imagePath(img)
 	if _, err := os.Stat(baseImgName); os.IsNotExist(err) {
 		return entity.VM{}, 400, errors.New(baseImgName + " image not found")
 	}
 
-	destImgName := filepath.Join(vmm.imgDir, vm.Name+".qcow2")
-	vmm.logger.Info("Copying image", baseImgName, "to", destImgName)
-	err := copyFile(baseImgName, destImgName)
+	// Never overwrite, nor roll back, the files of another vm.
+	if err := vmm.CheckVMName(vm.Name); err != nil {
+		return entity.VM{}, 409, err
+	}
+	destImgName := vmm.diskPath(vm.Name)
+	vmm.logger.Info("Creating overlay", destImgName, "backed by", baseImgName)
+	undo.add("remove disk "+destImgName, func() error { return removeFile(destImgName) })
+	err = vmm.images.CreateOverlay(baseImgName, destImgName)
 	if err != nil {
 		return entity.VM{}, 500, err
 	}
@@ -74,16 +238,52 @@ func (vmm VMManager) CreateVM(vm entity.VM) (entity.VM, int, error) {
 	if err != nil {
 		return entity.VM{}, 500, err
 	}
+	progress.Report(hypervisor.ProgressOverlayCreated)
 
+	metadata, err := marshalMetadata(domainMetadata{
+		Image:  vm.Image,
+		Labels: metadataLabels(vm.Labels),
+	})
+	if err != nil {
+		return entity.VM{}, 500, err
+	}
+
+	// The domain UUID doubles as the cloud-init instance ID.
+	domainUUID := uuid.New().String()
+	seed, err := seedFiles(domainUUID, vm)
+	if err != nil {
+		return entity.VM{}, 500, err
+	}
+	seedImgName := vmm.seedPath(vm.Name)
+	vmm.logger.Info("Creating cloud-init seed", seedImgName)
+	undo.add("remove cloud-init seed "+seedImgName, func() error { return removeFile(seedImgName) })
+	if err := vmm.images.CreateISO(seedImgName, seedVolumeID, seed); err != nil {
+		return entity.VM{}, 500, fmt.Errorf("failed to create cloud-init seed: %w", err)
+	}
+	progress.Report(hypervisor.ProgressSeedBuilt)
+
+	maxCPU, maxMemory, err := vmm.headroomFor(vm)
+	if err != nil {
+		return entity.VM{}, 500, err
+	}
 	domainXML := libvirtxml.Domain{
-		Type: "kvm",
-		Name: vm.Name,
+		Type:     vmm.domainType,
+		Name:     vm.Name,
+		UUID:     domainUUID,
+		Metadata: &libvirtxml.DomainMetadata{XML: metadata},
+		// The maximum vCPUs and memory leave room for the VM to be grown
+		// without a reboot.
 		Memory: &libvirtxml.DomainMemory{
-			Value: uint(vm.Memory),
-			Unit:  "MB",
+			Value: maxMemory,
+			Unit:  "MiB",
+		},
+		CurrentMemory: &libvirtxml.DomainCurrentMemory{
+			Value: vm.Memory,
+			Unit:  "MiB",
 		},
 		VCPU: &libvirtxml.DomainVCPU{
-			Value: vm.CPU,
+			Current: vm.CPU,
+			Value:   maxCPU,
 		},
 		OS: &libvirtxml.DomainOS{
 			Type: &libvirtxml.DomainOSType{
@@ -121,6 +321,36 @@ func (vmm VMManager) CreateVM(vm entity.VM) (entity.VM, int, error) {
 						WriteIopsSec:  vm.WriteIopsSec,
 					},
 				},
+				{
+					Device: "cdrom",
+					Driver: &libvirtxml.DomainDiskDriver{
+						Name: "qemu",
+						Type: "raw",
+					},
+					Source: &libvirtxml.DomainDiskSource{
+						File: &libvirtxml.DomainDiskSourceFile{
+							File: seedImgName,
+						},
+					},
+					Target: &libvirtxml.DomainDiskTarget{
+						Dev: seedDev,
+						Bus: "sata",
+					},
+					ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+				},
+			},
+			// Lets the guest agent, if installed, handle shutdown requests.
+			Channels: []libvirtxml.DomainChannel{
+				{
+					Source: &libvirtxml.DomainChardevSource{
+						UNIX: &libvirtxml.DomainChardevSourceUNIX{Mode: "bind"},
+					},
+					Target: &libvirtxml.DomainChannelTarget{
+						VirtIO: &libvirtxml.DomainChannelTargetVirtIO{
+							Name: "org.qemu.guest_agent.0",
+						},
+					},
+				},
 			},
 			Interfaces: []libvirtxml.DomainInterface{
 				{
@@ -137,26 +367,34 @@ func (vmm VMManager) CreateVM(vm entity.VM) (entity.VM, int, error) {
 					},
 				},
 			},
+			// The guest reports its memory usage through the balloon.
+			MemBalloon: &libvirtxml.DomainMemBalloon{
+				Model: "virtio",
+				Stats: &libvirtxml.DomainMemBalloonStats{
+					Period: uint(vmm.sampler.balloonPeriod()),
+				},
+			},
 		},
 	}
 	vmxml, err := domainXML.Marshal()
 	if err != nil {
 		return entity.VM{}, 500, err
 	}
-	domain, err := vmm.conn.DomainDefineXML(vmxml)
+	domain, err = vmm.conn.DomainDefineXML(vmxml)
 	if err != nil {
 		return entity.VM{}, 500, err
 	}
-	defer func() {
-		err := domain.Free()
-		if err != nil {
-			return
-		}
-	}()
+	undo.add("undefine domain "+vm.Name, domain.Undefine)
+	progress.Report(hypervisor.ProgressDefined)
 	err = domain.Create()
 	if err != nil {
 		return entity.VM{}, 500, err
 	}
+	undo.add("destroy domain "+vm.Name, domain.Destroy)
+	if err := domainStarted(domain); err != nil {
+		return entity.VM{}, 500, err
+	}
+	progress.Report(hypervisor.ProgressStarted)
 	id, err := domain.GetUUIDString()
 	if err != nil {
 		return entity.VM{}, 500, err
@@ -176,78 +414,74 @@ func (vmm VMManager) CreateVM(vm entity.VM) (entity.VM, int, error) {
 	return vm, 200, nil
 }
 
-// GetVM gets the vm.
-func (vmm VMManager) GetVM(id string) (entity.VM, error) {
-	domain, err := vmm.conn.LookupDomainByUUIDString(id)
-	if err != nil {
-		return entity.VM{}, err
-	}
+// CheckVMName fails if a domain is named name or if the disk or the seed
+// of a vm named name already exist.
+func (vmm VMManager) CheckVMName(name string) (err error) {
+	defer classifyError(&err)
 
-	var vm entity.VM
-	vm.Name, err = domain.GetName()
-	if err != nil {
-		return entity.VM{}, err
+	domain, err := vmm.conn.LookupDomainByName(name)
+	if err == nil {
+		domain.Free()
+		return fmt.Errorf("%w: domain %s", hypervisor.ErrVMExists, name)
 	}
-	state, _, err := domain.GetState()
-	if err != nil {
-		return entity.VM{}, err
+	var lerr libvirt.Error
+	if !errors.As(err, &lerr) || lerr.Code != libvirt.ERR_NO_DOMAIN {
+		return err
+	}
+
+	for _, path := range []string{vmm.diskPath(name), vmm.seedPath(name)} {
+		_, err := os.Stat(path)
+		if err == nil {
+			return fmt.Errorf("%w: %s already exists", hypervisor.ErrVMExists, path)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
 	}
+	return nil
+}
+
+// diskPath returns the location of the disk of the vm.
+func (vmm VMManager) diskPath(name string) string {
+	return filepath.Join(vmm.imgDir, name+".qcow2")
+}
+
+// GetVM gets the vm.
+func (vmm VMManager) GetVM(id string) (_ entity.VM, err error) {
+	defer classifyError(&err)
 
-	info, err := domain.GetInfo()
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
 		return entity.VM{}, err
 	}
-	vm.Memory = uint(info.Memory) / 1024
-	vm.CPU = info.NrVirtCpu
+	defer domain.Free()
 
-	xmlDesc, err := domain.GetXMLDesc(0)
+	stats, err := vmm.conn.GetAllDomainStats([]*libvirt.Domain{domain}, vmStatsTypes, 0)
 	if err != nil {
 		return entity.VM{}, err
 	}
-
-	type Domain struct {
-		Devices struct {
-			Disks []struct {
-				Target struct {
-					Dev string `xml:"dev,attr"`
-				} `xml:"target"`
-			} `xml:"disk"`
-		} `xml:"devices"`
+	for _, s := range stats {
+		defer s.Domain.Free()
+	}
+	if len(stats) == 0 {
+		return entity.VM{}, fmt.Errorf("%w: no stats for domain %s",
+			hypervisor.ErrVMNotFound, id)
 	}
 
-	var dom Domain
-	if err := xml.Unmarshal([]byte(xmlDesc), &dom); err != nil {
+	vm, err := vmm.statsVM(stats[0], true)
+	if err != nil {
 		return entity.VM{}, err
 	}
-
-	for _, disk := range dom.Devices.Disks {
-		info, err := domain.GetBlockInfo(disk.Target.Dev, 0)
-		if err != nil {
-			vmm.logger.Debugf("Could not get info for %s: %v", disk.Target.Dev, err)
-			continue
-		}
-		vm.Disk = info.Capacity / (1 << 30)
-
-		stats, err := domain.GetBlockIoTune(disk.Target.Dev, 0)
-		if err != nil {
-			vmm.logger.Debugf("Failed to get block stats: %v", err)
-		}
-		vm.ReadBytesSec = stats.ReadBytesSec / 1024 / 1024
-		vm.WriteBytesSec = stats.WriteBytesSec / 1024 / 1024
-		vm.TotalBytesSec = stats.TotalBytesSec / 1024 / 1024
-		vm.ReadIopsSec = stats.ReadIopsSec
-		vm.WriteIopsSec = stats.WriteIopsSec
-		vm.TotalIopsSec = stats.TotalIopsSec
-		break
+	if saved, err := domain.HasManagedSaveImage(0); err == nil {
+		vm.Saved = saved
 	}
-
-	vm.State = ParseState(state)
-	vm.ID = id
 	return vm, nil
 }
 
 // StartVM starts the vm.
-func (vmm VMManager) StartVM(id string) error {
+func (vmm VMManager) StartVM(id string) (err error) {
+	defer classifyError(&err)
+
 	domain, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
 		return err
@@ -266,7 +500,8 @@ func (vmm VMManager) StartVM(id string) error {
 }
 
 // DeleteVM deletes the vm.
-func (vmm VMManager) DeleteVM(id string) error {
+func (vmm VMManager) DeleteVM(id string) (err error) {
+	defer classifyError(&err)
 
 	domain, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
@@ -279,6 +514,45 @@ func (vmm VMManager) DeleteVM(id string) error {
 		}
 	}()
 
+	name, err := domain.GetName()
+	if err != nil {
+		return fmt.Errorf("failed to get domain name: %w", err)
+	}
+
+	// Collect the disks before the domain definition is gone.
+	disks, err := vmm.GetVMDiskPaths(id)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve vm disks paths: %w", err)
+	}
+
+	// Refuse to delete images other overlays are built on.
+	for _, disk := range disks {
+		overlays, err := vmm.Overlays(disk)
+		if err != nil {
+			return fmt.Errorf("failed to look for overlays of %s: %w", disk, err)
+		}
+		if len(overlays) > 0 {
+			return fmt.Errorf("%w: %s backs %d overlay(s)",
+				hypervisor.ErrImageInUse, disk, len(overlays))
+		}
+	}
+
+	// External snapshots leave the previous disks behind the overlays, as
+	// well as memory files.
+	var files []string
+	for _, disk := range disks {
+		chain, err := vmm.diskChain(disk)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", disk, err)
+		}
+		files = append(files, chain...)
+	}
+	memFiles, err := snapshotMemoryFiles(domain)
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	files = append(files, memFiles...)
+
 	active, err := domain.IsActive()
 	if err != nil {
 		return fmt.Errorf("failed to check domain status: %w", err)
@@ -293,31 +567,35 @@ func (vmm VMManager) DeleteVM(id string) error {
 	}
 
 	// Undefine
-	err = domain.Undefine()
+	err = domain.UndefineFlags(libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA |
+		libvirt.DOMAIN_UNDEFINE_MANAGED_SAVE)
 	if err != nil {
 		return fmt.Errorf("failed to undefine domain: %w", err)
 	}
+	vmm.descs.drop(id)
 
-	// Destroy if running.
-	disks, err := vmm.GetVMDiskPaths(id)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve vm disks paths: %w", err)
-	}
-
-	for _, disk := range disks {
+	for _, disk := range files {
 		if err := os.Remove(disk); err != nil {
-			vmm.logger.Errorf("failed to remove disk path %s domain: %w", disk, err)
+			vmm.logger.Errorf("failed to remove disk path %s domain: %v", disk, err)
 		}
 	}
+	if err := os.Remove(vmm.seedPath(name)); err != nil && !os.IsNotExist(err) {
+		vmm.logger.Errorf("failed to remove cloud-init seed of %s: %v", name, err)
+	}
 
 	return nil
 }
 
-// StopVM stops the vm.
-func (vmm VMManager) StopVM(id string) error {
+// StopVM asks the guest to shut down and waits for it to do so, powering
+// the vm off on timeout if opts.Fallback is set. Forced stops power the vm
+// off right away.
+func (vmm VMManager) StopVM(id string, opts hypervisor.StopOptions,
+	progress hypervisor.Progress) (_ entity.StopOutcome, err error) {
+	defer classifyError(&err)
+
 	domain, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer func() {
 		err := domain.Free()
@@ -326,16 +604,63 @@ func (vmm VMManager) StopVM(id string) error {
 		}
 	}()
 
-	err = domain.Destroy()
-	if err != nil {
-		return fmt.Errorf("failed to destroy domain: %w", err)
+	if opts.Force {
+		return vmm.powerOff(domain, progress)
 	}
 
-	return nil
+	// The test driver does not support selecting the shutdown method.
+	flags := libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN
+	if opts.Mode == hypervisor.ShutdownAgent {
+		flags = libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT
+	}
+	if vmm.domainType == "test" {
+		flags = libvirt.DOMAIN_SHUTDOWN_DEFAULT
+	}
+	if err := domain.ShutdownFlags(flags); err != nil {
+		if !opts.Fallback {
+			return "", fmt.Errorf("failed to shut down domain: %w", err)
+		}
+		vmm.logger.Errorf("failed to shut down %s, powering it off: %v", id, err)
+		return vmm.powerOff(domain, progress)
+	}
+	progress.Report(hypervisor.ProgressShutdownRequested)
+
+	deadline := time.Now().Add(opts.Timeout)
+	for {
+		state, _, err := domain.GetState()
+		if err != nil {
+			return "", fmt.Errorf("failed to get domain state: %w", err)
+		}
+		if state == libvirt.DOMAIN_SHUTOFF {
+			return entity.StopGraceful, nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(shutdownPollInterval)
+	}
+
+	if !opts.Fallback {
+		return "", hypervisor.ErrShutdownTimeout
+	}
+	vmm.logger.Info("Guest", id, "did not shut down in", opts.Timeout, "powering it off")
+	return vmm.powerOff(domain, progress)
+}
+
+// powerOff destroys the domain.
+func (vmm VMManager) powerOff(domain *libvirt.Domain, progress hypervisor.Progress) (
+	entity.StopOutcome, error) {
+	if err := domain.Destroy(); err != nil {
+		return "", fmt.Errorf("failed to destroy domain: %w", err)
+	}
+	progress.Report(hypervisor.ProgressForcedOff)
+	return entity.StopForced, nil
 }
 
 // RebootVM stops the vm.
-func (vmm VMManager) RebootVM(id string) error {
+func (vmm VMManager) RebootVM(id string) (err error) {
+	defer classifyError(&err)
+
 	domain, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
 		return err
@@ -353,92 +678,226 @@ func (vmm VMManager) RebootVM(id string) error {
 	return nil
 }
 
-// ListVMs lists the vms.
-func (vmm VMManager) ListVMs(active, inactive bool) ([]entity.VM, error) {
-	var flags libvirt.ConnectListAllDomainsFlags
+// PauseVM suspends the vm.
+func (vmm VMManager) PauseVM(id string) error {
+	return vmm.withDomain(id, func(domain *libvirt.Domain) error {
+		return domain.Suspend()
+	})
+}
+
+// ResumeVM resumes a paused vm, or wakes up a PM suspended one.
+func (vmm VMManager) ResumeVM(id string) error {
+	return vmm.withDomain(id, func(domain *libvirt.Domain) error {
+		state, _, err := domain.GetState()
+		if err != nil {
+			return err
+		}
+		if state == libvirt.DOMAIN_PMSUSPENDED {
+			return domain.PMWakeup(0)
+		}
+		return domain.Resume()
+	})
+}
+
+// SaveVM saves the memory of the vm to a managed save image and stops it.
+// Starting the vm restores it from the image.
+func (vmm VMManager) SaveVM(id string) error {
+	return vmm.withDomain(id, func(domain *libvirt.Domain) error {
+		return domain.ManagedSave(0)
+	})
+}
+
+// ResetVM resets the vm without shutting it down.
+func (vmm VMManager) ResetVM(id string) error {
+	return vmm.withDomain(id, func(domain *libvirt.Domain) error {
+		return domain.Reset(0)
+	})
+}
+
+// withDomain looks up the domain of the vm and calls fn with it.
+func (vmm VMManager) withDomain(id string, fn func(domain *libvirt.Domain) error) (err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return err
+	}
+	defer domain.Free()
+	return fn(domain)
+}
+
+// FlattenVM turns the disks of the vm into standalone images, merging their
+// backing chain into them. Disks of a running vm are flattened live.
+func (vmm VMManager) FlattenVM(id string) (err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := domain.Free()
+		if err != nil {
+			return
+		}
+	}()
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return fmt.Errorf("failed to check domain status: %w", err)
+	}
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return fmt.Errorf("failed to get domain XML: %w", err)
+	}
+	var domCfg libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &domCfg); err != nil {
+		return fmt.Errorf("failed to unmarshal domain XML: %w", err)
+	}
+
+	for _, disk := range domCfg.Devices.Disks {
+		if disk.Device != "disk" || disk.Source == nil || disk.Source.File == nil ||
+			disk.Target == nil {
+			continue
+		}
+		path := disk.Source.File.File
+		info, err := vmm.images.Info(path)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %w", path, err)
+		}
+		if info.BackingFile == "" {
+			continue
+		}
+
+		vmm.logger.Info("Flattening image", path, "backed by", info.BackingFile)
+		if !active {
+			if err := vmm.images.Flatten(path); err != nil {
+				return fmt.Errorf("failed to flatten %s: %w", path, err)
+			}
+			continue
+		}
+		if err := vmm.blockPull(domain, disk.Target.Dev); err != nil {
+			return fmt.Errorf("failed to flatten %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// blockPull streams the backing chain into the disk of a running domain and
+// waits for the block job to complete. The job is aborted when it does not
+// complete in time.
+func (vmm VMManager) blockPull(domain *libvirt.Domain, dev string) error {
+	if err := domain.BlockPull(dev, 0, 0); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(vmm.blockJobTimeout)
+	for {
+		info, err := domain.GetBlockJobInfo(dev, 0)
+		if err != nil {
+			return err
+		}
+		// No block job left means the pull completed.
+		if info.Type == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(blockJobPollInterval)
+	}
+
+	if err := domain.BlockJobAbort(dev, 0); err != nil {
+		vmm.logger.Errorf("failed to abort the block pull of %s: %v", dev, err)
+	}
+	return fmt.Errorf("%w: block pull of %s still running after %v",
+		hypervisor.ErrTimeout, dev, vmm.blockJobTimeout)
+}
+
+// ListVMs lists the vms. The VMs are built out of a single bulk stats call
+// rather than domain by domain, their descriptions are cached.
+func (vmm VMManager) ListVMs(active, inactive bool) (_ []entity.VM, err error) {
+	defer classifyError(&err)
+
+	var flags libvirt.ConnectGetAllDomainStatsFlags
 	if active {
-		flags |= libvirt.CONNECT_LIST_DOMAINS_ACTIVE
+		flags |= libvirt.CONNECT_GET_ALL_DOMAINS_STATS_ACTIVE
 	}
 	if inactive {
-		flags |= libvirt.CONNECT_LIST_DOMAINS_INACTIVE
+		flags |= libvirt.CONNECT_GET_ALL_DOMAINS_STATS_INACTIVE
 	}
-	domains, err := vmm.conn.ListAllDomains(flags)
+	stats, err := vmm.conn.GetAllDomainStats(nil, vmStatsTypes, flags)
 	if err != nil {
-		return []entity.VM{}, fmt.Errorf("failed to list domains: %w", err)
+		return []entity.VM{}, fmt.Errorf("failed to get domain stats: %w", err)
 	}
-	for _, domain := range domains {
-		defer domain.Free()
+	for _, s := range stats {
+		defer s.Domain.Free()
 	}
-	vms := make([]entity.VM, 0, len(domains))
-	for _, domain := range domains {
-		id, err := domain.GetUUIDString()
+
+	// Only inactive domains have managed save images.
+	saved := map[string]bool{}
+	if inactive || !active {
+		saved, err = vmm.managedSaves()
 		if err != nil {
-			return []entity.VM{}, fmt.Errorf("failed to get domain id: %w", err)
+			return []entity.VM{}, err
 		}
-		vm, err := vmm.GetVM(id)
+	}
+
+	vms := make([]entity.VM, 0, len(stats))
+	for _, s := range stats {
+		vm, err := vmm.statsVM(s, false)
 		if err != nil {
 			return []entity.VM{}, err
 		}
+		vm.Saved = saved[vm.ID]
 		vms = append(vms, vm)
 	}
 
 	return vms, nil
 }
 
-// GetStats returns CPU and memory stats.
-func (vmm VMManager) GetStats(id string) (VMState, error) {
+// GetStats returns the usage rates computed out of the two latest samples
+// of the vm, without waiting.
+func (vmm VMManager) GetStats(id string) (_ entity.VMStats, err error) {
+	defer classifyError(&err)
 
-	domain, err := vmm.conn.LookupDomainByUUIDString(id)
-	if err != nil {
-		return VMState{}, err
+	if stats, ok := vmm.sampler.latest(id); ok {
+		return stats, nil
 	}
 
-	// Get CPU usage
-	cpuStart, err := domain.GetCPUStats(-1, 1, 0)
+	// Tell apart the vms which are not sampled from those not sampled yet.
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
-		return VMState{}, err
+		return entity.VMStats{}, err
 	}
-
-	startTime := cpuStart[0].CpuTime
-	time.Sleep(1 * time.Second)
-	cpuEnd, err := domain.GetCPUStats(-1, 1, 0)
+	defer domain.Free()
+	active, err := domain.IsActive()
 	if err != nil {
-		return VMState{}, err
+		return entity.VMStats{}, err
 	}
-	endTime := cpuEnd[0].CpuTime
-
-	info, err := domain.GetInfo()
-	if err != nil {
-		return VMState{}, err
+	if !active {
+		return entity.VMStats{}, fmt.Errorf("%w: domain is not running",
+			hypervisor.ErrOperationInvalid)
 	}
+	return entity.VMStats{}, hypervisor.ErrStatsNotReady
+}
 
-	// CPU usage percentage over the interval
-	cpuDelta := endTime - startTime // in nanoseconds
-	cpuUsage := float64(cpuDelta) / (1e9 * float64(info.NrVirtCpu)) * 100
+// GetMetrics returns the usage rates sampled for the vm between from and to,
+// averaged over windows of at most step out of the rollup tiers.
+func (vmm VMManager) GetMetrics(id string, from, to time.Time,
+	step time.Duration) (_ []entity.VMStats, err error) {
+	defer classifyError(&err)
 
-	// Memory Usage
-	memStats, err := domain.MemoryStats(11, 0)
-	if err != nil {
-		return VMState{}, err
+	if metrics, ok := vmm.sampler.history(id, from, to, step); ok {
+		return metrics, nil
 	}
-
-	var available, unused uint64
-	for _, stat := range memStats {
-		switch stat.Tag {
-		case int32(libvirt.DOMAIN_MEMORY_STAT_AVAILABLE):
-			available = stat.Val
-		case int32(libvirt.DOMAIN_MEMORY_STAT_UNUSED):
-			unused = stat.Val
-		}
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return nil, err
 	}
-
-	used := available - unused
-	memPercent := float64(used) / float64(available) * 100
-	return VMState{
-		CPUUsage:      cpuUsage,
-		MemoryPercent: memPercent,
-	}, nil
-
+	domain.Free()
+	return []entity.VMStats{}, nil
 }
 
 // ParseState parses the state of the vm.
@@ -466,41 +925,12 @@ func ParseState(state libvirt.DomainState) entity.VMStateType {
 
 // ResizeImage resizes the image.
 func (vmm VMManager) ResizeImage(image string, newSize int) error {
-	imgInfo, err := exec.Command("qemu-img", "info", image).CombinedOutput()
-	if err != nil {
-		return err
-	}
-	lines := strings.Split(string(imgInfo), "\n")
-	re := regexp.MustCompile(`^virtual size: (\d+)`)
-	var virtualSize string
-	for _, line := range lines {
-		if re.MatchString(line) {
-			matches := re.FindStringSubmatch(line)
-			virtualSize = matches[1]
-			break
-		}
-	}
-	size, err := strconv.Atoi(virtualSize)
-	if err != nil {
-		return err
-	}
-	var cmdStrings []string
-	if size < newSize {
-		cmdStrings = []string{"resize", image, strconv.Itoa(newSize) + "G"}
-	} else {
-		cmdStrings = []string{"resize", "--shrink", image, strconv.Itoa(newSize) + "G"}
-	}
-	cmd := exec.Command("qemu-img", cmdStrings...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		vmm.logger.Info(string(output))
-		return err
-	}
-	return nil
+	return vmm.images.Resize(image, newSize)
 }
 
 // GetVMDiskPaths returns local file-based disks.
-func (vmm VMManager) GetVMDiskPaths(id string) ([]string, error) {
+func (vmm VMManager) GetVMDiskPaths(id string) (_ []string, err error) {
+	defer classifyError(&err)
 
 	dom, err := vmm.conn.LookupDomainByUUIDString(id)
 	if err != nil {
@@ -528,20 +958,178 @@ func (vmm VMManager) GetVMDiskPaths(id string) ([]string, error) {
 	return diskPaths, nil
 }
 
-// copyFile copies the file.
-func copyFile(src, dst string) error {
-	srcFile, err := os.Open(src)
+// diskChain returns the disk along with the images of its backing chain
+// which belong to the vm, i.e. up to the base image it was created from.
+func (vmm VMManager) diskChain(disk string) ([]string, error) {
+
+	imgDir, err := filepath.Abs(vmm.imgDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer srcFile.Close()
-	dstFile, err := os.Create(dst)
+	images, err := vmm.ListImages()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	bases := make(map[string]bool, len(images))
+	for _, img := range images {
+		if path, err := filepath.Abs(vmm.imagePath(img)); err == nil {
+			bases[path] = true
+		}
 	}
-	defer dstFile.Close()
-	_, err = io.Copy(dstFile, srcFile)
+
+	// The length of the chain is bounded in case of a loop.
+	chain := []string{disk}
+	for path := disk; len(chain) < 64; {
+		info, err := vmm.images.Info(path)
+		if err != nil {
+			return nil, err
+		}
+		if info.BackingFile == "" || bases[info.BackingFile] ||
+			filepath.Dir(info.BackingFile) != imgDir {
+			break
+		}
+		path = info.BackingFile
+		chain = append(chain, path)
+	}
+	return chain, nil
+}
+
+// Overlays returns the images of the image directory which are backed by
+// the given image.
+func (vmm VMManager) Overlays(image string) ([]string, error) {
+
+	image, err := filepath.Abs(image)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(vmm.imgDir)
 	if err != nil {
+		return nil, err
+	}
+
+	var overlays []string
+	for _, entry := range entries {
+		path := filepath.Join(vmm.imgDir, entry.Name())
+		if !entry.Type().IsRegular() || path == image ||
+			strings.HasSuffix(path, imageMetadataSuffix) {
+			continue
+		}
+		info, err := vmm.images.Info(path)
+		if err != nil {
+			vmm.logger.Debugf("Could not inspect image %s: %v", path, err)
+			continue
+		}
+		if info.BackingFile == image {
+			overlays = append(overlays, path)
+		}
+	}
+	return overlays, nil
+}
+
+// OrphanedImages returns the files of the image directory which belong to
+// no domain and are not base images, e.g. the disks left behind by a crash
+// while creating a vm.
+func (vmm VMManager) OrphanedImages() (_ []string, err error) {
+	defer classifyError(&err)
+
+	owned := make(map[string]bool)
+	images, err := vmm.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		path, err := filepath.Abs(vmm.imagePath(img))
+		if err != nil {
+			return nil, err
+		}
+		owned[path] = true
+	}
+
+	domains, err := vmm.conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, domain := range domains {
+		files, err := vmm.domainFiles(&domain)
+		domain.Free()
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			owned[file] = true
+		}
+	}
+
+	entries, err := os.ReadDir(vmm.imgDir)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() ||
+			strings.HasSuffix(entry.Name(), imageMetadataSuffix) {
+			continue
+		}
+		path, err := filepath.Abs(filepath.Join(vmm.imgDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if !owned[path] {
+			orphans = append(orphans, path)
+		}
+	}
+	return orphans, nil
+}
+
+// domainFiles returns the absolute paths of the files the domain uses:
+// its disks and their backing chain, its CD-ROMs and the memory files of
+// its snapshots.
+func (vmm VMManager) domainFiles(domain *libvirt.Domain) ([]string, error) {
+
+	xmlDesc, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	var domCfg libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &domCfg); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	if domCfg.Devices != nil {
+		for _, disk := range domCfg.Devices.Disks {
+			if disk.Source == nil || disk.Source.File == nil {
+				continue
+			}
+			if disk.Device != "disk" {
+				files = append(files, disk.Source.File.File)
+				continue
+			}
+			chain, err := vmm.diskChain(disk.Source.File.File)
+			if err != nil {
+				vmm.logger.Debugf("Could not inspect disk %s: %v", disk.Source.File.File, err)
+				chain = []string{disk.Source.File.File}
+			}
+			files = append(files, chain...)
+		}
+	}
+	memFiles, err := snapshotMemoryFiles(domain)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, memFiles...)
+
+	for i, file := range files {
+		if files[i], err = filepath.Abs(file); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// removeFile removes a file, which may not exist.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
@@ -0,0 +1,254 @@
+package vmmgr
+
+import (
+	"encoding/xml"
+	"fmt"
+	"maps"
+	"sync"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"libvirt.org/go/libvirt"
+)
+
+// vmStatsTypes are the statistics groups the VMs are built from.
+const vmStatsTypes = libvirt.DOMAIN_STATS_STATE | libvirt.DOMAIN_STATS_VCPU |
+	libvirt.DOMAIN_STATS_BALLOON | libvirt.DOMAIN_STATS_BLOCK
+
+// description holds the details of a VM which are only found in the domain
+// XML. They seldom change, which makes them worth caching: listing VMs then
+// takes a single bulk stats call instead of several calls per domain.
+type description struct {
+	vm    entity.VM // Image, labels, I/O limits and maximum resources
+	disk  string    // Target of the main disk, e.g. sda
+	vcpus uint      // vCPUs the domain boots with
+}
+
+// descriptionCache caches the descriptions of the domains by UUID. Entries
+// are dropped when the domain is redefined, undefined or tuned.
+type descriptionCache struct {
+	mu    sync.RWMutex
+	descs map[string]description
+}
+
+func newDescriptionCache() *descriptionCache {
+	return &descriptionCache{descs: make(map[string]description)}
+}
+
+func (c *descriptionCache) get(id string) (description, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	desc, ok := c.descs[id]
+	return desc, ok
+}
+
+func (c *descriptionCache) put(id string, desc description) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.descs[id] = desc
+}
+
+func (c *descriptionCache) drop(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.descs, id)
+}
+
+// forget drops the cached description of the domain.
+func (vmm VMManager) forget(d *libvirt.Domain) {
+	if id, err := d.GetUUIDString(); err == nil {
+		vmm.descs.drop(id)
+	}
+}
+
+// describe parses the description of the domain out of its XML.
+func describe(domain *libvirt.Domain) (description, error) {
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return description{}, err
+	}
+
+	type Domain struct {
+		Metadata struct {
+			Instance domainMetadata
+		} `xml:"metadata"`
+		Memory uint `xml:"memory"` // In KiB
+		VCPU   struct {
+			Current uint `xml:"current,attr"`
+			Value   uint `xml:",chardata"`
+		} `xml:"vcpu"`
+		Devices struct {
+			Disks []struct {
+				Device string `xml:"device,attr"`
+				Target struct {
+					Dev string `xml:"dev,attr"`
+				} `xml:"target"`
+				IOTune struct {
+					TotalBytesSec uint64 `xml:"total_bytes_sec"`
+					ReadBytesSec  uint64 `xml:"read_bytes_sec"`
+					WriteBytesSec uint64 `xml:"write_bytes_sec"`
+					TotalIopsSec  uint64 `xml:"total_iops_sec"`
+					ReadIopsSec   uint64 `xml:"read_iops_sec"`
+					WriteIopsSec  uint64 `xml:"write_iops_sec"`
+				} `xml:"iotune"`
+			} `xml:"disk"`
+		} `xml:"devices"`
+	}
+
+	var dom Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &dom); err != nil {
+		return description{}, err
+	}
+
+	var desc description
+	desc.vm.Image = dom.Metadata.Instance.Image
+	desc.vm.MaxCPU = dom.VCPU.Value
+	desc.vm.MaxMemory = dom.Memory / 1024
+	desc.vcpus = dom.VCPU.Current
+	if desc.vcpus == 0 {
+		desc.vcpus = dom.VCPU.Value
+	}
+	if labels := dom.Metadata.Instance.Labels; len(labels) > 0 {
+		desc.vm.Labels = make(map[string]string, len(labels))
+		for _, label := range labels {
+			desc.vm.Labels[label.Key] = label.Value
+		}
+	}
+	for _, disk := range dom.Devices.Disks {
+		if disk.Device != "disk" {
+			continue
+		}
+		desc.disk = disk.Target.Dev
+		desc.vm.ReadBytesSec = disk.IOTune.ReadBytesSec / 1024 / 1024
+		desc.vm.WriteBytesSec = disk.IOTune.WriteBytesSec / 1024 / 1024
+		desc.vm.TotalBytesSec = disk.IOTune.TotalBytesSec / 1024 / 1024
+		desc.vm.ReadIopsSec = disk.IOTune.ReadIopsSec
+		desc.vm.WriteIopsSec = disk.IOTune.WriteIopsSec
+		desc.vm.TotalIopsSec = disk.IOTune.TotalIopsSec
+		break
+	}
+	return desc, nil
+}
+
+// description returns the description of the domain, from the cache unless
+// fresh is set.
+func (vmm VMManager) description(domain *libvirt.Domain, id string,
+	fresh bool) (description, error) {
+
+	if !fresh {
+		if desc, ok := vmm.descs.get(id); ok {
+			return desc, nil
+		}
+	}
+	desc, err := describe(domain)
+	if err != nil {
+		return description{}, err
+	}
+	vmm.descs.put(id, desc)
+	return desc, nil
+}
+
+// statsVM builds the VM out of the statistics of its domain and its
+// description. Drivers which do not report some of the statistics are
+// queried for them domain by domain.
+func (vmm VMManager) statsVM(stats libvirt.DomainStats, fresh bool) (entity.VM, error) {
+	domain := stats.Domain
+	id, err := domain.GetUUIDString()
+	if err != nil {
+		return entity.VM{}, fmt.Errorf("failed to get domain id: %w", err)
+	}
+	desc, err := vmm.description(domain, id, fresh)
+	if err != nil {
+		return entity.VM{}, err
+	}
+
+	vm := desc.vm
+	vm.Labels = maps.Clone(desc.vm.Labels)
+	vm.ID = id
+	vm.Name, err = domain.GetName()
+	if err != nil {
+		return entity.VM{}, err
+	}
+
+	if stats.State != nil && stats.State.StateSet {
+		vm.State = ParseState(stats.State.State)
+	} else {
+		state, _, err := domain.GetState()
+		if err != nil {
+			return entity.VM{}, err
+		}
+		vm.State = ParseState(state)
+	}
+
+	vm.CPU = countVcpus(stats.Vcpu)
+	// Inactive domains report their maximum vCPUs instead.
+	if (vm.State == entity.VMStateShutOff || vm.State == entity.VMStateCrashed) &&
+		desc.vcpus > 0 {
+		vm.CPU = desc.vcpus
+	}
+	if stats.Balloon != nil && stats.Balloon.CurrentSet {
+		vm.Memory = uint(stats.Balloon.Current) / 1024
+	}
+	if vm.CPU == 0 || vm.Memory == 0 {
+		info, err := domain.GetInfo()
+		if err != nil {
+			return entity.VM{}, err
+		}
+		vm.CPU = info.NrVirtCpu
+		vm.Memory = uint(info.Memory) / 1024
+	}
+
+	if desc.disk != "" {
+		capacity, ok := blockCapacity(stats.Block, desc.disk)
+		if !ok {
+			info, err := domain.GetBlockInfo(desc.disk, 0)
+			if err != nil {
+				vmm.logger.Debugf("Could not get info for %s: %v", desc.disk, err)
+			}
+			capacity = info.Capacity
+		}
+		vm.Disk = capacity / (1 << 30)
+	}
+
+	return vm, nil
+}
+
+// countVcpus returns the number of vCPUs online.
+func countVcpus(vcpus []libvirt.DomainStatsVcpu) uint {
+	var count uint
+	for _, vcpu := range vcpus {
+		if vcpu.State != libvirt.VCPU_OFFLINE {
+			count++
+		}
+	}
+	// The vCPUs of inactive domains are all reported offline.
+	if count == 0 {
+		return uint(len(vcpus))
+	}
+	return count
+}
+
+// blockCapacity returns the capacity of the disk dev.
+func blockCapacity(blocks []libvirt.DomainStatsBlock, dev string) (uint64, bool) {
+	for _, block := range blocks {
+		if block.Name == dev && block.CapacitySet {
+			return block.Capacity, true
+		}
+	}
+	return 0, false
+}
+
+// managedSaves returns the IDs of the domains with a managed save image.
+func (vmm VMManager) managedSaves() (map[string]bool, error) {
+	domains, err := vmm.conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_MANAGEDSAVE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list saved domains: %w", err)
+	}
+	saved := make(map[string]bool, len(domains))
+	for _, domain := range domains {
+		if id, err := domain.GetUUIDString(); err == nil {
+			saved[id] = true
+		}
+		domain.Free()
+	}
+	return saved, nil
+}
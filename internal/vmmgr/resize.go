@@ -0,0 +1,131 @@
+package vmmgr
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"libvirt.org/go/libvirtxml"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"libvirt.org/go/libvirt"
+)
+
+// headroomFor returns the maximum vCPUs and memory, in MiB, of the vm: the
+// ones requested grown by the headroom, within the resources of the host.
+func (vmm VMManager) headroomFor(vm entity.VM) (maxCPU, maxMemory uint, err error) {
+	info, err := vmm.conn.GetNodeInfo()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get node info: %w", err)
+	}
+	maxCPU = max(vm.CPU, min(vm.CPU*vmm.headroom, info.Cpus))
+	maxMemory = max(vm.Memory, min(vm.Memory*vmm.headroom, uint(info.Memory/1024)))
+	return maxCPU, maxMemory, nil
+}
+
+// ResizeVM changes the vCPUs and memory, in MiB, of the vm, zero leaves
+// them unchanged. The definition of the vm is updated, and so is the vm
+// when it runs unless the change exceeds its maximum or the hypervisor
+// cannot apply it live: a reboot is then required.
+func (vmm VMManager) ResizeVM(id string, cpu, memory uint) (rebootRequired bool, err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(id)
+	if err != nil {
+		return false, err
+	}
+	defer domain.Free()
+	defer vmm.descs.drop(id)
+
+	active, err := domain.IsActive()
+	if err != nil {
+		return false, err
+	}
+	xmlDesc, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return false, err
+	}
+	var domCfg libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &domCfg); err != nil {
+		return false, fmt.Errorf("failed to unmarshal domain XML: %w", err)
+	}
+
+	if cpu > 0 {
+		reboot, err := vmm.resizeVcpus(domain, id, cpu, domCfg.VCPU, active)
+		if err != nil {
+			return false, err
+		}
+		rebootRequired = rebootRequired || reboot
+	}
+	if memory > 0 {
+		reboot, err := vmm.resizeMemory(domain, id, uint64(memory)*1024, domCfg.Memory, active)
+		if err != nil {
+			return rebootRequired, err
+		}
+		rebootRequired = rebootRequired || reboot
+	}
+	return rebootRequired, nil
+}
+
+// resizeVcpus sets the vCPUs of the domain, raising its maximum when needed.
+func (vmm VMManager) resizeVcpus(domain *libvirt.Domain, id string, cpu uint,
+	cfg *libvirtxml.DomainVCPU, active bool) (rebootRequired bool, err error) {
+
+	if cfg == nil || cpu > cfg.Value {
+		err := domain.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := domain.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_CONFIG); err != nil {
+		return false, err
+	}
+	if !active {
+		return false, nil
+	}
+
+	maxCPU, err := domain.GetVcpusFlags(libvirt.DOMAIN_VCPU_LIVE | libvirt.DOMAIN_VCPU_MAXIMUM)
+	if err != nil {
+		return false, err
+	}
+	if cpu > uint(maxCPU) {
+		return true, nil
+	}
+	if err := domain.SetVcpusFlags(cpu, libvirt.DOMAIN_VCPU_LIVE); err != nil {
+		vmm.logger.Infof("Could not set the vCPUs of %s live: %v", id, err)
+		return true, nil
+	}
+	return false, nil
+}
+
+// resizeMemory sets the memory of the domain, in KiB, raising its maximum
+// when needed. The memory of a running domain is changed by its balloon.
+func (vmm VMManager) resizeMemory(domain *libvirt.Domain, id string, memory uint64,
+	cfg *libvirtxml.DomainMemory, active bool) (rebootRequired bool, err error) {
+
+	// Libvirt always reports the memory in KiB.
+	if cfg == nil || memory > uint64(cfg.Value) {
+		err := domain.SetMemoryFlags(memory, libvirt.DOMAIN_MEM_CONFIG|libvirt.DOMAIN_MEM_MAXIMUM)
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := domain.SetMemoryFlags(memory, libvirt.DOMAIN_MEM_CONFIG); err != nil {
+		return false, err
+	}
+	if !active {
+		return false, nil
+	}
+
+	maxMemory, err := domain.GetMaxMemory()
+	if err != nil {
+		return false, err
+	}
+	if memory > maxMemory {
+		return true, nil
+	}
+	if err := domain.SetMemoryFlags(memory, libvirt.DOMAIN_MEM_LIVE); err != nil {
+		vmm.logger.Infof("Could not set the memory of %s live: %v", id, err)
+		return true, nil
+	}
+	return false, nil
+}
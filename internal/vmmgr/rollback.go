@@ -0,0 +1,36 @@
+package vmmgr
+
+import (
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+)
+
+// rollbackStep undoes a step of an operation.
+type rollbackStep struct {
+	desc string
+	undo func() error
+}
+
+// rollback holds the compensating actions of the steps an operation has
+// completed so far, so that a failing operation leaves nothing behind.
+type rollback struct {
+	logger log.Logger
+	steps  []rollbackStep
+}
+
+// add registers the action undoing the step which just completed.
+func (r *rollback) add(desc string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{desc, undo})
+}
+
+// run undoes the completed steps in reverse order. Failures are logged, the
+// remaining steps are undone regardless.
+func (r *rollback) run() {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		r.logger.Infof("Rolling back: %s", step.desc)
+		if err := step.undo(); err != nil {
+			r.logger.Errorf("failed to roll back %s: %v", step.desc, err)
+		}
+	}
+	r.steps = nil
+}
@@ -0,0 +1,90 @@
+package vmmgr
+
+import (
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+)
+
+const (
+	// Default periods for which the usage of the VMs averaged over a minute
+	// and over five minutes is kept.
+	defaultRollup1mRetention = 24 * time.Hour
+	defaultRollup5mRetention = 7 * 24 * time.Hour
+)
+
+// rollup is a tier of the usage history: the rates averaged over windows of
+// resolution, kept for longer than the sampled ones.
+type rollup struct {
+	resolution time.Duration
+	retention  time.Duration
+}
+
+// size returns the number of points kept per domain.
+func (r rollup) size() int {
+	return max(int(r.retention/r.resolution), 1)
+}
+
+// rollupSeries holds the usage history of a domain in a rollup tier along
+// with the rates of the window in progress.
+type rollupSeries struct {
+	points *ring
+	window time.Time // Start of the window in progress
+	sum    entity.VMStats
+	count  int
+}
+
+// add accounts for a point, the window in progress is completed once a
+// point falls in the next one.
+func (r *rollupSeries) add(p entity.VMStats, resolution time.Duration) {
+	window := p.Timestamp.Truncate(resolution)
+	if r.count > 0 && !window.Equal(r.window) {
+		r.flush()
+	}
+	r.window = window
+	r.sum.Interval += p.Interval
+	r.sum.CPUUsage += p.CPUUsage
+	r.sum.MemoryPercent += p.MemoryPercent
+	r.sum.DiskReadBytesSec += p.DiskReadBytesSec
+	r.sum.DiskWriteBytesSec += p.DiskWriteBytesSec
+	r.sum.DiskReadIOPS += p.DiskReadIOPS
+	r.sum.DiskWriteIOPS += p.DiskWriteIOPS
+	r.sum.NetRxBytesSec += p.NetRxBytesSec
+	r.sum.NetTxBytesSec += p.NetTxBytesSec
+	r.sum.NetRxPacketsSec += p.NetRxPacketsSec
+	r.sum.NetTxPacketsSec += p.NetTxPacketsSec
+	r.count++
+}
+
+// flush completes the window in progress, its average is added to the
+// history.
+func (r *rollupSeries) flush() {
+	if avg, ok := r.average(); ok {
+		r.points.push(avg)
+	}
+	r.sum, r.count = entity.VMStats{}, 0
+}
+
+// average returns the average of the points of the window in progress,
+// stamped with its start. The interval is the time the points cover. ok is
+// false when no window is in progress.
+func (r *rollupSeries) average() (_ entity.VMStats, ok bool) {
+	if r.count == 0 {
+		return entity.VMStats{}, false
+	}
+	n := float64(r.count)
+	return entity.VMStats{
+		Timestamp:         r.window,
+		Interval:          r.sum.Interval,
+		CPUUsage:          r.sum.CPUUsage / n,
+		MemoryPercent:     r.sum.MemoryPercent / n,
+		DiskReadBytesSec:  r.sum.DiskReadBytesSec / n,
+		DiskWriteBytesSec: r.sum.DiskWriteBytesSec / n,
+		DiskReadIOPS:      r.sum.DiskReadIOPS / n,
+		DiskWriteIOPS:     r.sum.DiskWriteIOPS / n,
+		NetRxBytesSec:     r.sum.NetRxBytesSec / n,
+		NetTxBytesSec:     r.sum.NetTxBytesSec / n,
+		NetRxPacketsSec:   r.sum.NetRxPacketsSec / n,
+		NetTxPacketsSec:   r.sum.NetTxPacketsSec / n,
+	}, true
+}
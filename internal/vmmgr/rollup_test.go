@@ -0,0 +1,67 @@
+package vmmgr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler_HistoryRollups(t *testing.T) {
+	s := newSampler(nil, nil, 10*time.Second, time.Hour, 0, 0)
+	ser := s.newSeries()
+	s.series["vm"] = ser
+
+	// Two hours and a half of samples, from 3h ago.
+	start := time.Now().Add(-3 * time.Hour).Truncate(5 * time.Minute)
+	for ts := start; ts.Before(start.Add(150 * time.Minute)); ts = ts.Add(10 * time.Second) {
+		p := entity.VMStats{Timestamp: ts, Interval: 10, CPUUsage: float64(ts.Sub(start) / time.Minute)}
+		ser.points.push(p)
+		for i, r := range ser.rollups {
+			r.add(p, s.rollups[i].resolution)
+		}
+	}
+	assert.Equal(t, 360, ser.points.len())
+	assert.Equal(t, 149, ser.rollups[0].points.len())
+	assert.Equal(t, 29, ser.rollups[1].points.len())
+
+	to := time.Now()
+	recent := start.Add(130 * time.Minute)
+	points, ok := s.history("vm", recent, to, 0)
+	assert.True(t, ok)
+	assert.Len(t, points, 120)
+
+	// Minutes averaged out of their samples, the last window in progress.
+	points, _ = s.history("vm", recent, to, time.Minute)
+	if assert.Len(t, points, 20) {
+		assert.Equal(t, recent, points[0].Timestamp)
+		assert.Equal(t, 130.0, points[0].CPUUsage)
+		assert.Equal(t, 60.0, points[0].Interval)
+		assert.Equal(t, 149.0, points[19].CPUUsage)
+	}
+	points, _ = s.history("vm", recent, to, 10*time.Minute)
+	if assert.Len(t, points, 4) {
+		assert.Equal(t, 132.0, points[0].CPUUsage)
+		assert.Equal(t, 300.0, points[0].Interval)
+	}
+
+	// Past the retention of the samples, the minutes are returned.
+	points, _ = s.history("vm", start, to, 0)
+	assert.Len(t, points, 150)
+
+	_, ok = s.history("other", start, to, 0)
+	assert.False(t, ok)
+}
+
+func TestRing(t *testing.T) {
+	r := newRing(3)
+	assert.Equal(t, 0, r.len())
+	for i := 0; i < 5; i++ {
+		r.push(entity.VMStats{CPUUsage: float64(i)})
+	}
+	assert.Equal(t, 3, r.len())
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, float64(i+2), r.at(i).CPUUsage)
+	}
+}
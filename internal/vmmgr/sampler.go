@@ -0,0 +1,545 @@
+package vmmgr
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/pkg/log"
+	"libvirt.org/go/libvirt"
+)
+
+const (
+	// Default period between two samples of the domains.
+	defaultStatsInterval = 10 * time.Second
+	// Default period for which the usage of the VMs is kept.
+	defaultStatsRetention = time.Hour
+
+	// Statistics groups sampled for the running domains.
+	samplerStatsTypes = libvirt.DOMAIN_STATS_CPU_TOTAL | libvirt.DOMAIN_STATS_VCPU |
+		libvirt.DOMAIN_STATS_BALLOON | libvirt.DOMAIN_STATS_BLOCK |
+		libvirt.DOMAIN_STATS_INTERFACE
+)
+
+// sample holds the counters of a domain at a point in time. Rates are
+// computed out of two consecutive samples.
+type sample struct {
+	time      time.Time
+	cpuTime   uint64 // In nanoseconds
+	vcpus     uint
+	vcpuTimes []vcpuSample
+	memActual uint64 // In KiB
+	memRSS    uint64 // In KiB
+	// The following are only reported by the balloon driver of the guest.
+	guestMem     bool
+	memAvailable uint64 // In KiB
+	memUsable    uint64 // In KiB
+	memUnused    uint64 // In KiB
+	swapIn       uint64 // In KiB
+	swapOut      uint64 // In KiB
+	majorFaults  uint64
+	blocks       []blockSample
+	nets         []netSample
+}
+
+// vcpuSample holds the time consumed by an online vCPU.
+type vcpuSample struct {
+	id   uint
+	time uint64 // In nanoseconds
+}
+
+// blockSample holds the I/O counters of a disk.
+type blockSample struct {
+	name    string
+	rdBytes uint64
+	wrBytes uint64
+	rdReqs  uint64
+	wrReqs  uint64
+	rdTimes uint64 // In nanoseconds
+	wrTimes uint64 // In nanoseconds
+}
+
+// netSample holds the traffic counters of a network interface.
+type netSample struct {
+	name    string
+	rxBytes uint64
+	txBytes uint64
+	rxPkts  uint64
+	txPkts  uint64
+	rxErrs  uint64
+	txErrs  uint64
+	rxDrop  uint64
+	txDrop  uint64
+}
+
+// ring is a fixed size buffer of the usage rates of a VM, the oldest are
+// overwritten once it is full. It grows as points are added, so that the
+// long retention tiers only take memory once filled.
+type ring struct {
+	points []entity.VMStats
+	size   int
+	next   int
+}
+
+func newRing(size int) *ring {
+	return &ring{size: size}
+}
+
+// push adds a point, overwriting the oldest one when full.
+func (r *ring) push(p entity.VMStats) {
+	if len(r.points) < r.size {
+		r.points = append(r.points, p)
+		return
+	}
+	r.points[r.next] = p
+	r.next = (r.next + 1) % r.size
+}
+
+// len returns the number of points held.
+func (r *ring) len() int {
+	return len(r.points)
+}
+
+// at returns the i-th point, from the oldest.
+func (r *ring) at(i int) entity.VMStats {
+	if len(r.points) == r.size {
+		i = (r.next + i) % r.size
+	}
+	return r.points[i]
+}
+
+// series holds the usage history of a domain.
+type series struct {
+	// Latest sample, nil when the domain was not running at the latest
+	// collection: rates are never computed across a restart.
+	last *sample
+	// Latest rates along with the rates by device, nil until two samples
+	// were collected since the domain started.
+	current *entity.VMStats
+	points  *ring
+	// History by rollup tier, in the order of the tiers of the sampler.
+	rollups []*rollupSeries
+}
+
+// sampler periodically collects the counters of the running domains with a
+// single bulk stats call, and keeps the usage rates computed out of them for
+// the retention period. The rates are also rolled up into tiers of coarser
+// resolution kept for longer. The history of a VM outlives its shutdown, not
+// a restart of the process as it is only held in memory.
+type sampler struct {
+	logger    log.Logger
+	conn      *libvirt.Connect
+	interval  time.Duration
+	retention time.Duration
+	rollups   []rollup // By increasing resolution
+
+	mu     sync.RWMutex
+	series map[string]*series // By domain UUID
+}
+
+func newSampler(logger log.Logger, conn *libvirt.Connect, interval,
+	retention, rollup1mRetention, rollup5mRetention time.Duration) *sampler {
+
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+	if retention <= 0 {
+		retention = defaultStatsRetention
+	}
+	if rollup1mRetention <= 0 {
+		rollup1mRetention = defaultRollup1mRetention
+	}
+	if rollup5mRetention <= 0 {
+		rollup5mRetention = defaultRollup5mRetention
+	}
+	return &sampler{
+		logger:    logger,
+		conn:      conn,
+		interval:  interval,
+		retention: retention,
+		rollups: []rollup{
+			{time.Minute, rollup1mRetention},
+			{5 * time.Minute, rollup5mRetention},
+		},
+		series: make(map[string]*series),
+	}
+}
+
+// balloonPeriod returns the period in seconds at which the guests are to
+// report their memory usage, it matches the sampling interval.
+func (s *sampler) balloonPeriod() int {
+	return max(int(s.interval.Seconds()), 1)
+}
+
+// size returns the number of points kept per domain.
+func (s *sampler) size() int {
+	return max(int(s.retention/s.interval), 1)
+}
+
+// keep returns the period for which the history of a domain is kept once
+// it stopped, that of the tier kept the longest.
+func (s *sampler) keep() time.Duration {
+	keep := s.retention
+	for _, r := range s.rollups {
+		keep = max(keep, r.retention)
+	}
+	return keep
+}
+
+// newSeries returns an empty history.
+func (s *sampler) newSeries() *series {
+	ser := &series{points: newRing(s.size())}
+	for _, r := range s.rollups {
+		ser.rollups = append(ser.rollups, &rollupSeries{points: newRing(r.size())})
+	}
+	return ser
+}
+
+// run samples the domains every interval until ctx is done, it closes done
+// once it returns.
+func (s *sampler) run(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	s.collect()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.collect()
+		}
+	}
+}
+
+// collect samples the running domains.
+func (s *sampler) collect() {
+	stats, err := s.conn.GetAllDomainStats(nil, samplerStatsTypes,
+		libvirt.CONNECT_GET_ALL_DOMAINS_STATS_RUNNING|
+			libvirt.CONNECT_GET_ALL_DOMAINS_STATS_PAUSED)
+	if err != nil {
+		s.logger.Errorf("failed to sample domain stats: %v", err)
+		return
+	}
+	now := time.Now()
+
+	samples := make(map[string]sample, len(stats))
+	for _, st := range stats {
+		id, err := st.Domain.GetUUIDString()
+		if err != nil {
+			s.logger.Errorf("failed to get domain id: %v", err)
+			st.Domain.Free()
+			continue
+		}
+		smp := newSample(now, st)
+		if !smp.guestMem && s.started(id) {
+			s.enableBalloonStats(st.Domain, id)
+		}
+		st.Domain.Free()
+		samples[id] = smp
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, ser := range s.series {
+		if _, ok := samples[id]; ok {
+			continue
+		}
+		ser.last, ser.current = nil, nil
+		for _, r := range ser.rollups {
+			r.flush()
+		}
+		// Forget the domains which stopped, or are gone, for long enough.
+		if ser.points.len() == 0 ||
+			now.Sub(ser.points.at(ser.points.len()-1).Timestamp) > s.keep() {
+			delete(s.series, id)
+		}
+	}
+	for id, smp := range samples {
+		ser, ok := s.series[id]
+		if !ok {
+			ser = s.newSeries()
+			s.series[id] = ser
+		}
+		if ser.last != nil {
+			stats := rates(*ser.last, smp)
+			ser.current = &stats
+			// The history only holds the rates of the domain as a whole.
+			point := stats
+			point.Memory, point.Disks, point.Interfaces, point.Vcpus = nil, nil, nil, nil
+			ser.points.push(point)
+			for i, r := range ser.rollups {
+				r.add(point, s.rollups[i].resolution)
+			}
+		}
+		ser.last = &smp
+	}
+}
+
+// started tells whether the domain was not running at the previous
+// collection.
+func (s *sampler) started(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ser, ok := s.series[id]
+	return !ok || ser.last == nil
+}
+
+// enableBalloonStats asks the balloon driver of the guest to report its
+// memory usage. Domains defined with a stats period already do, this is
+// for the other ones. Guests without a balloon driver never report it.
+func (s *sampler) enableBalloonStats(domain *libvirt.Domain, id string) {
+	err := domain.SetMemoryStatsPeriod(s.balloonPeriod(), libvirt.DOMAIN_MEM_LIVE)
+	if err != nil {
+		s.logger.Debugf("failed to set the memory stats period of %s: %v", id, err)
+	}
+}
+
+// newSample extracts the counters out of the stats of a domain.
+func newSample(now time.Time, st libvirt.DomainStats) sample {
+	smp := sample{time: now, vcpus: countVcpus(st.Vcpu)}
+	if st.Cpu != nil {
+		smp.cpuTime = st.Cpu.Time
+	}
+	if b := st.Balloon; b != nil {
+		smp.memActual = b.Current
+		smp.memRSS = b.Rss
+		// The usable memory is a better estimate than the unused one, as it
+		// accounts for the caches, but older guests do not report it.
+		if b.AvailableSet && b.Available > 0 && (b.UsableSet || b.UnusedSet) {
+			smp.guestMem = true
+			smp.memAvailable = b.Available
+			smp.memUnused = b.Unused
+			smp.memUsable = b.Unused
+			if b.UsableSet {
+				smp.memUsable = b.Usable
+			}
+			smp.swapIn = b.SwapIn
+			smp.swapOut = b.SwapOut
+			smp.majorFaults = b.MajorFault
+		}
+	}
+	for i, v := range st.Vcpu {
+		if v.TimeSet && v.State != libvirt.VCPU_OFFLINE {
+			smp.vcpuTimes = append(smp.vcpuTimes, vcpuSample{id: uint(i), time: v.Time})
+		}
+	}
+	for _, b := range st.Block {
+		smp.blocks = append(smp.blocks, blockSample{
+			name:    b.Name,
+			rdBytes: b.RdBytes,
+			wrBytes: b.WrBytes,
+			rdReqs:  b.RdReqs,
+			wrReqs:  b.WrReqs,
+			rdTimes: b.RdTimes,
+			wrTimes: b.WrTimes,
+		})
+	}
+	for _, n := range st.Net {
+		smp.nets = append(smp.nets, netSample{
+			name:    n.Name,
+			rxBytes: n.RxBytes,
+			txBytes: n.TxBytes,
+			rxPkts:  n.RxPkts,
+			txPkts:  n.TxPkts,
+			rxErrs:  n.RxErrs,
+			txErrs:  n.TxErrs,
+			rxDrop:  n.RxDrop,
+			txDrop:  n.TxDrop,
+		})
+	}
+	return smp
+}
+
+// memoryPercent returns the memory used in percent, as reported by the guest
+// when it does, and as the resident memory of the VM process out of the
+// balloon size otherwise. The source is empty when neither is known.
+func (smp sample) memoryPercent() (_ float64, source string) {
+	if smp.guestMem {
+		if smp.memUsable > smp.memAvailable {
+			return 0, entity.MemoryStatsGuest
+		}
+		used := smp.memAvailable - smp.memUsable
+		return float64(used) / float64(smp.memAvailable) * 100, entity.MemoryStatsGuest
+	}
+	if smp.memActual > 0 && smp.memRSS > 0 {
+		// The process also holds the memory of the emulator itself.
+		return min(float64(smp.memRSS)/float64(smp.memActual)*100, 100),
+			entity.MemoryStatsHost
+	}
+	return 0, ""
+}
+
+// latest returns the latest rates of the domain, ok is false unless the
+// domain is running and was sampled twice.
+func (s *sampler) latest(id string) (_ entity.VMStats, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ser, ok := s.series[id]
+	if !ok || ser.current == nil {
+		return entity.VMStats{}, false
+	}
+	return *ser.current, true
+}
+
+// history returns the rates of the domain between from and to, oldest
+// first. They are read from the coarsest tier whose resolution is at most
+// step, or from a coarser one when the history goes back further than from
+// only there. ok is false when the domain was never sampled.
+func (s *sampler) history(id string, from, to time.Time, step time.Duration) (
+	_ []entity.VMStats, ok bool) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ser, ok := s.series[id]
+	if !ok {
+		return nil, false
+	}
+
+	tier, retention := -1, s.retention
+	horizon := time.Now().Add(-retention)
+	for i, r := range s.rollups {
+		if r.resolution <= step || (horizon.After(from) && r.retention > retention) {
+			tier, retention = i, r.retention
+			horizon = time.Now().Add(-retention)
+		}
+	}
+	history := ser.points
+	if tier >= 0 {
+		history = ser.rollups[tier].points
+	}
+
+	points := []entity.VMStats{}
+	for i := 0; i < history.len(); i++ {
+		p := history.at(i)
+		if !p.Timestamp.Before(from) && !p.Timestamp.After(to) {
+			points = append(points, p)
+		}
+	}
+	// The window in progress is averaged out of the points so far.
+	if tier >= 0 {
+		if p, ok := ser.rollups[tier].average(); ok &&
+			!p.Timestamp.Before(from) && !p.Timestamp.After(to) {
+			points = append(points, p)
+		}
+	}
+	return points, true
+}
+
+// rates computes the usage of a domain between two samples.
+func rates(prev, cur sample) entity.VMStats {
+	interval := cur.time.Sub(prev.time).Seconds()
+	stats := entity.VMStats{
+		Timestamp: cur.time,
+		Interval:  interval,
+	}
+	if interval <= 0 {
+		return stats
+	}
+
+	if cur.vcpus > 0 {
+		stats.CPUUsage = float64(delta(prev.cpuTime, cur.cpuTime)) /
+			(1e9 * interval * float64(cur.vcpus)) * 100
+	}
+
+	rate := func(prev, cur uint64) float64 {
+		return float64(delta(prev, cur)) / interval
+	}
+
+	var source string
+	stats.MemoryPercent, source = cur.memoryPercent()
+	if source != "" {
+		stats.Memory = &entity.MemoryStats{
+			Source:      source,
+			ActualBytes: cur.memActual * 1024,
+			RSSBytes:    cur.memRSS * 1024,
+		}
+	}
+	if cur.guestMem {
+		stats.Memory.AvailableBytes = cur.memAvailable * 1024
+		stats.Memory.UsableBytes = cur.memUsable * 1024
+		stats.Memory.UnusedBytes = cur.memUnused * 1024
+		if prev.guestMem {
+			stats.Memory.SwapInBytesSec = rate(prev.swapIn, cur.swapIn) * 1024
+			stats.Memory.SwapOutBytesSec = rate(prev.swapOut, cur.swapOut) * 1024
+			stats.Memory.MajorFaultsSec = rate(prev.majorFaults, cur.majorFaults)
+		}
+	}
+
+	for _, v := range cur.vcpuTimes {
+		for _, p := range prev.vcpuTimes {
+			if p.id != v.id {
+				continue
+			}
+			stats.Vcpus = append(stats.Vcpus, entity.VcpuStats{
+				ID:    v.id,
+				Usage: rate(p.time, v.time) / 1e9 * 100,
+			})
+		}
+	}
+	for _, b := range cur.blocks {
+		for _, p := range prev.blocks {
+			if p.name != b.name {
+				continue
+			}
+			disk := entity.DiskStats{
+				Device:         b.name,
+				ReadBytesSec:   rate(p.rdBytes, b.rdBytes),
+				WriteBytesSec:  rate(p.wrBytes, b.wrBytes),
+				ReadIOPS:       rate(p.rdReqs, b.rdReqs),
+				WriteIOPS:      rate(p.wrReqs, b.wrReqs),
+				ReadLatencyMs:  latency(p.rdTimes, b.rdTimes, p.rdReqs, b.rdReqs),
+				WriteLatencyMs: latency(p.wrTimes, b.wrTimes, p.wrReqs, b.wrReqs),
+			}
+			stats.Disks = append(stats.Disks, disk)
+			stats.DiskReadBytesSec += disk.ReadBytesSec
+			stats.DiskWriteBytesSec += disk.WriteBytesSec
+			stats.DiskReadIOPS += disk.ReadIOPS
+			stats.DiskWriteIOPS += disk.WriteIOPS
+		}
+	}
+	for _, n := range cur.nets {
+		for _, p := range prev.nets {
+			if p.name != n.name {
+				continue
+			}
+			iface := entity.InterfaceStats{
+				Name:         n.name,
+				RxBytesSec:   rate(p.rxBytes, n.rxBytes),
+				TxBytesSec:   rate(p.txBytes, n.txBytes),
+				RxPacketsSec: rate(p.rxPkts, n.rxPkts),
+				TxPacketsSec: rate(p.txPkts, n.txPkts),
+				RxDropsSec:   rate(p.rxDrop, n.rxDrop),
+				TxDropsSec:   rate(p.txDrop, n.txDrop),
+				RxErrorsSec:  rate(p.rxErrs, n.rxErrs),
+				TxErrorsSec:  rate(p.txErrs, n.txErrs),
+			}
+			stats.Interfaces = append(stats.Interfaces, iface)
+			stats.NetRxBytesSec += iface.RxBytesSec
+			stats.NetTxBytesSec += iface.TxBytesSec
+			stats.NetRxPacketsSec += iface.RxPacketsSec
+			stats.NetTxPacketsSec += iface.TxPacketsSec
+		}
+	}
+	return stats
+}
+
+// latency returns the average time in milliseconds spent per request
+// between two samples, zero when no request completed.
+func latency(prevTimes, curTimes, prevReqs, curReqs uint64) float64 {
+	reqs := delta(prevReqs, curReqs)
+	if reqs == 0 {
+		return 0
+	}
+	return float64(delta(prevTimes, curTimes)) / float64(reqs) / 1e6
+}
+
+// delta returns the increase of a counter, counters which were reset count
+// as not having increased.
+func delta(prev, cur uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
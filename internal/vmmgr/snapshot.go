@@ -0,0 +1,303 @@
+package vmmgr
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ayoubfaouzi/kvm-manager/internal/entity"
+	"github.com/ayoubfaouzi/kvm-manager/internal/hypervisor"
+	"libvirt.org/go/libvirt"
+	"libvirt.org/go/libvirtxml"
+)
+
+// CreateSnapshot creates a snapshot of the vm. Internal snapshots are stored
+// in the qcow2 disks and capture the memory of running vms. External
+// snapshots create an overlay per disk, next to the disk, and capture the
+// memory in a separate file when requested.
+func (vmm VMManager) CreateSnapshot(vmID string, snap entity.Snapshot) (
+	_ entity.Snapshot, err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(vmID)
+	if err != nil {
+		return entity.Snapshot{}, err
+	}
+	defer domain.Free()
+
+	if s, err := domain.SnapshotLookupByName(snap.Name, 0); err == nil {
+		s.Free()
+		return entity.Snapshot{}, hypervisor.ErrSnapshotExists
+	}
+	active, err := domain.IsActive()
+	if err != nil {
+		return entity.Snapshot{}, fmt.Errorf("failed to check domain status: %w", err)
+	}
+	if snap.Memory && !active {
+		return entity.Snapshot{}, hypervisor.ErrSnapshotMemory
+	}
+
+	snapXML := libvirtxml.DomainSnapshot{
+		Name:        snap.Name,
+		Description: snap.Description,
+	}
+	var flags libvirt.DomainSnapshotCreateFlags
+	if snap.Type == entity.SnapshotExternal {
+		name, err := domain.GetName()
+		if err != nil {
+			return entity.Snapshot{}, err
+		}
+		disks, err := vmm.externalSnapshotDisks(domain, snap.Name)
+		if err != nil {
+			return entity.Snapshot{}, err
+		}
+		snapXML.Disks = &libvirtxml.DomainSnapshotDisks{Disks: disks}
+		if snap.Memory {
+			snapXML.Memory = &libvirtxml.DomainSnapshotMemory{
+				Snapshot: "external",
+				File:     filepath.Join(vmm.imgDir, name+"."+snap.Name+".mem"),
+			}
+		} else {
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_DISK_ONLY
+		}
+		if active {
+			flags |= libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC
+		}
+	}
+
+	doc, err := snapXML.Marshal()
+	if err != nil {
+		return entity.Snapshot{}, err
+	}
+	s, err := domain.CreateSnapshotXML(doc, flags)
+	if err != nil {
+		return entity.Snapshot{}, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer s.Free()
+	return parseSnapshot(s)
+}
+
+// externalSnapshotDisks returns the disk definitions of an external
+// snapshot, redirecting each disk to a new overlay.
+func (vmm VMManager) externalSnapshotDisks(domain *libvirt.Domain, snapName string) (
+	[]libvirtxml.DomainSnapshotDisk, error) {
+
+	xmlDesc, err := domain.GetXMLDesc(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get domain XML: %w", err)
+	}
+	var domCfg libvirtxml.Domain
+	if err := xml.Unmarshal([]byte(xmlDesc), &domCfg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal domain XML: %w", err)
+	}
+
+	var disks []libvirtxml.DomainSnapshotDisk
+	for _, disk := range domCfg.Devices.Disks {
+		if disk.Target == nil {
+			continue
+		}
+		if disk.Device != "disk" || disk.Source == nil || disk.Source.File == nil {
+			// Read-only media such as the cloud-init seed are left as is.
+			disks = append(disks, libvirtxml.DomainSnapshotDisk{
+				Name: disk.Target.Dev, Snapshot: "no"})
+			continue
+		}
+		overlay := strings.TrimSuffix(disk.Source.File.File, ".qcow2") +
+			"." + snapName + ".qcow2"
+		disks = append(disks, libvirtxml.DomainSnapshotDisk{
+			Name:     disk.Target.Dev,
+			Snapshot: "external",
+			Driver:   &libvirtxml.DomainDiskDriver{Type: "qcow2"},
+			Source: &libvirtxml.DomainDiskSource{
+				File: &libvirtxml.DomainDiskSourceFile{File: overlay},
+			},
+		})
+	}
+	return disks, nil
+}
+
+// ListSnapshots lists the snapshots of the vm sorted by creation time.
+func (vmm VMManager) ListSnapshots(vmID string) (_ []entity.Snapshot, err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(vmID)
+	if err != nil {
+		return nil, err
+	}
+	defer domain.Free()
+
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for i := range snapshots {
+		defer snapshots[i].Free()
+	}
+
+	snaps := make([]entity.Snapshot, 0, len(snapshots))
+	for i := range snapshots {
+		snap, err := parseSnapshot(&snapshots[i])
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		if snaps[i].CreatedAt.Equal(snaps[j].CreatedAt) {
+			return snaps[i].Name < snaps[j].Name
+		}
+		return snaps[i].CreatedAt.Before(snaps[j].CreatedAt)
+	})
+	return snaps, nil
+}
+
+// GetSnapshot gets a snapshot of the vm.
+func (vmm VMManager) GetSnapshot(vmID, name string) (entity.Snapshot, error) {
+	var snap entity.Snapshot
+	err := vmm.withSnapshot(vmID, name, func(s *libvirt.DomainSnapshot) (err error) {
+		snap, err = parseSnapshot(s)
+		return err
+	})
+	return snap, err
+}
+
+// RevertSnapshot reverts the vm to the snapshot. The vm ends up running if
+// the snapshot captured a running vm, shut off otherwise.
+func (vmm VMManager) RevertSnapshot(vmID, name string) error {
+	// The domain is redefined as captured by the snapshot.
+	defer vmm.descs.drop(vmID)
+	return vmm.withSnapshot(vmID, name, func(s *libvirt.DomainSnapshot) error {
+		return s.RevertToSnapshot(0)
+	})
+}
+
+// DeleteSnapshot deletes the snapshot, merging its data into its children.
+func (vmm VMManager) DeleteSnapshot(vmID, name string) error {
+	return vmm.withSnapshot(vmID, name, func(s *libvirt.DomainSnapshot) error {
+		return s.Delete(0)
+	})
+}
+
+// withSnapshot looks up a snapshot of the vm and calls fn with it.
+func (vmm VMManager) withSnapshot(vmID, name string,
+	fn func(s *libvirt.DomainSnapshot) error) (err error) {
+	defer classifyError(&err)
+
+	domain, err := vmm.conn.LookupDomainByUUIDString(vmID)
+	if err != nil {
+		return err
+	}
+	defer domain.Free()
+
+	s, err := domain.SnapshotLookupByName(name, 0)
+	if err != nil {
+		var lerr libvirt.Error
+		if errors.As(err, &lerr) && lerr.Code == libvirt.ERR_NO_DOMAIN_SNAPSHOT {
+			return hypervisor.ErrSnapshotNotFound
+		}
+		return err
+	}
+	defer s.Free()
+	return fn(s)
+}
+
+// snapshotMemoryFiles returns the memory files of the external snapshots of
+// the domain.
+func snapshotMemoryFiles(domain *libvirt.Domain) ([]string, error) {
+
+	snapshots, err := domain.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for i := range snapshots {
+		defer snapshots[i].Free()
+		snapXML, err := snapshotXML(&snapshots[i])
+		if err != nil {
+			return nil, err
+		}
+		if snapXML.Memory != nil && snapXML.Memory.File != "" {
+			files = append(files, snapXML.Memory.File)
+		}
+	}
+	return files, nil
+}
+
+// snapshotXML retrieves the definition of the snapshot.
+func snapshotXML(s *libvirt.DomainSnapshot) (libvirtxml.DomainSnapshot, error) {
+	var snapXML libvirtxml.DomainSnapshot
+	doc, err := s.GetXMLDesc(0)
+	if err != nil {
+		return snapXML, fmt.Errorf("failed to get snapshot XML: %w", err)
+	}
+	if err := snapXML.Unmarshal(doc); err != nil {
+		return snapXML, fmt.Errorf("failed to unmarshal snapshot XML: %w", err)
+	}
+	return snapXML, nil
+}
+
+// parseSnapshot describes the snapshot.
+func parseSnapshot(s *libvirt.DomainSnapshot) (entity.Snapshot, error) {
+
+	snapXML, err := snapshotXML(s)
+	if err != nil {
+		return entity.Snapshot{}, err
+	}
+	current, err := s.IsCurrent(0)
+	if err != nil {
+		return entity.Snapshot{}, err
+	}
+
+	snap := entity.Snapshot{
+		Name:        snapXML.Name,
+		Description: snapXML.Description,
+		Type:        entity.SnapshotInternal,
+		State:       parseSnapshotState(snapXML.State),
+		Current:     current,
+	}
+	if snapXML.Parent != nil {
+		snap.Parent = snapXML.Parent.Name
+	}
+	if secs, err := strconv.ParseInt(snapXML.CreationTime, 10, 64); err == nil {
+		snap.CreatedAt = time.Unix(secs, 0).UTC()
+	}
+	if snapXML.Memory != nil {
+		snap.Memory = snapXML.Memory.Snapshot != "no"
+		if snapXML.Memory.Snapshot == "external" {
+			snap.Type = entity.SnapshotExternal
+		}
+	}
+	if snapXML.Disks != nil {
+		for _, disk := range snapXML.Disks.Disks {
+			if disk.Snapshot == "external" {
+				snap.Type = entity.SnapshotExternal
+			}
+		}
+	}
+	return snap, nil
+}
+
+// parseSnapshotState parses the state of the vm captured by a snapshot.
+func parseSnapshotState(state string) entity.VMStateType {
+	switch state {
+	case "running", "disk-snapshot":
+		// Disk-only snapshots are only flagged as such when taken live.
+		return entity.VMStateRunning
+	case "paused":
+		return entity.VMStatePaused
+	case "shutoff":
+		return entity.VMStateShutOff
+	case "shutdown":
+		return entity.VMStateShutdown
+	case "crashed":
+		return entity.VMStateCrashed
+	case "pmsuspended":
+		return entity.VMStatePMSuspended
+	}
+	return entity.VMStateUnknown
+}
@@ -78,6 +78,13 @@ func parseInt(value string, defaultValue int) int {
 	return defaultValue
 }
 
+// SetTotal sets the total number of items, for when it is only known once
+// the page is retrieved.
+func (p *Pages) SetTotal(total int) {
+	p.TotalCount = total
+	p.PageCount = (total + p.PerPage - 1) / p.PerPage
+}
+
 // Offset returns the OFFSET value that can be used in a SQL statement.
 func (p *Pages) Offset() int {
 	return (p.Page - 1) * p.PerPage
@@ -85,9 +92,6 @@ func (p *Pages) Offset() int {
 
 // Limit returns the LIMIT value that can be used in a SQL statement.
 func (p *Pages) Limit() int {
-	if p.PerPage > p.TotalCount {
-		return p.TotalCount
-	}
 	return p.PerPage
 }
 
@@ -43,6 +43,15 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestPages_SetTotal(t *testing.T) {
+	p := New(4, 20, -1)
+	p.SetTotal(50)
+	assert.Equal(t, 4, p.Page)
+	assert.Equal(t, 50, p.TotalCount)
+	assert.Equal(t, 3, p.PageCount)
+	assert.Equal(t, 60, p.Offset())
+}
+
 func TestPages_BuildLinkHeader(t *testing.T) {
 	baseURL := "/tokens"
 	defaultPerPage := 10
@@ -99,4 +108,4 @@ func TestNewFromRequest(t *testing.T) {
 	assert.Equal(t, 20, p.PerPage)
 	assert.Equal(t, 100, p.TotalCount)
 	assert.Equal(t, 5, p.PageCount)
-}
\ No newline at end of file
+}